@@ -1,8 +1,13 @@
 package controllers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
@@ -20,6 +25,7 @@ type AI struct {
 	CoinCode             string
 	UsePercent           float64
 	MinuteToExpires      int
+	OrderPollInterval    time.Duration
 	Duration             time.Duration
 	PastPeriod           int
 	SignalEvents         *models.SignalEvents
@@ -27,48 +33,131 @@ type AI struct {
 	TradeSemaphore       *semaphore.Weighted
 	StopLimit            float64
 	StopLimitPercent     float64
+	UseSpecialOrder      bool
+	TakeProfitPercent    float64
+	OrderBook            *bitflyer.OrderBook
+	MaxSlippagePercent   float64
+	MarginTrading        bool
+	Leverage             float64
 	BackTest             bool
 	StartTrade           time.Time
+
+	// 特殊注文モードで保有中のポジションに紐づく IFDOCO の受付ID
+	ParentOrderAcceptanceID string
+	// 起動時に SignalEvents と取引所の約定履歴を照合した結果
+	ReconcileReport *ReconcileReport
+	// Realtime API が切断されている間は 1 になり、トレードを止める
+	streamPaused int32
+	// child_order_events で受け取った受付IDごとの約定状況
+	orderFills orderFills
+	// キャンセルされたら新しい注文を止め、約定待ちの注文を確認して終了する
+	ctx context.Context
 }
 
-// グローバルで宣言
-var Ai *AI
+// 商品ごとの AI をグローバルで宣言 (Web サーバーを起動する前に登録し、その後は読み込むだけにする)
+var AIs = map[string]*AI{}
+
+// IFDOCO の利確・損切り注文の有効期限 (分)。ポジションを保有している間は残しておきたいので最大値にする
+const specialOrderMinuteToExpires = 43200
+
+// 停止する時に、約定を待っていた注文の状態を最後に確認するまでの時間
+const reconcileTimeout = 10 * time.Second
 
-func NewAI(productCode string, duration time.Duration, pastPeriod int, UsePercent, stopLimitPercent float64, backTest bool) *AI {
-	apiClient := bitflyer.New(config.Config.APIKey, config.Config.APISecret)
+// API の残りのリクエスト数がこの割合を下回ったら、注文以外の API 呼び出しを控える
+const rateLimitLowRatio = 0.1
+
+// config.ini の接続先の設定を反映した APIClient を作成する function
+func newAPIClient() *bitflyer.APIClient {
+	var opts []bitflyer.Option
+	if config.Config.BaseURL != "" {
+		opts = append(opts, bitflyer.WithBaseURL(config.Config.BaseURL))
+	}
+	if config.Config.WebSocketURL != "" {
+		opts = append(opts, bitflyer.WithWebSocketURL(config.Config.WebSocketURL))
+	}
+	return bitflyer.New(config.Config.APIKey, config.Config.APISecret, opts...)
+}
+
+// 商品ごとの AI を作成して AIs に登録する function (商品コードが BTC_JPY の形でなければエラーを返す)
+func NewAI(ctx context.Context, productCode string, duration time.Duration, pastPeriod int, UsePercent, stopLimitPercent float64, backTest bool) (*AI, error) {
+	// FX_BTC_JPY のような証拠金取引の商品も BTC と JPY に分ける
+	codes := strings.Split(strings.TrimPrefix(productCode, "FX_"), "_")
+	if len(codes) != 2 || codes[0] == "" || codes[1] == "" {
+		return nil, fmt.Errorf("invalid product code: %q", productCode)
+	}
+	apiClient := newAPIClient()
 	var signalEvents *models.SignalEvents
 	// バックテストの場合
 	if backTest {
 		signalEvents = models.NewSignalEvents()
 	} else {
 		// 再起動などを行なった際に、購入か売却かを判断する
-		signalEvents = models.GetSignalEventsByCount(1)
-	}
-	codes := strings.Split(productCode, "_")
-
-	// グローバルで宣言したAIに格納する
-	Ai = &AI{
-		API:              apiClient,
-		ProductCode:      productCode,
-		CoinCode:         codes[0],
-		CurrencyCode:     codes[1],
-		UsePercent:       UsePercent,
-		MinuteToExpires:  1,
-		PastPeriod:       pastPeriod,
-		Duration:         duration,
-		SignalEvents:     signalEvents,
-		TradeSemaphore:   semaphore.NewWeighted(1),
-		BackTest:         backTest,
-		StartTrade:       time.Now(),
-		StopLimitPercent: stopLimitPercent,
+		signalEvents = models.GetSignalEventsByCount(productCode, 1)
+		if signalEvents == nil {
+			signalEvents = models.NewSignalEvents()
+		}
+	}
+	signalEvents.AllowShort = config.Config.MarginTrading
+
+	ai := &AI{
+		API:                apiClient,
+		ProductCode:        productCode,
+		CoinCode:           codes[0],
+		CurrencyCode:       codes[1],
+		UsePercent:         UsePercent,
+		MinuteToExpires:    1,
+		OrderPollInterval:  time.Second,
+		PastPeriod:         pastPeriod,
+		Duration:           duration,
+		SignalEvents:       signalEvents,
+		TradeSemaphore:     semaphore.NewWeighted(1),
+		BackTest:           backTest,
+		StartTrade:         time.Now(),
+		StopLimitPercent:   stopLimitPercent,
+		UseSpecialOrder:    config.Config.UseSpecialOrder,
+		TakeProfitPercent:  config.Config.TakeProfitPercent,
+		OrderBook:          bitflyer.NewOrderBook(productCode),
+		MaxSlippagePercent: config.Config.MaxSlippagePercent,
+		MarginTrading:      config.Config.MarginTrading,
+		Leverage:           config.Config.Leverage,
+		ctx:                ctx,
+	}
+	// 証拠金取引では、取引所で保有している建玉からポジションを復元する
+	if ai.MarginTrading && !backTest {
+		if err := ai.SyncPosition(); err != nil {
+			log.Printf("action=NewAI err=%s", err.Error())
+		}
+	}
+	// 記録している売買と取引所の約定が食い違っていないか確認する
+	if !backTest {
+		report, err := ai.ReconcileSignalEvents()
+		if err != nil {
+			log.Printf("action=NewAI err=%s", err.Error())
+		}
+		ai.ReconcileReport = report
 	}
 	// インディケータの最適値を入れる
-	Ai.UpdateOptimizeParams()
-	return Ai
+	ai.UpdateOptimizeParams()
+	// グローバルで宣言した AIs に商品ごとに格納する
+	AIs[productCode] = ai
+	return ai, nil
 }
 
+// インディケータを最適化する function
+// キャンドルを取得できなかった場合は、前回の最適値をそのまま使う
 func (ai *AI) UpdateOptimizeParams() {
-	df, _ := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+	var df *models.DataFrameCandle
+	var err error
+	// バックテストで期間を指定した場合は、暴落した週などその期間のキャンドルで最適化する
+	if config.Config.BackTestRange() {
+		df, err = models.GetCandlesBetween(ai.ProductCode, ai.Duration, config.Config.BackTestFrom, config.Config.BackTestTo)
+	} else {
+		df, err = models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+	}
+	if err != nil {
+		log.Printf("action=UpdateOptimizeParams status=keep_params params=%+v err=%s", ai.OptimizedTradeParams, err.Error())
+		return
+	}
 	// インディケータの最適化した結果を ai に格納する
 	ai.OptimizedTradeParams = df.OptimizeParams()
 	log.Printf("optimized_trade_params=%+v", ai.OptimizedTradeParams)
@@ -78,11 +167,75 @@ func (ai *AI) UpdateOptimizeParams() {
 func (ai *AI) Buy(candle models.Candle) (childOrderAcceptanceID string, isOrderCompleted bool) {
 	// アカウントを持っていない為、バックテストで実行
 	if ai.BackTest {
-		couldBuy := ai.SignalEvents.Buy(ai.ProductCode, candle.Time, candle.Close, 1.0, false)
+		couldBuy := ai.SignalEvents.Buy(ai.ProductCode, candle.Time, candle.BuyPrice(), 1.0, false)
 		return "", couldBuy
 	}
 
 	// アカウントを持っている場合、実際の購入を実行できる
+	// 起動前のキャンドルで過去のシグナルに反応して注文しないようにする
+	if ai.StartTrade.After(candle.Time) || !ai.SignalEvents.CanBuy(candle.Time) {
+		return
+	}
+	// 板が停止している間は注文を出さない
+	if !ai.IsMarketTradable() {
+		return
+	}
+
+	// 期限内に約定しなかった指値注文を先にキャンセルしておく
+	ai.CancelStaleOrders()
+
+	ticker, err := ai.API.GetTickerContext(ai.ctx, ai.ProductCode)
+	if err != nil {
+		log.Printf("action=Buy err=%s", err.Error())
+		return
+	}
+	var size float64
+	if ai.MarginTrading {
+		// ショートを保有していれば決済し、無ければ証拠金の範囲でロングを建てる
+		size = ai.GetMarginOrderSize("BUY", ticker.BestAsk)
+	} else {
+		// 残高のうち UsePercent 分の金額で買えるサイズを計算する
+		availableCurrency, _ := ai.GetAvailableBalance()
+		useCurrency := availableCurrency * ai.UsePercent
+		size = ai.AdjustSize(useCurrency / ticker.BestAsk)
+		if size <= 0 {
+			log.Printf("action=Buy status=no_balance available=%f", availableCurrency)
+		}
+	}
+	if size <= 0 {
+		return
+	}
+	if ai.IsSlippageTooLarge("BUY", size) {
+		return
+	}
+
+	// 特殊注文モードでは IFDOCO で利確と損切りまでまとめて発注する (ショートの決済には使わない)
+	if ai.UseSpecialOrder && !ai.SignalEvents.IsShort() {
+		return ai.BuyWithSpecialOrder(candle, size, ticker.BestAsk)
+	}
+
+	order := &bitflyer.Order{
+		ProductCode:     ai.ProductCode,
+		ChildOrderType:  "MARKET",
+		Side:            "BUY",
+		Size:            size,
+		MinuteToExpires: ai.MinuteToExpires,
+		TimeInForce:     "GTC",
+	}
+	log.Printf("status=order candle=%+v order=%+v", candle, order)
+	resp, err := ai.API.SendChildOrderContext(ai.ctx, order)
+	if err != nil {
+		ai.logOrderError("Buy", err)
+		return
+	}
+	childOrderAcceptanceID = resp.ChildOrderAcceptanceID
+	if childOrderAcceptanceID == "" {
+		log.Printf("action=Buy status=not_accepted order=%+v", order)
+		return
+	}
+
+	// 注文が約定するまで待ってから SignalEvents に記録する
+	isOrderCompleted = ai.WaitUntilOrderComplete(childOrderAcceptanceID, candle.Time)
 	return childOrderAcceptanceID, isOrderCompleted
 }
 
@@ -90,16 +243,412 @@ func (ai *AI) Buy(candle models.Candle) (childOrderAcceptanceID string, isOrderC
 func (ai *AI) Sell(candle models.Candle) (childOrderAcceptanceID string, isOrderCompleted bool) {
 	// アカウントを持っていない為、バックテストで実行
 	if ai.BackTest {
-		couldSell := ai.SignalEvents.Sell(ai.ProductCode, candle.Time, candle.Close, 1.0, false)
+		couldSell := ai.SignalEvents.Sell(ai.ProductCode, candle.Time, candle.SellPrice(), 1.0, false)
 		return "", couldSell
 	}
 
 	// アカウントを持っている場合、実際の売却を実行できる
+	if ai.StartTrade.After(candle.Time) || !ai.SignalEvents.CanSell(candle.Time) {
+		return
+	}
+	// 板が停止している間は注文を出さない
+	if !ai.IsMarketTradable() {
+		return
+	}
+
+	// 特殊注文で発注済みの利確・損切り注文が残っていれば先に取り消す
+	if ai.ParentOrderAcceptanceID != "" {
+		if err := ai.API.CancelParentOrderContext(ai.ctx, ai.ProductCode, ai.ParentOrderAcceptanceID); err != nil {
+			log.Printf("action=Sell err=%s", err.Error())
+			return
+		}
+		ai.ParentOrderAcceptanceID = ""
+	}
+
+	// 期限内に約定しなかった指値注文を先にキャンセルしておく
+	ai.CancelStaleOrders()
+
+	var size float64
+	if ai.MarginTrading {
+		// ロングを保有していれば決済し、無ければ証拠金の範囲でショートを建てる
+		ticker, err := ai.API.GetTickerContext(ai.ctx, ai.ProductCode)
+		if err != nil {
+			log.Printf("action=Sell err=%s", err.Error())
+			return
+		}
+		size = ai.GetMarginOrderSize("SELL", ticker.BestBid)
+	} else {
+		// ボットが購入したサイズだけを売却する (ボット以外で保有しているコインは売らない)
+		bought := ai.SignalEvents.BoughtSize()
+		_, availableCoin := ai.GetAvailableBalance()
+		size = ai.AdjustSize(math.Min(bought, availableCoin))
+		if size <= 0 {
+			log.Printf("action=Sell status=no_coin bought=%f available=%f", bought, availableCoin)
+		}
+	}
+	if size <= 0 {
+		return
+	}
+	if ai.IsSlippageTooLarge("SELL", size) {
+		return
+	}
+
+	order := &bitflyer.Order{
+		ProductCode:     ai.ProductCode,
+		ChildOrderType:  "MARKET",
+		Side:            "SELL",
+		Size:            size,
+		MinuteToExpires: ai.MinuteToExpires,
+		TimeInForce:     "GTC",
+	}
+	log.Printf("status=order candle=%+v order=%+v", candle, order)
+	resp, err := ai.API.SendChildOrderContext(ai.ctx, order)
+	if err != nil {
+		ai.logOrderError("Sell", err)
+		return
+	}
+	childOrderAcceptanceID = resp.ChildOrderAcceptanceID
+	if childOrderAcceptanceID == "" {
+		log.Printf("action=Sell status=not_accepted order=%+v", order)
+		return
+	}
+
+	// 注文が約定するまで待ってから SignalEvents に記録する
+	isOrderCompleted = ai.WaitUntilOrderComplete(childOrderAcceptanceID, candle.Time)
 	return childOrderAcceptanceID, isOrderCompleted
 }
 
+// 注文が失敗した理由ごとにログを出し分ける function
+func (ai *AI) logOrderError(action string, err error) {
+	switch {
+	case errors.Is(err, bitflyer.ErrInsufficientFunds):
+		log.Printf("action=%s status=insufficient_funds err=%s", action, err.Error())
+	case errors.Is(err, bitflyer.ErrRateLimited):
+		log.Printf("action=%s status=rate_limited err=%s", action, err.Error())
+	case errors.Is(err, bitflyer.ErrUnderMaintenance):
+		log.Printf("action=%s status=under_maintenance err=%s", action, err.Error())
+	case errors.Is(err, bitflyer.ErrInvalidSignature):
+		// APIキーかシークレットキーが間違っているので、再起動するまで注文は通らない
+		log.Printf("action=%s status=invalid_signature check api_key and api_secret in config.ini err=%s", action, err.Error())
+	default:
+		log.Printf("action=%s err=%s", action, err.Error())
+	}
+}
+
+// MinuteToExpires を過ぎても約定していない指値注文をキャンセルする function
+func (ai *AI) CancelStaleOrders() {
+	// API 制限に近い時は注文のためにリクエストを残しておく
+	if ai.API.IsRateLimitLow(rateLimitLowRatio) {
+		log.Printf("action=CancelStaleOrders status=skip budget=%+v", ai.API.RateLimitBudget())
+		return
+	}
+	orders, err := ai.API.ListChildOrdersContext(ai.ctx, &bitflyer.ListChildOrdersParams{
+		ProductCode:     ai.ProductCode,
+		ChildOrderState: "ACTIVE",
+	})
+	if err != nil {
+		return
+	}
+	expire := time.Now().UTC().Add(-time.Minute * time.Duration(ai.MinuteToExpires))
+	for _, order := range orders {
+		if order.ChildOrderType != "LIMIT" || order.DateTime().After(expire) {
+			continue
+		}
+		log.Printf("action=CancelStaleOrders order=%+v", order)
+		if err := ai.API.CancelChildOrderContext(ai.ctx, ai.ProductCode, order.ChildOrderAcceptanceID); err != nil {
+			log.Printf("action=CancelStaleOrders err=%s", err.Error())
+		}
+	}
+}
+
+// 板をもとに size 分を成行で注文した時の最良気配からの滑りの割合を見積もる function
+func (ai *AI) EstimateSlippage(side string, size float64) (slippage float64, ok bool) {
+	if ai.OrderBook == nil || !ai.OrderBook.Synced() {
+		return 0, false
+	}
+	vwap, ok := ai.OrderBook.VWAP(side, size)
+	if !ok {
+		return 0, false
+	}
+	if side == "BUY" {
+		best, ok := ai.OrderBook.BestAsk()
+		if !ok {
+			return 0, false
+		}
+		return (vwap - best.Price) / best.Price, true
+	}
+	best, ok := ai.OrderBook.BestBid()
+	if !ok {
+		return 0, false
+	}
+	return (best.Price - vwap) / best.Price, true
+}
+
+// 見積もった滑りが MaxSlippagePercent を超えているか判定する function
+// 板が同期できていない時は判断できないので注文を止めない
+func (ai *AI) IsSlippageTooLarge(side string, size float64) bool {
+	if ai.MaxSlippagePercent <= 0 {
+		return false
+	}
+	slippage, ok := ai.EstimateSlippage(side, size)
+	if !ok {
+		log.Printf("action=IsSlippageTooLarge status=no_book side=%s size=%f", side, size)
+		return false
+	}
+	if slippage > ai.MaxSlippagePercent {
+		log.Printf("action=IsSlippageTooLarge status=skip side=%s size=%f slippage=%f", side, size, slippage)
+		return true
+	}
+	return false
+}
+
+// 板の状態が RUNNING で、取引所が停止していなければ true を返す function
+func (ai *AI) IsMarketTradable() bool {
+	boardState, err := ai.API.GetBoardStateContext(ai.ctx, ai.ProductCode)
+	if err != nil {
+		log.Printf("action=IsMarketTradable err=%s", err.Error())
+		return false
+	}
+	if !boardState.IsTradable() {
+		log.Printf("action=IsMarketTradable status=skip state=%s health=%s", boardState.State, boardState.Health)
+		return false
+	}
+	return true
+}
+
+// 残高から使用可能な通貨とコインの量を返す function
+func (ai *AI) GetAvailableBalance() (availableCurrency, availableCoin float64) {
+	balances, err := ai.API.GetBalanceContext(ai.ctx)
+	if err != nil {
+		return
+	}
+	for _, balance := range balances {
+		if balance.CurrentCode == ai.CurrencyCode {
+			availableCurrency = balance.Available
+		} else if balance.CurrentCode == ai.CoinCode {
+			availableCoin = balance.Available
+		}
+	}
+	return availableCurrency, availableCoin
+}
+
+// 注文サイズを取引所が受け付ける桁数に切り捨てる function
+func (ai *AI) AdjustSize(size float64) float64 {
+	return math.Floor(size*10000) / 10000
+}
+
+// 受付IDの注文が約定するまでポーリングし、約定したら SignalEvents に記録する function
+func (ai *AI) WaitUntilOrderComplete(childOrderAcceptanceID string, executeTime time.Time) bool {
+	// child_order_events で約定が届けばすぐに、届かなければポーリングで約定を確認する
+	fill := ai.orderFills.get(childOrderAcceptanceID)
+	defer ai.orderFills.delete(childOrderAcceptanceID)
+	order := ai.pollCompletedOrder(func(ctx context.Context) (*bitflyer.ChildOrder, error) {
+		return ai.API.GetChildOrderContext(ctx, ai.ProductCode, childOrderAcceptanceID)
+	}, fill)
+	if order == nil {
+		log.Printf("action=WaitUntilOrderComplete status=timeout child_order_acceptance_id=%s", childOrderAcceptanceID)
+		return false
+	}
+	return ai.recordOrder(order, executeTime)
+}
+
+// fetch で取得した注文が約定するまで MinuteToExpires の間ポーリングする function
+// fill が渡された場合は、Private チャネルで約定を受け取った時点で返す
+func (ai *AI) pollCompletedOrder(fetch func(context.Context) (*bitflyer.ChildOrder, error), fill *orderFill) *bitflyer.ChildOrder {
+	expire := time.After(time.Minute * time.Duration(ai.MinuteToExpires))
+	interval := time.NewTicker(ai.OrderPollInterval)
+	defer interval.Stop()
+	var filled <-chan struct{}
+	if fill != nil {
+		filled = fill.done
+	}
+	for {
+		select {
+		case <-filled:
+			if !fill.filled {
+				return nil
+			}
+			return fill.childOrder()
+		case <-interval.C:
+			order, err := fetch(ai.ctx)
+			if err != nil || order == nil || order.ChildOrderState != "COMPLETED" {
+				continue
+			}
+			return order
+		case <-expire:
+			return nil
+		case <-ai.ctx.Done():
+			return ai.reconcileOrder(fetch)
+		}
+	}
+}
+
+// 停止する前に約定待ちの注文をもう一度だけ確認する function
+// 既に約定していれば記録できるように、キャンセルされた ctx とは別の ctx で取得する
+func (ai *AI) reconcileOrder(fetch func(context.Context) (*bitflyer.ChildOrder, error)) *bitflyer.ChildOrder {
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+	order, err := fetch(ctx)
+	if err != nil || order == nil || order.ChildOrderState != "COMPLETED" {
+		log.Printf("action=reconcileOrder status=unreconciled order=%+v err=%v", order, err)
+		return nil
+	}
+	log.Printf("action=reconcileOrder status=completed order=%+v", order)
+	return order
+}
+
+// 約定した価格とサイズで SignalEvents に記録し、DBにも保存する function
+func (ai *AI) recordOrder(order *bitflyer.ChildOrder, executeTime time.Time) bool {
+	if order.Side == "BUY" {
+		return ai.SignalEvents.Buy(ai.ProductCode, executeTime, order.AveragePrice, order.ExecutedSize, true)
+	}
+	if order.Side == "SELL" {
+		return ai.SignalEvents.Sell(ai.ProductCode, executeTime, order.AveragePrice, order.ExecutedSize, true)
+	}
+	return false
+}
+
+// IFDOCO で成行の購入と、利確の指値・損切りの逆指値の売却を同時に発注する function
+func (ai *AI) BuyWithSpecialOrder(candle models.Candle, size, price float64) (parentOrderAcceptanceID string, isOrderCompleted bool) {
+	takeProfit := math.Floor(price * ai.TakeProfitPercent)
+	stopLimit := math.Floor(price * ai.StopLimitPercent)
+	order := &bitflyer.ParentOrder{
+		OrderMethod:     "IFDOCO",
+		MinuteToExpires: specialOrderMinuteToExpires,
+		TimeInForce:     "GTC",
+		Parameters: []bitflyer.ParentOrderParameter{
+			{ProductCode: ai.ProductCode, ConditionType: "MARKET", Side: "BUY", Size: size},
+			{ProductCode: ai.ProductCode, ConditionType: "LIMIT", Side: "SELL", Price: takeProfit, Size: size},
+			{ProductCode: ai.ProductCode, ConditionType: "STOP", Side: "SELL", TriggerPrice: stopLimit, Size: size},
+		},
+	}
+	log.Printf("status=order candle=%+v order=%+v", candle, order)
+	resp, err := ai.API.SendParentOrderContext(ai.ctx, order)
+	if err != nil {
+		ai.logOrderError("BuyWithSpecialOrder", err)
+		return
+	}
+	parentOrderAcceptanceID = resp.ParentOrderAcceptanceID
+	if parentOrderAcceptanceID == "" {
+		log.Printf("action=BuyWithSpecialOrder status=not_accepted order=%+v", order)
+		return
+	}
+
+	// IFD の最初の成行注文が約定するまで待ってから SignalEvents に記録する
+	entry := ai.pollCompletedOrder(func(ctx context.Context) (*bitflyer.ChildOrder, error) {
+		return ai.GetSpecialOrderChild(ctx, parentOrderAcceptanceID, "BUY")
+	}, nil)
+	if entry != nil {
+		ai.ParentOrderAcceptanceID = parentOrderAcceptanceID
+	} else {
+		log.Printf("action=BuyWithSpecialOrder status=timeout parent_order_acceptance_id=%s", parentOrderAcceptanceID)
+		// 後から約定して、ポジションが無いと思っている間に利確・損切りが約定しないように取り消す
+		var canceled bool
+		entry, canceled = ai.cancelSpecialOrder(parentOrderAcceptanceID)
+		if entry == nil {
+			return parentOrderAcceptanceID, false
+		}
+		// 取り消せなかった場合は利確・損切りが残っているので、保有中の IFDOCO として扱う
+		if !canceled {
+			ai.ParentOrderAcceptanceID = parentOrderAcceptanceID
+		}
+	}
+	isOrderCompleted = ai.recordOrder(entry, candle.Time)
+	if isOrderCompleted {
+		ai.StopLimit = stopLimit
+	}
+	return parentOrderAcceptanceID, isOrderCompleted
+}
+
+// 約定を確認できなかった IFDOCO を取り消し、取り消す前に約定していた最初の注文と取り消せたかを返す function
+// 停止中でも取り消せるように、キャンセルされた ctx とは別の ctx で取り消す
+func (ai *AI) cancelSpecialOrder(parentOrderAcceptanceID string) (entry *bitflyer.ChildOrder, canceled bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+	if err := ai.API.CancelParentOrderContext(ctx, ai.ProductCode, parentOrderAcceptanceID); err != nil {
+		log.Printf("action=cancelSpecialOrder parent_order_acceptance_id=%s err=%s", parentOrderAcceptanceID, err.Error())
+	} else {
+		canceled = true
+	}
+	entry, err := ai.GetSpecialOrderChild(ctx, parentOrderAcceptanceID, "BUY")
+	if err != nil || entry == nil {
+		log.Printf("action=cancelSpecialOrder status=not_filled parent_order_acceptance_id=%s canceled=%t", parentOrderAcceptanceID, canceled)
+		return nil, canceled
+	}
+	log.Printf("action=cancelSpecialOrder status=filled parent_order_acceptance_id=%s canceled=%t order=%+v", parentOrderAcceptanceID, canceled, entry)
+	return entry, canceled
+}
+
+// IFDOCO から、指定した side の約定済みの子注文を取得する function
+func (ai *AI) GetSpecialOrderChild(ctx context.Context, parentOrderAcceptanceID, side string) (*bitflyer.ChildOrder, error) {
+	detail, err := ai.API.GetParentOrderContext(ctx, parentOrderAcceptanceID)
+	if err != nil || detail.ParentOrderID == "" {
+		return nil, err
+	}
+	orders, err := ai.API.ListChildOrdersContext(ctx, &bitflyer.ListChildOrdersParams{
+		ProductCode:   ai.ProductCode,
+		ParentOrderID: detail.ParentOrderID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		if orders[i].Side == side && orders[i].ChildOrderState == "COMPLETED" {
+			return &orders[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// 取引所側で利確・損切りが約定していれば SignalEvents に売却を記録する function
+func (ai *AI) SyncSpecialOrder(executeTime time.Time) {
+	if ai.ParentOrderAcceptanceID == "" {
+		return
+	}
+	exit, err := ai.GetSpecialOrderChild(ai.ctx, ai.ParentOrderAcceptanceID, "SELL")
+	if err != nil || exit == nil {
+		return
+	}
+	log.Printf("action=SyncSpecialOrder status=closed order=%+v", exit)
+	if ai.recordOrder(exit, executeTime) {
+		ai.ParentOrderAcceptanceID = ""
+		ai.StopLimit = 0.0
+		ai.UpdateOptimizeParams()
+	}
+}
+
+// Realtime API の接続状態に応じてトレードを止めたり再開したりする function
+func (ai *AI) OnConnectionEvent(event bitflyer.ConnectionEvent) {
+	switch event.State {
+	case bitflyer.StateConnected:
+		if atomic.SwapInt32(&ai.streamPaused, 0) == 1 {
+			log.Printf("action=OnConnectionEvent status=resume_trade")
+		}
+	case bitflyer.StateDisconnected, bitflyer.StateClosed:
+		if atomic.SwapInt32(&ai.streamPaused, 1) == 0 {
+			log.Printf("action=OnConnectionEvent status=pause_trade err=%v", event.Err)
+		}
+	}
+}
+
+// 実行中のトレードが終わるのを待ってから停止する function
+func (ai *AI) Shutdown() {
+	ai.TradeSemaphore.Acquire(context.Background(), 1)
+	defer ai.TradeSemaphore.Release(1)
+	log.Printf("action=Shutdown status=stopped product_code=%s", ai.ProductCode)
+}
+
 // トレードを行う function
 func (ai *AI) Trade() {
+	// 停止中は新しい注文を出さない
+	if ai.ctx.Err() != nil {
+		return
+	}
+	// データが途切れている間は古いキャンドルで判断しないように止める
+	if atomic.LoadInt32(&ai.streamPaused) == 1 {
+		log.Println("Trade is paused while the realtime stream is disconnected")
+		return
+	}
 	isAcquire := ai.TradeSemaphore.TryAcquire(1)
 	if !isAcquire {
 		log.Println("Could not get trade lock")
@@ -107,9 +656,25 @@ func (ai *AI) Trade() {
 	}
 	defer ai.TradeSemaphore.Release(1)
 	params := ai.OptimizedTradeParams
-	df, _ := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+	// まだ一度も最適化できていない場合は、どのインディケータを使うか決められない
+	if params == nil {
+		log.Printf("action=Trade status=no_params product_code=%s", ai.ProductCode)
+		return
+	}
+	df, err := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+	if err != nil {
+		log.Printf("action=Trade err=%s", err.Error())
+		return
+	}
 	lenCandles := len(df.Candles)
 
+	// 特殊注文モードでは損切りを取引所の逆指値に任せる
+	exchangeStop := ai.UseSpecialOrder && !ai.BackTest
+	// API 制限に近い時は parent_order_events で決済を反映するのに任せる
+	if exchangeStop && lenCandles > 0 && !ai.API.IsRateLimitLow(rateLimitLowRatio) {
+		ai.SyncSpecialOrder(df.Candles[lenCandles-1].Time)
+	}
+
 	// 最適化された値を取得して、Enableであれば使用
 	var emaValues1 []float64
 	var emaValues2 []float64
@@ -202,23 +767,38 @@ func (ai *AI) Trade() {
 		}
 
 		// buyPointが０以上であれば購入（最適化されたインディケータが buyPoint++ すれば購入）
-		if buyPoint > 0 {
+		// ショートを保有中に、終値が StopLimit より上昇した場合は買い戻す
+		isShort := ai.SignalEvents.IsShort()
+		if buyPoint > 0 || (isShort && ai.StopLimit > 0 && ai.StopLimit < df.Candles[i].Close) {
 			_, isOrderCompleted := ai.Buy(df.Candles[i])
 			if !isOrderCompleted {
 				continue
 			}
-			// 終値に設定したパーセンテージを掛けた値に達した場合終了
-			ai.StopLimit = df.Candles[i].Close * ai.StopLimitPercent
+			if isShort {
+				// ショートを決済した
+				ai.StopLimit = 0.0
+				ai.UpdateOptimizeParams()
+			} else {
+				// 終値に設定したパーセンテージを掛けた値に達した場合終了
+				ai.StopLimit = df.Candles[i].Close * ai.StopLimitPercent
+			}
 		}
 
 		// 終値が StopLimit より下降した場合、もしくは SellPoint++ した場合売却
-		if sellPoint > 0 || ai.StopLimit > df.Candles[i].Close {
+		isShort = ai.SignalEvents.IsShort()
+		if sellPoint > 0 || (!isShort && !exchangeStop && ai.StopLimit > df.Candles[i].Close) {
+			isLong := ai.SignalEvents.IsLong()
 			_, isOrderCompleted := ai.Sell(df.Candles[i])
 			if !isOrderCompleted {
 				continue
 			}
-			ai.StopLimit = 0.0
-			ai.UpdateOptimizeParams()
+			if ai.SignalEvents.AllowShort && !isLong {
+				// ショートを新しく建てた場合は、終値から StopLimitPercent 分上昇した所で損切りする
+				ai.StopLimit = df.Candles[i].Close * (2 - ai.StopLimitPercent)
+			} else {
+				ai.StopLimit = 0.0
+				ai.UpdateOptimizeParams()
+			}
 		}
 	}
 }
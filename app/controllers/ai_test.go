@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+	"golang.org/x/sync/semaphore"
+)
+
+// テストで注文を出すキャンドルの時間
+var testTime = time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+const testAcceptanceID = "JRF20200101-100000-000001"
+
+// fakeExchange bitflyer の REST API の代わりに残高・Ticker・注文の状態を返すテスト用のサーバー
+type fakeExchange struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	boardState   string
+	balances     []bitflyer.Balance
+	collateral   bitflyer.Collateral
+	ticker       bitflyer.Ticker
+	acceptanceID string
+	// getchildorders の n 回目に返す注文の状態 ("" はまだ一覧に反映されていない)
+	states []string
+	fill   bitflyer.ChildOrder
+	orders []bitflyer.Order
+	polls  int
+}
+
+func newFakeExchange(t *testing.T) *fakeExchange {
+	f := &fakeExchange{boardState: "RUNNING", acceptanceID: testAcceptanceID}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeExchange) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/v1/getboardstate":
+		json.NewEncoder(w).Encode(bitflyer.BoardState{Health: "NORMAL", State: f.boardState})
+	case "/v1/me/getbalance":
+		json.NewEncoder(w).Encode(f.balances)
+	case "/v1/me/getcollateral":
+		json.NewEncoder(w).Encode(f.collateral)
+	case "/v1/ticker":
+		json.NewEncoder(w).Encode(f.ticker)
+	case "/v1/me/sendchildorder":
+		var order bitflyer.Order
+		json.NewDecoder(r.Body).Decode(&order)
+		f.orders = append(f.orders, order)
+		json.NewEncoder(w).Encode(bitflyer.ResponseSendChildOrder{ChildOrderAcceptanceID: f.acceptanceID})
+	case "/v1/me/getchildorders":
+		orders := []bitflyer.ChildOrder{}
+		if r.URL.Query().Get("child_order_acceptance_id") == f.acceptanceID && len(f.states) > 0 {
+			state := f.states[len(f.states)-1]
+			if f.polls < len(f.states) {
+				state = f.states[f.polls]
+			}
+			f.polls++
+			if state != "" {
+				order := f.fill
+				order.ChildOrderAcceptanceID = f.acceptanceID
+				order.ChildOrderState = state
+				orders = append(orders, order)
+			}
+		}
+		json.NewEncoder(w).Encode(orders)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fake のサーバーに注文を出す AI を作成する
+func newTestAI(f *fakeExchange, signals []models.SignalEvent) *AI {
+	return &AI{
+		ctx:               context.Background(),
+		API:               bitflyer.New("key", "secret", bitflyer.WithBaseURL(f.URL+"/v1/")),
+		ProductCode:       "BTC_JPY",
+		CoinCode:          "BTC",
+		CurrencyCode:      "JPY",
+		UsePercent:        0.5,
+		MinuteToExpires:   1,
+		OrderPollInterval: time.Millisecond,
+		SignalEvents:      &models.SignalEvents{Signals: signals},
+		TradeSemaphore:    semaphore.NewWeighted(1),
+		StartTrade:        testTime.Add(-time.Hour),
+	}
+}
+
+// 約定した注文を一時ファイルの SQLite に保存するように Repo を差し替える
+func useTestDB(t *testing.T) {
+	t.Helper()
+	repo, err := models.OpenRepository("sqlite3", filepath.Join(t.TempDir(), "test.sql"))
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if err := repo.Migrate(); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	prev := models.Repo
+	models.Repo = repo
+	t.Cleanup(func() {
+		models.Repo = prev
+		repo.Close()
+	})
+}
+
+func TestAIOrderFlow(t *testing.T) {
+	bought := models.SignalEvent{ProductCode: "BTC_JPY", Time: testTime.Add(-time.Minute), Side: "BUY", Price: 2900000, Size: 0.0166}
+	sold := models.SignalEvent{ProductCode: "BTC_JPY", Time: testTime.Add(-time.Minute), Side: "SELL", Price: 2900000, Size: 0.0166}
+	balances := []bitflyer.Balance{
+		{CurrentCode: "JPY", Amount: 100000, Available: 100000},
+		{CurrentCode: "BTC", Amount: 0.0166, Available: 0.0166},
+	}
+
+	tests := []struct {
+		name         string
+		side         string
+		boardState   string
+		signals      []models.SignalEvent
+		balances     []bitflyer.Balance
+		acceptanceID string
+		states       []string
+		fill         bitflyer.ChildOrder
+		// nil の場合は注文を出さない
+		wantOrder     *bitflyer.Order
+		wantCompleted bool
+		wantSignal    *models.SignalEvent
+	}{
+		{
+			name:         "buy sizes a market order from the balance and records the fill",
+			side:         "BUY",
+			balances:     balances,
+			acceptanceID: testAcceptanceID,
+			states:       []string{"", "ACTIVE", "COMPLETED"},
+			fill:         bitflyer.ChildOrder{Side: "BUY", AveragePrice: 3000100, ExecutedSize: 0.0166},
+			// 100000 * 0.5 / 3000000 = 0.016666... を4桁で切り捨てる
+			wantOrder:     &bitflyer.Order{ProductCode: "BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.0166},
+			wantCompleted: true,
+			wantSignal:    &models.SignalEvent{ProductCode: "BTC_JPY", Time: testTime, Side: "BUY", Price: 3000100, Size: 0.0166},
+		},
+		{
+			name:         "buy without currency sends no order",
+			side:         "BUY",
+			balances:     []bitflyer.Balance{{CurrentCode: "JPY"}},
+			acceptanceID: testAcceptanceID,
+		},
+		{
+			name:         "buy after a buy sends no order",
+			side:         "BUY",
+			signals:      []models.SignalEvent{bought},
+			balances:     balances,
+			acceptanceID: testAcceptanceID,
+		},
+		{
+			name:         "buy while the board is not running sends no order",
+			side:         "BUY",
+			boardState:   "CLOSED",
+			balances:     balances,
+			acceptanceID: testAcceptanceID,
+		},
+		{
+			name:      "buy not accepted records nothing",
+			side:      "BUY",
+			balances:  balances,
+			wantOrder: &bitflyer.Order{ProductCode: "BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.0166},
+		},
+		{
+			name:          "sell sells the coin balance and records the fill",
+			side:          "SELL",
+			signals:       []models.SignalEvent{bought},
+			balances:      balances,
+			acceptanceID:  testAcceptanceID,
+			states:        []string{"ACTIVE", "COMPLETED"},
+			fill:          bitflyer.ChildOrder{Side: "SELL", AveragePrice: 2999900, ExecutedSize: 0.0166},
+			wantOrder:     &bitflyer.Order{ProductCode: "BTC_JPY", ChildOrderType: "MARKET", Side: "SELL", Size: 0.0166},
+			wantCompleted: true,
+			wantSignal:    &models.SignalEvent{ProductCode: "BTC_JPY", Time: testTime, Side: "SELL", Price: 2999900, Size: 0.0166},
+		},
+		{
+			name:         "sell after a sell sends no order",
+			side:         "SELL",
+			signals:      []models.SignalEvent{sold},
+			balances:     balances,
+			acceptanceID: testAcceptanceID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			f := newFakeExchange(t)
+			if tt.boardState != "" {
+				f.boardState = tt.boardState
+			}
+			f.balances = tt.balances
+			f.ticker = bitflyer.Ticker{ProductCode: "BTC_JPY", BestBid: 2999000, BestAsk: 3000000}
+			f.acceptanceID = tt.acceptanceID
+			f.states = tt.states
+			f.fill = tt.fill
+			ai := newTestAI(f, tt.signals)
+
+			candle := models.Candle{ProductCode: "BTC_JPY", Duration: time.Minute, Time: testTime, Close: 3000000}
+			var id string
+			var completed bool
+			if tt.side == "BUY" {
+				id, completed = ai.Buy(candle)
+			} else {
+				id, completed = ai.Sell(candle)
+			}
+
+			if completed != tt.wantCompleted {
+				t.Errorf("completed = %t, want %t", completed, tt.wantCompleted)
+			}
+			if tt.wantOrder == nil {
+				if len(f.orders) != 0 {
+					t.Errorf("orders = %+v, want none", f.orders)
+				}
+			} else {
+				if len(f.orders) != 1 {
+					t.Fatalf("orders = %+v, want 1", f.orders)
+				}
+				got := f.orders[0]
+				want := tt.wantOrder
+				if got.ProductCode != want.ProductCode || got.ChildOrderType != want.ChildOrderType || got.Side != want.Side || got.Size != want.Size {
+					t.Errorf("order = %+v, want %+v", got, *want)
+				}
+				if id != tt.acceptanceID {
+					t.Errorf("child_order_acceptance_id = %q, want %q", id, tt.acceptanceID)
+				}
+			}
+
+			// 約定した場合だけ SignalEvents と DB に記録される
+			wantSignals := len(tt.signals)
+			if tt.wantSignal != nil {
+				wantSignals++
+			}
+			signals := ai.SignalEvents.Signals
+			if len(signals) != wantSignals {
+				t.Fatalf("signals = %+v, want %d", signals, wantSignals)
+			}
+			saved := models.GetSignalEventsAfterTime("BTC_JPY", time.Time{})
+			if tt.wantSignal == nil {
+				if len(saved.Signals) != 0 {
+					t.Errorf("saved signals = %+v, want none", saved.Signals)
+				}
+				return
+			}
+			if got := signals[len(signals)-1]; !sameSignal(got, *tt.wantSignal) {
+				t.Errorf("signal = %+v, want %+v", got, *tt.wantSignal)
+			}
+			if len(saved.Signals) != 1 || !sameSignal(saved.Signals[0], *tt.wantSignal) {
+				t.Errorf("saved signals = %+v, want %+v", saved.Signals, *tt.wantSignal)
+			}
+		})
+	}
+}
+
+func TestWaitUntilOrderComplete(t *testing.T) {
+	tests := []struct {
+		name       string
+		signals    []models.SignalEvent
+		states     []string
+		fill       bitflyer.ChildOrder
+		want       bool
+		wantSignal *models.SignalEvent
+	}{
+		{
+			name:       "polls until the order completes",
+			states:     []string{"", "", "ACTIVE", "ACTIVE", "COMPLETED"},
+			fill:       bitflyer.ChildOrder{Side: "BUY", AveragePrice: 3000100, ExecutedSize: 0.01},
+			want:       true,
+			wantSignal: &models.SignalEvent{ProductCode: "BTC_JPY", Time: testTime, Side: "BUY", Price: 3000100, Size: 0.01},
+		},
+		{
+			name:    "completed order the signals do not allow is not recorded",
+			signals: []models.SignalEvent{{ProductCode: "BTC_JPY", Time: testTime.Add(-time.Minute), Side: "BUY", Price: 2900000, Size: 0.01}},
+			states:  []string{"COMPLETED"},
+			fill:    bitflyer.ChildOrder{Side: "BUY", AveragePrice: 3000100, ExecutedSize: 0.01},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			f := newFakeExchange(t)
+			f.states = tt.states
+			f.fill = tt.fill
+			ai := newTestAI(f, tt.signals)
+
+			if got := ai.WaitUntilOrderComplete(testAcceptanceID, testTime); got != tt.want {
+				t.Errorf("WaitUntilOrderComplete = %t, want %t", got, tt.want)
+			}
+			if f.polls != len(tt.states) {
+				t.Errorf("polls = %d, want %d", f.polls, len(tt.states))
+			}
+			signals := ai.SignalEvents.Signals
+			if tt.wantSignal == nil {
+				if len(signals) != len(tt.signals) {
+					t.Errorf("signals = %+v, want %+v", signals, tt.signals)
+				}
+				return
+			}
+			if got := signals[len(signals)-1]; !sameSignal(got, *tt.wantSignal) {
+				t.Errorf("signal = %+v, want %+v", got, *tt.wantSignal)
+			}
+		})
+	}
+}
+
+func sameSignal(a, b models.SignalEvent) bool {
+	return a.ProductCode == b.ProductCode && a.Time.Equal(b.Time) && a.Side == b.Side && a.Price == b.Price && a.Size == b.Size
+}
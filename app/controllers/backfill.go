@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
+)
+
+// backfill.go 抜けているキャンドルを過去の約定履歴から作り直すファイル
+
+// 1回のリクエストで取得する約定履歴の件数 (bitflyer の上限)
+const backfillPageSize = 500
+
+// apiExecutionSource bitflyer の約定履歴 API から約定履歴を取得するStruct
+type apiExecutionSource struct {
+	api         *bitflyer.APIClient
+	productCode string
+}
+
+func (s *apiExecutionSource) Executions(ctx context.Context, before int) ([]bitflyer.Execution, error) {
+	return s.api.GetExecutionsContext(ctx, &bitflyer.ExecutionsParams{
+		ProductCode: s.productCode,
+		Count:       backfillPageSize,
+		Before:      before,
+	})
+}
+
+// fileExecutionSource 手元に保存した約定履歴のファイルから約定履歴を取得するStruct
+type fileExecutionSource struct {
+	// ID の新しい順に並べた約定履歴
+	executions []bitflyer.Execution
+}
+
+// 約定履歴のファイルを読み込むfunction
+// ファイルは1行に1件の約定履歴を JSON で書いたもの (API のレスポンスと同じ形式) で、並び順は問わない
+func newFileExecutionSource(path string) (*fileExecutionSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	source := &fileExecutionSource{}
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var execution bitflyer.Execution
+		if err := decoder.Decode(&execution); err != nil {
+			return nil, err
+		}
+		source.executions = append(source.executions, execution)
+	}
+	sort.Slice(source.executions, func(i, j int) bool {
+		return source.executions[i].ID > source.executions[j].ID
+	})
+	return source, nil
+}
+
+func (s *fileExecutionSource) Executions(ctx context.Context, before int) ([]bitflyer.Execution, error) {
+	i := 0
+	if before > 0 {
+		i = sort.Search(len(s.executions), func(i int) bool {
+			return s.executions[i].ID < before
+		})
+	}
+	end := i + backfillPageSize
+	if end > len(s.executions) {
+		end = len(s.executions)
+	}
+	return s.executions[i:end], nil
+}
+
+// Backfill productCode の start から end までのキャンドルを約定履歴から作り直す function
+// dumpFile を指定した場合は API の代わりにファイルの約定履歴を使う
+func Backfill(ctx context.Context, productCode string, start, end time.Time, dumpFile string) error {
+	var source models.ExecutionSource = &apiExecutionSource{api: newAPIClient(), productCode: productCode}
+	if dumpFile != "" {
+		fileSource, err := newFileExecutionSource(dumpFile)
+		if err != nil {
+			return err
+		}
+		source = fileSource
+	}
+
+	// 1分以下の期間を約定履歴から作り直し、それより長い期間は1分足からまとめ直す
+	var durations, resampled []time.Duration
+	for _, duration := range config.Config.Durations {
+		if models.IsResampledDuration(duration) {
+			resampled = append(resampled, duration)
+		} else {
+			durations = append(durations, duration)
+		}
+	}
+	if err := models.BackfillCandles(ctx, source, productCode, durations, start, end); err != nil {
+		return err
+	}
+	// 約定が無かった期間も埋めてから、上位の期間をまとめ直す
+	if config.Config.FillGaps {
+		for _, duration := range durations {
+			if _, err := models.FillCandleGaps(productCode, duration, start, end); err != nil {
+				return err
+			}
+		}
+	}
+	for _, duration := range resampled {
+		if err := models.RebuildCandles(productCode, duration, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
+)
+
+// export.go キャンドルと売買のイベントを CSV・Parquet でダウンロードさせるファイル
+// 例: /api/export/candles?product_code=BTC_USD&duration=1m&from=2020-01-01T00:00:00Z&to=2020-01-08T00:00:00Z&format=parquet
+// 例: /api/export/events?product_code=BTC_USD&format=csv
+
+// format ごとの Content-Type
+var exportContentTypes = map[string]string{
+	models.FormatCSV:     "text/csv",
+	models.FormatParquet: "application/octet-stream",
+}
+
+// from・to のパラメータを RFC3339 の時間に変換するfunction (無い場合はゼロ値)
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s param: %s", name, value)
+	}
+	return t, nil
+}
+
+// 商品コード・期間・形式のパラメータを共通で読み込むfunction
+func exportParams(r *http.Request) (productCode, format string, start, end time.Time, err error) {
+	productCode = r.URL.Query().Get("product_code")
+	if productCode == "" {
+		productCode = config.Config.ProductCode
+	}
+	if !validProductCode(productCode) {
+		return "", "", time.Time{}, time.Time{}, fmt.Errorf("invalid product_code param: %s", productCode)
+	}
+	format = r.URL.Query().Get("format")
+	if format == "" {
+		format = models.FormatCSV
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		return "", "", time.Time{}, time.Time{}, fmt.Errorf("invalid format param: %s", format)
+	}
+	if start, err = parseTimeParam(r, "from"); err != nil {
+		return "", "", time.Time{}, time.Time{}, err
+	}
+	if end, err = parseTimeParam(r, "to"); err != nil {
+		return "", "", time.Time{}, time.Time{}, err
+	}
+	return productCode, format, start, end, nil
+}
+
+// exportWriter 最初に書き出す時にダウンロードのヘッダーを送って、そのまま ResponseWriter に書き出すStruct
+// 書き出す前に失敗した場合は、まだエラーのレスポンスを返せる
+type exportWriter struct {
+	w        http.ResponseWriter
+	format   string
+	fileName string
+	started  bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		e.w.Header().Set("Content-Type", exportContentTypes[e.format])
+		e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.fileName+"."+e.format))
+		e.w.WriteHeader(http.StatusOK)
+	}
+	return e.w.Write(p)
+}
+
+// export で書き出したデータをファイルとしてダウンロードさせるfunction
+// 途中で失敗した場合はステータスを変えられないので、途中までのファイルを正常なものと思われないように接続を切る
+func writeExport(w http.ResponseWriter, format, fileName string, export func(ew *exportWriter) error) {
+	ew := &exportWriter{w: w, format: format, fileName: fileName}
+	err := export(ew)
+	if err == nil {
+		return
+	}
+	if !ew.started {
+		APIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("action=writeExport file_name=%s err=%s", fileName, err.Error())
+	panic(http.ErrAbortHandler)
+}
+
+// from 以上 to 未満のキャンドルを CSV・Parquet で返す function
+func apiExportCandlesHandler(w http.ResponseWriter, r *http.Request) {
+	productCode, format, start, end, err := exportParams(r)
+	if err != nil {
+		APIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	durationName := r.URL.Query().Get("duration")
+	if durationName == "" {
+		durationName = "1m"
+	}
+	duration, ok := config.Config.Durations[durationName]
+	if !ok {
+		APIError(w, "invalid duration param: "+durationName, http.StatusBadRequest)
+		return
+	}
+
+	// メモリに溜めずに、DB から読み込んだ分ずつ送る
+	writeExport(w, format, fmt.Sprintf("%s_%s", productCode, durationName), func(ew *exportWriter) error {
+		_, err := models.ExportCandles(ew, format, productCode, duration, start, end)
+		return err
+	})
+}
+
+// from 以上 to 未満の売買のイベントを CSV・Parquet で返す function
+func apiExportEventsHandler(w http.ResponseWriter, r *http.Request) {
+	productCode, format, start, end, err := exportParams(r)
+	if err != nil {
+		APIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeExport(w, format, fmt.Sprintf("%s_signal_events", productCode), func(ew *exportWriter) error {
+		_, err := models.ExportSignalEvents(ew, format, productCode, start, end)
+		return err
+	})
+}
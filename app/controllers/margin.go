@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"log"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+)
+
+// margin.go 証拠金取引でショートを含めたポジションを扱うファイル
+
+// 取引所で保有している建玉を SignalEvents のポジションに反映する function
+func (ai *AI) SyncPosition() error {
+	positions, err := ai.API.GetPositionsContext(ai.ctx, ai.ProductCode)
+	if err != nil {
+		return err
+	}
+	// 建玉ごとに分かれているので、平均の建値で1つのポジションにまとめる (bitflyer の建玉は片側にしか持てない)
+	var position models.Position
+	var notional float64
+	for _, p := range positions {
+		position.Side = p.Side
+		position.Size += p.Size
+		notional += p.Price * p.Size
+	}
+	if position.Size > 0 {
+		position.Price = notional / position.Size
+		position.Size = ai.AdjustSize(position.Size)
+	}
+	ai.SignalEvents.Position = position
+	log.Printf("action=SyncPosition position=%+v", position)
+	return nil
+}
+
+// 新しく建てた後の証拠金維持率 (評価額 / 必要証拠金) がこの値を下回る注文は出さない
+const minKeepRate = 1.0
+
+// 証拠金取引で side に注文するサイズを返す function
+// 反対のポジションを保有していれば決済するサイズを、無ければ証拠金の UsePercent 分で建てられるサイズを返す
+func (ai *AI) GetMarginOrderSize(side string, price float64) float64 {
+	position := ai.SignalEvents.Position
+	if position.Side != "" && position.Side != side {
+		return position.Size
+	}
+	collateral, err := ai.API.GetCollateralContext(ai.ctx)
+	if err != nil {
+		return 0
+	}
+	size := ai.AdjustSize(collateral.Free() * ai.UsePercent * ai.Leverage / price)
+	if !ai.CheckMargin(collateral, price, size) {
+		return 0
+	}
+	return size
+}
+
+// 新しく建てる注文に必要な証拠金が足りているか判定する function
+// 取引所の証拠金維持率 (keep_rate) と、今の必要証拠金 (require_collateral) に注文の分を足した維持率の両方を確認する
+func (ai *AI) CheckMargin(collateral *bitflyer.Collateral, price, size float64) bool {
+	if size <= 0 {
+		log.Printf("action=CheckMargin status=no_collateral free=%f", collateral.Free())
+		return false
+	}
+	// 建玉が無い場合は keep_rate が0なので、建玉がある場合だけ確認する
+	if collateral.RequireCollateral > 0 && collateral.KeepRate < minKeepRate {
+		log.Printf("action=CheckMargin status=low_keep_rate keep_rate=%f", collateral.KeepRate)
+		return false
+	}
+	require := collateral.RequireCollateral + price*size/ai.Leverage
+	keepRate := (collateral.Collateral + collateral.OpenPositionPnl) / require
+	if keepRate < minKeepRate {
+		log.Printf("action=CheckMargin status=insufficient_collateral keep_rate=%f require=%f size=%f", keepRate, require, size)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+)
+
+func TestCheckMargin(t *testing.T) {
+	tests := []struct {
+		name       string
+		collateral bitflyer.Collateral
+		size       float64
+		want       bool
+	}{
+		{
+			name:       "no open positions",
+			collateral: bitflyer.Collateral{Collateral: 100000},
+			// 必要証拠金 3000000 * 0.0333 / 2 = 49950、維持率 200%
+			size: 0.0333,
+			want: true,
+		},
+		{
+			name:       "order larger than the collateral",
+			collateral: bitflyer.Collateral{Collateral: 100000},
+			size:       0.1,
+		},
+		{
+			name:       "order on top of open positions",
+			collateral: bitflyer.Collateral{Collateral: 100000, RequireCollateral: 80000, KeepRate: 1.25},
+			size:       0.0333,
+		},
+		{
+			name:       "unrealized loss on open positions",
+			collateral: bitflyer.Collateral{Collateral: 100000, OpenPositionPnl: -60000, RequireCollateral: 10000, KeepRate: 4},
+			size:       0.0333,
+		},
+		{
+			name:       "exchange keep rate below 100%",
+			collateral: bitflyer.Collateral{Collateral: 100000, RequireCollateral: 50000, KeepRate: 0.9},
+			size:       0.001,
+		},
+		{
+			name:       "zero size",
+			collateral: bitflyer.Collateral{Collateral: 100000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ai := &AI{Leverage: 2}
+			if got := ai.CheckMargin(&tt.collateral, 3000000, tt.size); got != tt.want {
+				t.Errorf("CheckMargin = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMarginOrderSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		position   models.Position
+		collateral bitflyer.Collateral
+		want       float64
+	}{
+		{
+			name:       "opens from the free collateral",
+			collateral: bitflyer.Collateral{Collateral: 100000},
+			// 100000 * 0.5 * 2 / 3000000 = 0.03333... を4桁で切り捨てる
+			want: 0.0333,
+		},
+		{
+			name:     "closes the opposite position",
+			position: models.Position{Side: "SELL", Size: 0.05, Price: 3100000},
+			want:     0.05,
+		},
+		{
+			name:       "rejects while the keep rate is below 100%",
+			collateral: bitflyer.Collateral{Collateral: 100000, OpenPositionPnl: -5000, RequireCollateral: 80000, KeepRate: 0.95},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeExchange(t)
+			f.collateral = tt.collateral
+			ai := newTestAI(f, nil)
+			ai.Leverage = 2
+			ai.SignalEvents.Position = tt.position
+
+			if got := ai.GetMarginOrderSize("BUY", 3000000); got != tt.want {
+				t.Errorf("GetMarginOrderSize = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+)
+
+// orderevent.go Private チャネルで届く注文のイベントを AI に反映するファイル
+
+// 誰も待っていない注文の記録をどれだけ残しておくか
+// 注文の応答より先にイベントが届くことがあるので、待ち始める前の記録もしばらく残しておく
+const orderFillRetention = time.Hour
+
+// orderFill 受付IDごとの約定状況を格納するStruct
+type orderFill struct {
+	side         string
+	executedSize float64
+	notional     float64
+	filled       bool
+	finished     bool
+	waiting      bool
+	done         chan struct{}
+	updatedAt    time.Time
+}
+
+// 約定した分を ChildOrder の形にして返すfunction (ポーリングで取得した時と同じように記録できるようにする)
+func (f *orderFill) childOrder() *bitflyer.ChildOrder {
+	return &bitflyer.ChildOrder{
+		Side:            f.side,
+		AveragePrice:    f.notional / f.executedSize,
+		ExecutedSize:    f.executedSize,
+		ChildOrderState: "COMPLETED",
+	}
+}
+
+// orderFills 受付IDごとの約定状況を管理するStruct
+type orderFills struct {
+	mu    sync.Mutex
+	fills map[string]*orderFill
+}
+
+// 約定を待つ受付IDの約定状況を返すfunction (まだ無ければ作成する)
+// 待ち終わったら delete で削除する
+func (o *orderFills) get(childOrderAcceptanceID string) *orderFill {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fill := o.getLocked(childOrderAcceptanceID)
+	fill.waiting = true
+	return fill
+}
+
+func (o *orderFills) getLocked(childOrderAcceptanceID string) *orderFill {
+	if o.fills == nil {
+		o.fills = map[string]*orderFill{}
+	}
+	fill, ok := o.fills[childOrderAcceptanceID]
+	if ok {
+		return fill
+	}
+
+	// 手動で出した注文など、誰も待っていない古い記録を掃除する
+	now := time.Now()
+	for id, f := range o.fills {
+		if !f.waiting && now.Sub(f.updatedAt) > orderFillRetention {
+			delete(o.fills, id)
+		}
+	}
+	fill = &orderFill{done: make(chan struct{}), updatedAt: now}
+	o.fills[childOrderAcceptanceID] = fill
+	return fill
+}
+
+// 受付IDの約定状況を削除するfunction
+func (o *orderFills) delete(childOrderAcceptanceID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.fills, childOrderAcceptanceID)
+}
+
+// イベントを約定状況に反映するfunction
+func (o *orderFills) apply(event bitflyer.ChildOrderEvent) {
+	switch event.EventType {
+	case bitflyer.EventExecution, bitflyer.EventCancel, bitflyer.EventExpire, bitflyer.EventOrderFailed:
+	default:
+		// ORDER など約定状況が変わらないイベントでは記録を作らない
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fill := o.getLocked(event.ChildOrderAcceptanceID)
+	if fill.finished {
+		return
+	}
+	fill.updatedAt = time.Now()
+
+	switch event.EventType {
+	case bitflyer.EventExecution:
+		fill.side = event.Side
+		fill.executedSize += event.Size
+		fill.notional += event.Price * event.Size
+		if event.OutstandingSize > 0 {
+			return
+		}
+		fill.filled = true
+	case bitflyer.EventCancel, bitflyer.EventExpire, bitflyer.EventOrderFailed:
+		// 一部だけ約定していた場合はその分を約定として扱う
+		fill.filled = fill.executedSize > 0
+		log.Printf("action=orderFills.apply status=%s child_order_acceptance_id=%s reason=%s", event.EventType, event.ChildOrderAcceptanceID, event.Reason)
+	}
+	fill.finished = true
+	close(fill.done)
+}
+
+// child_order_events のイベントを受け取り、約定を待っている注文に知らせる function
+func (ai *AI) OnChildOrderEvent(event bitflyer.ChildOrderEvent) {
+	if event.ProductCode != ai.ProductCode {
+		return
+	}
+	ai.orderFills.apply(event)
+}
+
+// parent_order_events のイベントを受け取り、IFDOCO の決済をすぐに SignalEvents に反映する function
+func (ai *AI) OnParentOrderEvent(event bitflyer.ParentOrderEvent) {
+	if event.EventType != bitflyer.EventComplete {
+		return
+	}
+	// トレード中であれば次のトレードで反映されるので何もしない
+	if !ai.TradeSemaphore.TryAcquire(1) {
+		return
+	}
+	defer ai.TradeSemaphore.Release(1)
+	if event.ParentOrderAcceptanceID != ai.ParentOrderAcceptanceID {
+		return
+	}
+	ai.SyncSpecialOrder(event.DateTime())
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+)
+
+func TestOrderFillsApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		events     []bitflyer.ChildOrderEvent
+		wantFilled bool
+		wantDone   bool
+		wantPrice  float64
+		wantSize   float64
+	}{
+		{
+			name: "executions until nothing is outstanding",
+			events: []bitflyer.ChildOrderEvent{
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventOrder},
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventExecution, Side: "BUY", Price: 3000000, Size: 0.01, OutstandingSize: 0.01},
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventExecution, Side: "BUY", Price: 3000200, Size: 0.01},
+			},
+			wantFilled: true,
+			wantDone:   true,
+			wantPrice:  3000100,
+			wantSize:   0.02,
+		},
+		{
+			name: "partially executed and canceled",
+			events: []bitflyer.ChildOrderEvent{
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventExecution, Side: "SELL", Price: 3000000, Size: 0.01, OutstandingSize: 0.01},
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventCancel},
+			},
+			wantFilled: true,
+			wantDone:   true,
+			wantPrice:  3000000,
+			wantSize:   0.01,
+		},
+		{
+			name: "expired without executions",
+			events: []bitflyer.ChildOrderEvent{
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventExpire},
+			},
+			wantDone: true,
+		},
+		{
+			name: "still outstanding",
+			events: []bitflyer.ChildOrderEvent{
+				{ChildOrderAcceptanceID: testAcceptanceID, EventType: bitflyer.EventExecution, Side: "BUY", Price: 3000000, Size: 0.01, OutstandingSize: 0.01},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fills orderFills
+			fill := fills.get(testAcceptanceID)
+			for _, event := range tt.events {
+				fills.apply(event)
+			}
+
+			select {
+			case <-fill.done:
+				if !tt.wantDone {
+					t.Fatal("done is closed, want the order still waiting")
+				}
+			default:
+				if tt.wantDone {
+					t.Fatal("done is not closed, want the order finished")
+				}
+				return
+			}
+			if fill.filled != tt.wantFilled {
+				t.Errorf("filled = %t, want %t", fill.filled, tt.wantFilled)
+			}
+			if !tt.wantFilled {
+				return
+			}
+			order := fill.childOrder()
+			if order.AveragePrice != tt.wantPrice || order.ExecutedSize != tt.wantSize {
+				t.Errorf("order = %+v, want %f x %f", order, tt.wantPrice, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestOrderFillsCleanup(t *testing.T) {
+	var fills orderFills
+	// 約定状況が変わらないイベントでは記録を作らない
+	fills.apply(bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: "JRF-ORDER", EventType: bitflyer.EventOrder})
+	fills.apply(bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: "JRF-TRIGGER", EventType: bitflyer.EventTrigger})
+	if len(fills.fills) != 0 {
+		t.Fatalf("fills = %v, want none for ORDER and TRIGGER events", fills.fills)
+	}
+
+	// 誰も待っていない記録は終わっていなくても orderFillRetention を過ぎたら掃除される
+	fills.apply(bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: "JRF-MANUAL", EventType: bitflyer.EventExecution, Size: 0.01, OutstandingSize: 0.01})
+	fills.get(testAcceptanceID)
+	old := time.Now().Add(-2 * orderFillRetention)
+	fills.fills["JRF-MANUAL"].updatedAt = old
+	fills.fills[testAcceptanceID].updatedAt = old
+
+	fills.apply(bitflyer.ChildOrderEvent{ChildOrderAcceptanceID: "JRF-NEW", EventType: bitflyer.EventExecution, Size: 0.01, OutstandingSize: 0.01})
+	if _, ok := fills.fills["JRF-MANUAL"]; ok {
+		t.Error("unwaited fill older than orderFillRetention remains")
+	}
+	if _, ok := fills.fills[testAcceptanceID]; !ok {
+		t.Error("fill someone is waiting on was removed")
+	}
+
+	fills.delete(testAcceptanceID)
+	if _, ok := fills.fills[testAcceptanceID]; ok {
+		t.Error("fill remains after delete")
+	}
+}
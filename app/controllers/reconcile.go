@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
+)
+
+// reconcile.go DBの SignalEvents と取引所の約定履歴を照合するファイル
+
+// 起動時に照合する SignalEvents の件数
+const reconcileSignalCount = 100
+
+// サイズが一致しているとみなす誤差 (注文サイズは小数点以下4桁に切り捨てている)
+const reconcileSizeTolerance = 0.00005
+
+// ReconcileMismatch 照合で一致しなかった内容を格納するStruct
+type ReconcileMismatch struct {
+	// missing_execution: 約定が見つからない / size_mismatch: 約定したサイズが違う / untracked_execution: 記録されていない約定
+	Reason       string              `json:"reason"`
+	Signal       *models.SignalEvent `json:"signal,omitempty"`
+	ExecutedSize float64             `json:"executed_size"`
+	ExecutionIDs []int               `json:"execution_ids,omitempty"`
+}
+
+// ReconcileReport 照合の結果を格納するStruct
+type ReconcileReport struct {
+	CheckedAt  time.Time           `json:"checked_at"`
+	Signals    int                 `json:"signals"`
+	Executions int                 `json:"executions"`
+	Mismatches []ReconcileMismatch `json:"mismatches"`
+}
+
+// 直近の SignalEvents を取引所の約定履歴と照合して、一致しなかったものをログに出す function
+func (ai *AI) ReconcileSignalEvents() (*ReconcileReport, error) {
+	report := &ReconcileReport{CheckedAt: time.Now()}
+	signalEvents := models.GetSignalEventsByCount(ai.ProductCode, reconcileSignalCount)
+	if signalEvents == nil || len(signalEvents.Signals) == 0 {
+		return report, nil
+	}
+	signals := signalEvents.Signals
+	report.Signals = len(signals)
+
+	// SignalEvents にはキャンドルの時間で記録しているので、実際の約定との時間のずれを許容する
+	window := ai.Duration + time.Minute*time.Duration(ai.MinuteToExpires)
+	oldest := signals[0].Time.Add(-window)
+	var executions []bitflyer.MyExecution
+	err := ai.API.EachMyExecutionsContext(ai.ctx, &bitflyer.MyExecutionsParams{ProductCode: ai.ProductCode}, func(execution bitflyer.MyExecution) bool {
+		if execution.DateTime().Before(oldest) {
+			return false
+		}
+		executions = append(executions, execution)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 古い順に並べ替える
+	for i, j := 0, len(executions)-1; i < j; i, j = i+1, j-1 {
+		executions[i], executions[j] = executions[j], executions[i]
+	}
+	report.Executions = len(executions)
+
+	claimed := make([]bool, len(executions))
+	for i := range signals {
+		signal := &signals[i]
+		var executedSize float64
+		var ids []int
+		for j, execution := range executions {
+			if claimed[j] || execution.Side != signal.Side {
+				continue
+			}
+			if executedSize >= signal.Size-reconcileSizeTolerance {
+				break
+			}
+			dateTime := execution.DateTime()
+			if dateTime.Before(signal.Time.Add(-window)) || dateTime.After(signal.Time.Add(window)) {
+				continue
+			}
+			claimed[j] = true
+			executedSize += execution.Size
+			ids = append(ids, execution.ID)
+		}
+		if len(ids) == 0 {
+			report.Mismatches = append(report.Mismatches, ReconcileMismatch{Reason: "missing_execution", Signal: signal})
+		} else if math.Abs(executedSize-signal.Size) > reconcileSizeTolerance {
+			report.Mismatches = append(report.Mismatches, ReconcileMismatch{Reason: "size_mismatch", Signal: signal, ExecutedSize: executedSize, ExecutionIDs: ids})
+		}
+	}
+
+	// 手動で出した注文など、SignalEvents に記録されていない約定
+	for j, execution := range executions {
+		if claimed[j] || execution.DateTime().Before(signals[0].Time) {
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, ReconcileMismatch{Reason: "untracked_execution", ExecutedSize: execution.Size, ExecutionIDs: []int{execution.ID}})
+	}
+
+	for _, mismatch := range report.Mismatches {
+		log.Printf("action=ReconcileSignalEvents status=%s signal=%+v executed_size=%f execution_ids=%v", mismatch.Reason, mismatch.Signal, mismatch.ExecutedSize, mismatch.ExecutionIDs)
+	}
+	log.Printf("action=ReconcileSignalEvents signals=%d executions=%d mismatches=%d", report.Signals, report.Executions, len(report.Mismatches))
+	return report, nil
+}
+
+// 起動時の照合の結果を Json で返す function (product_code を省略した場合はデフォルトの商品)
+func apiReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	productCode := r.URL.Query().Get("product_code")
+	if productCode == "" {
+		productCode = config.Config.ProductCode
+	}
+	ai, ok := AIs[productCode]
+	if !ok || ai.ReconcileReport == nil {
+		APIError(w, "No reconcile report", http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(ai.ReconcileReport)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -1,7 +1,10 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"log"
+	"sync"
 
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
@@ -9,24 +12,186 @@ import (
 )
 
 // StreamIngestionData データをストリーミングするfunction
-func StreamIngestionData() {
+// 商品ごとに AI を作成し、1本の WebSocket で全ての商品のチャネルを購読する
+// ctx がキャンセルされるとストリームを閉じ、約定待ちの注文を確認してから返り値のチャネルを閉じる
+// AI を1つも作成できなかった場合はエラーを返す
+func StreamIngestionData(ctx context.Context) (<-chan struct{}, error) {
 	c := config.Config
-	ai := NewAI(c.ProductCode, c.TradeDuration, c.DataLimit, c.UsePercent, c.StopLimitPercent, c.BackTest)
+	var ais []*AI
+	for _, productCode := range c.ProductCodes {
+		ai, err := NewAI(ctx, productCode, c.TradeDuration, c.DataLimit, c.UsePercent, c.StopLimitPercent, c.BackTest)
+		if err != nil {
+			log.Printf("action=StreamIngestionData product_code=%s err=%s", productCode, err.Error())
+			continue
+		}
+		ais = append(ais, ai)
+	}
+	if len(ais) == 0 {
+		return nil, errors.New("no product to stream: check product_codes in config.ini")
+	}
 
-	var tickerChannel = make(chan bitflyer.Ticker)
-	apiClient := bitflyer.New(config.Config.APIKey, config.Config.APISecret)
-	go apiClient.GetRealTimeTicker(config.Config.ProductCode, tickerChannel)
+	var wg sync.WaitGroup
+	// 認証などは商品に依らないので、商品ごとの AI とは別の APIClient でストリームを作成する
+	stream := newAPIClient().NewStream()
 
+	// 切断・再接続を全ての AI に伝えてトレードを一時停止させる
+	wg.Add(1)
 	go func() {
-		for ticker := range tickerChannel {
-			// 秒、分、時間ごとにデータの書き込みを行う
-			log.Printf("action=StreamIngestionData, %v", ticker)
-			for _, duration := range config.Config.Durations {
-				isCreated := models.CreateCandleWithDuration(ticker, ticker.ProductCode, duration)
-				if isCreated == true && duration == config.Config.TradeDuration {
-					ai.Trade()
+		defer wg.Done()
+		for event := range stream.States() {
+			log.Printf("action=StreamIngestionData state=%s err=%v", event.State, event.Err)
+			for _, ai := range ais {
+				ai.OnConnectionEvent(event)
+			}
+		}
+	}()
+
+	if !c.BackTest {
+		// 自分の注文のイベントを購読して、約定をすぐに反映する
+		// イベントは全ての商品分がまとめて届くので、それぞれの AI が自分の商品の分だけを反映する
+		childOrderChannel := make(chan []bitflyer.ChildOrderEvent, 16)
+		parentOrderChannel := make(chan []bitflyer.ParentOrderEvent, 16)
+		stream.SubscribeChildOrderEvents(childOrderChannel)
+		stream.SubscribeParentOrderEvents(parentOrderChannel)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case events := <-childOrderChannel:
+					for _, event := range events {
+						log.Printf("action=StreamIngestionData child_order_event=%+v", event)
+						for _, ai := range ais {
+							ai.OnChildOrderEvent(event)
+						}
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case events := <-parentOrderChannel:
+					for _, event := range events {
+						log.Printf("action=StreamIngestionData parent_order_event=%+v", event)
+						for _, ai := range ais {
+							ai.OnParentOrderEvent(event)
+						}
+					}
+				case <-ctx.Done():
+					return
 				}
 			}
+		}()
+	}
+
+	// 作成中のキャンドルはメモリで更新し、まとめてDBに書き込む
+	aggregator := models.NewCandleAggregator(c.Durations)
+	aggregator.FillGaps = c.FillGaps
+	aggregator.PriceSources = c.PriceSources
+	for _, ai := range ais {
+		subscribeProduct(ctx, &wg, stream, aggregator, ai)
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aggregator.Run(ctx)
+	}()
+	// トレードする期間のキャンドルが確定したらトレードする
+	go func() {
+		defer wg.Done()
+		for event := range aggregator.Events() {
+			if event.Candle.Duration != c.TradeDuration {
+				continue
+			}
+			if ai, ok := AIs[event.Candle.ProductCode]; ok {
+				// 約定を待っている間も他の商品のデータや注文のイベントを受け取れるように、別の goroutine でトレードする
+				go ai.Trade()
+			}
+		}
+	}()
+
+	// retention より古いキャンドルを上位の期間にまとめてから削除し、定期的に VACUUM / ANALYZE する
+	compactor := models.NewCandleCompactor(c.ProductCodes, c.Durations, c.Retentions)
+	compactor.Interval = c.CompactInterval
+	compactor.VacuumInterval = c.VacuumInterval
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		compactor.Run(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stream.RunContext(ctx)
+	}()
+
+	// 全ての goroutine が終わったら、実行中のトレードを待って終了を知らせる
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		for _, ai := range ais {
+			ai.Shutdown()
+		}
+		close(done)
+	}()
+	return done, nil
+}
+
+// 1つの商品のチャネルを購読して、キャンドルの作成に使う function
+func subscribeProduct(ctx context.Context, wg *sync.WaitGroup, stream *bitflyer.Stream, aggregator *models.CandleAggregator, ai *AI) {
+	c := config.Config
+	productCode := ai.ProductCode
+
+	if !c.BackTest {
+		// 成行注文の滑りを見積もるために板を保持しておく
+		stream.SubscribeOrderBook(productCode, ai.OrderBook)
+	}
+
+	// Ticker はキャンドルの最良気配の記録にも使うので、どちらの場合も購読する
+	var tickerChannel = make(chan bitflyer.Ticker)
+	stream.SubscribeTicker(productCode, tickerChannel)
+
+	if c.CandleSource == "executions" {
+		// 約定履歴から OHLCV のキャンドルを作成し、Ticker からは最良気配だけを記録する
+		var executionChannel = make(chan []bitflyer.Execution)
+		stream.SubscribeExecutions(productCode, executionChannel)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case executions := <-executionChannel:
+					for _, execution := range executions {
+						aggregator.AddExecution(execution, productCode)
+					}
+				case ticker := <-tickerChannel:
+					aggregator.SetQuote(productCode, ticker.DateTime(), ticker.BestBid, ticker.BestAsk)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return
+	}
+
+	// Ticker の price_source で指定した価格からキャンドルを作成する
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case ticker := <-tickerChannel:
+				log.Printf("action=StreamIngestionData, %v", ticker)
+				aggregator.AddTicker(ticker, ticker.ProductCode)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
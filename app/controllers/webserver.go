@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -8,16 +9,23 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/models"
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
 )
 
 // chart.html を読み込むファイル
-var templates = template.Must(template.ParseFiles("backend-2-go-fintech/Section20/app/views/chart.html"))
+var templates = template.Must(template.ParseFiles(config.Path("app/views/chart.html")))
 
 func viewChartHandler(w http.ResponseWriter, r *http.Request) {
-	err := templates.ExecuteTemplate(w, "chart.html", nil)
+	// config.ini の durations の期間をボタンにする
+	data := struct {
+		Durations []string
+	}{
+		Durations: config.Config.DurationNames,
+	}
+	err := templates.ExecuteTemplate(w, "chart.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -41,6 +49,17 @@ func APIError(w http.ResponseWriter, errMessage string, code int) {
 	w.Write(jsonError)
 }
 
+// 商品コードが config.ini の product_codes に含まれているか判定するfunction
+// 商品コードはキャンドルのテーブル名に使うので、それ以外の値を SQL に渡さないようにする
+func validProductCode(productCode string) bool {
+	for _, code := range config.Config.ProductCodes {
+		if code == productCode {
+			return true
+		}
+	}
+	return false
+}
+
 var apiValidPath = regexp.MustCompile("^/api/candle/$")
 
 // apiValidPathにマッチングする物があるか調べるfunction
@@ -61,6 +80,10 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 		APIError(w, "No product_code param", http.StatusBadRequest)
 		return
 	}
+	if !validProductCode(productCode) {
+		APIError(w, "invalid product_code param: "+productCode, http.StatusBadRequest)
+		return
+	}
 	// 各パラメータの限界値を設定
 	strLimit := r.URL.Query().Get("limit")
 	limit, err := strconv.Atoi(strLimit)
@@ -71,9 +94,30 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 	if duration == "" {
 		duration = "1m"
 	}
-	durationTime := config.Config.Durations[duration]
+	durationTime, ok := config.Config.Durations[duration]
+	if !ok {
+		APIError(w, "invalid duration param: "+duration, http.StatusBadRequest)
+		return
+	}
+	// from・to を指定すると過去のキャンドルを limit 件ずつ取得できる
+	// レスポンスの prev_cursor を to に、next_cursor を from に指定すると前後のページを取得する
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		APIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		APIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	df, _ := models.GetAllCandle(productCode, durationTime, limit)
+	page, err := models.GetCandlePage(productCode, durationTime, from, to, limit)
+	if err != nil {
+		APIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	df := page.DataFrameCandle
 
 	// フロントエンドからSmaが来たらdfに追加する
 	sma := r.URL.Query().Get("sma")
@@ -207,11 +251,13 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	events := r.URL.Query().Get("events")
-	if events != "" {
+	if events != "" && len(df.Candles) > 0 {
 
 		// バックテストの場合
 		if config.Config.BackTest {
-			df.Events = Ai.SignalEvents.CollectAfter(df.Candles[0].Time)
+			if ai, ok := AIs[productCode]; ok {
+				df.Events = ai.SignalEvents.CollectAfter(df.Candles[0].Time)
+			}
 		} else {
 			// バックテストではない場合
 			firstTime := df.Candles[0].Time
@@ -219,8 +265,8 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// productCode, durationTime, limit が格納されたJsonを変換する
-	js, err := json.Marshal(df)
+	// productCode, durationTime, limit と前後のページのカーソルが格納されたJsonを変換する
+	js, err := json.Marshal(page)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -228,9 +274,55 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
+// テーブルごとの行数と容量、キャンドルの期間ごとの retention を返す function
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := models.Repo.GetStorageStats()
+	if err != nil {
+		APIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	retentions := map[string]string{}
+	for name, keep := range config.Config.Retentions {
+		retentions[name] = keep.String()
+	}
+	js, err := json.Marshal(struct {
+		*models.StorageStats
+		Retentions map[string]string `json:"retentions"`
+	}{stats, retentions})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// サーバーを止める時に、処理中のリクエストを待つ時間
+const shutdownTimeout = 10 * time.Second
+
 // Handler の登録、サーバーの立ち上げを行うfunction
-func StartWebServer() error {
+// ctx がキャンセルされたら処理中のリクエストを待ってから終了する
+func StartWebServer(ctx context.Context) error {
 	http.HandleFunc("/api/candle/", apiMakeHandler(apiCandleHandler))
+	http.HandleFunc("/api/reconcile/", apiReconcileHandler)
+	http.HandleFunc("/api/stats/", apiStatsHandler)
+	http.HandleFunc("/api/export/candles", apiExportCandlesHandler)
+	http.HandleFunc("/api/export/events", apiExportEventsHandler)
 	http.HandleFunc("/chart/", viewChartHandler)
-	return http.ListenAndServe(fmt.Sprintf(":%d", config.Config.Port), nil)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Config.Port)}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("action=StartWebServer err=%s", err.Error())
+		}
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,305 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+)
+
+// aggregator.go Tick ごとにDBを読み書きせず、作成中のキャンドルをメモリで更新するファイル
+
+// 作成中のキャンドルをDBに書き込む間隔
+const defaultCandleFlushInterval = time.Second
+
+// CandleClosedEvent キャンドルが確定した時に通知するイベント
+type CandleClosedEvent struct {
+	Candle Candle
+}
+
+// candleKey 商品と期間の組み合わせ
+type candleKey struct {
+	productCode string
+	duration    time.Duration
+}
+
+// closedCandle 確定したキャンドルと、次に作成したキャンドルの時間
+type closedCandle struct {
+	candle *Candle
+	next   time.Time
+}
+
+// CandleAggregator 商品・期間ごとに作成中のキャンドルをメモリに保持して、まとめてDBに書き込むStruct
+// 1分以下の期間は Tick から作成し、それより長い期間は1分足が確定した時にまとめる
+type CandleAggregator struct {
+	// 作成中のキャンドルをDBに書き込む間隔 (確定したキャンドルはすぐに書き込む)
+	FlushInterval time.Duration
+	// Tick が無かった期間を前の終値の出来高0のキャンドルで埋めるかどうか
+	FillGaps bool
+	// Ticker からキャンドルを作る時に商品ごとに使う価格の種類 (無い場合は中間価格)
+	PriceSources map[string]string
+
+	durations map[string]time.Duration
+	mu        sync.Mutex
+	current   map[candleKey]*Candle
+	dirty     map[candleKey]bool
+	closed    []closedCandle
+	// 上位の期間ごとに、作成中のキャンドルの確定した1分足だけをまとめたもの (flush の中だけで使う)
+	resampled map[candleKey]*Candle
+	flushNow  chan struct{}
+	events    chan CandleClosedEvent
+}
+
+// durations の期間のキャンドルを作成する CandleAggregator を返すfunction
+func NewCandleAggregator(durations map[string]time.Duration) *CandleAggregator {
+	return &CandleAggregator{
+		FlushInterval: defaultCandleFlushInterval,
+		durations:     durations,
+		current:       map[candleKey]*Candle{},
+		dirty:         map[candleKey]bool{},
+		resampled:     map[candleKey]*Candle{},
+		flushNow:      make(chan struct{}, 1),
+		events:        make(chan CandleClosedEvent, 64),
+	}
+}
+
+// キャンドルが確定した時のイベントを受け取るチャネルを返すfunction (Run が終わると閉じられる)
+func (a *CandleAggregator) Events() <-chan CandleClosedEvent {
+	return a.events
+}
+
+// Ticker の PriceSources で指定した種類の価格でキャンドルを更新し、最良気配を記録するfunction
+func (a *CandleAggregator) AddTicker(ticker bitflyer.Ticker, productCode string) {
+	dateTime := ticker.DateTime()
+	a.Add(productCode, dateTime, ticker.GetPrice(a.PriceSources[productCode]), ticker.Volume)
+	a.SetQuote(productCode, dateTime, ticker.BestBid, ticker.BestAsk)
+}
+
+// 作成中のキャンドルに最良気配を記録するfunction
+// 気配だけではキャンドルを作らないので、dateTime の期間のキャンドルが作成中の場合だけ更新する
+func (a *CandleAggregator) SetQuote(productCode string, dateTime time.Time, bid, ask float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, duration := range a.durations {
+		if IsResampledDuration(duration) {
+			continue
+		}
+		key := candleKey{productCode, duration}
+		candle := a.current[key]
+		if candle == nil || !candle.Time.Equal(dateTime.Truncate(duration)) {
+			continue
+		}
+		candle.setQuote(bid, ask)
+		a.dirty[key] = true
+	}
+}
+
+// 約定の価格とサイズでキャンドルを更新するfunction
+func (a *CandleAggregator) AddExecution(execution bitflyer.Execution, productCode string) {
+	a.Add(productCode, execution.DateTime(), execution.Price, execution.Size)
+}
+
+// 価格と出来高で、1分以下の期間の作成中のキャンドルを更新するfunction
+func (a *CandleAggregator) Add(productCode string, dateTime time.Time, price, volume float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	isClosed := false
+	for _, duration := range a.durations {
+		if IsResampledDuration(duration) {
+			continue
+		}
+		key := candleKey{productCode, duration}
+		bucket := dateTime.Truncate(duration)
+		candle := a.current[key]
+		// 遅れて届いた前の期間のデータは、確定したキャンドルを書き換えないように捨てる
+		if candle != nil && bucket.Before(candle.Time) {
+			continue
+		}
+		if candle == nil || !candle.Time.Equal(bucket) {
+			if candle != nil {
+				gaps := a.gapCandles(candle, bucket)
+				next := bucket
+				if len(gaps) > 0 {
+					next = gaps[0].Time
+				}
+				a.closed = append(a.closed, closedCandle{candle: candle, next: next})
+				for i, gap := range gaps {
+					next = bucket
+					if i+1 < len(gaps) {
+						next = gaps[i+1].Time
+					}
+					a.closed = append(a.closed, closedCandle{candle: gap, next: next})
+				}
+				isClosed = true
+			}
+			// 再起動した時などは、DBに途中まで作成したキャンドルがあれば続きから更新する
+			candle = GetCandle(productCode, duration, bucket)
+			if candle == nil {
+				candle = NewCandle(productCode, duration, bucket, price, price, price, price, 0)
+			}
+			a.current[key] = candle
+		}
+		candle.update(price, volume)
+		a.dirty[key] = true
+	}
+	if isClosed {
+		select {
+		case a.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// FillGaps の場合に、確定したキャンドルから next までの Tick が無かった期間のキャンドルを返すfunction
+func (a *CandleAggregator) gapCandles(candle *Candle, next time.Time) []*Candle {
+	if !a.FillGaps {
+		return nil
+	}
+	gaps := flatCandles(candle, next)
+	if len(gaps) > maxLiveGapCandles {
+		log.Printf("action=CandleAggregator.gapCandles status=skip product_code=%s duration=%s from=%s to=%s", candle.ProductCode, candle.Duration, candle.Time, next)
+		return nil
+	}
+	return gaps
+}
+
+// ctx がキャンセルされるまで、キャンドルをDBに書き込み続けるfunction
+// 終了する前に残りを書き込み、イベントのチャネルを閉じる
+func (a *CandleAggregator) Run(ctx context.Context) {
+	defer close(a.events)
+	interval := time.NewTicker(a.FlushInterval)
+	defer interval.Stop()
+	for {
+		select {
+		case <-interval.C:
+			a.flush()
+		case <-a.flushNow:
+			a.flush()
+		case <-ctx.Done():
+			a.flush()
+			return
+		}
+	}
+}
+
+// 確定したキャンドルと更新された作成中のキャンドルを1つのトランザクションで書き込み、確定したイベントを送るfunction
+func (a *CandleAggregator) flush() {
+	a.mu.Lock()
+	closed := a.closed
+	a.closed = nil
+	var open []Candle
+	for key := range a.dirty {
+		open = append(open, *a.current[key])
+	}
+	a.dirty = map[candleKey]bool{}
+	a.mu.Unlock()
+	if len(closed) == 0 && len(open) == 0 {
+		return
+	}
+
+	if err := a.write(closed, open); err != nil {
+		log.Printf("action=CandleAggregator.flush err=%s", err.Error())
+		// 次の書き込みでやり直す
+		a.mu.Lock()
+		a.closed = append(closed, a.closed...)
+		for _, candle := range open {
+			a.dirty[candleKey{candle.ProductCode, candle.Duration}] = true
+		}
+		a.mu.Unlock()
+		return
+	}
+
+	for _, c := range closed {
+		a.events <- CandleClosedEvent{Candle: *c.candle}
+		if c.candle.Duration == BaseDuration {
+			a.resample(c)
+		}
+	}
+}
+
+// キャンドルをまとめてDBに書き込むfunction
+func (a *CandleAggregator) write(closed []closedCandle, open []Candle) error {
+	return Repo.RunInTx(func(repo Repository) error {
+		for _, c := range closed {
+			if err := repo.SaveCandle(c.candle); err != nil {
+				return err
+			}
+		}
+		for i := range open {
+			if err := repo.SaveCandle(&open[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 確定した1分足を上位の期間のキャンドルにまとめ、期間が終わっていれば確定したイベントを送るfunction
+// 確定した1分足だけをまとめたキャンドルをメモリに持って1本ずつ足していき、DBには作成中の1分足も足して書き込む
+func (a *CandleAggregator) resample(c closedCandle) {
+	productCode := c.candle.ProductCode
+	a.mu.Lock()
+	var open *Candle
+	if candle := a.current[candleKey{productCode, BaseDuration}]; candle != nil {
+		copied := *candle
+		open = &copied
+	}
+	a.mu.Unlock()
+
+	for _, duration := range a.durations {
+		if !IsResampledDuration(duration) {
+			continue
+		}
+		key := candleKey{productCode, duration}
+		closed, err := a.mergeClosed(key, c.candle)
+		if err != nil {
+			log.Printf("action=CandleAggregator.resample err=%s", err.Error())
+			continue
+		}
+		candle := *closed
+		if open != nil && open.Time.Truncate(duration).Equal(candle.Time) {
+			candle.merge(open)
+		}
+		if err := Repo.SaveCandle(&candle); err != nil {
+			log.Printf("action=CandleAggregator.resample err=%s", err.Error())
+		}
+		next := c.next.Truncate(duration)
+		if candle.Time.Equal(next) {
+			continue
+		}
+		a.events <- CandleClosedEvent{Candle: candle}
+		delete(a.resampled, key)
+		// 新しい期間のキャンドルを、作成中の1分足から作成しておく
+		if open == nil || !open.Time.Truncate(duration).Equal(next) {
+			continue
+		}
+		candle = *NewCandle(productCode, duration, next, open.Open, open.Close, open.High, open.Low, 0)
+		candle.merge(open)
+		if err := Repo.SaveCandle(&candle); err != nil {
+			log.Printf("action=CandleAggregator.resample err=%s", err.Error())
+		}
+	}
+}
+
+// 確定した1分足 candle を、key の期間の確定した1分足だけをまとめたキャンドルに足して返すfunction
+// メモリに同じ期間のキャンドルが無い場合 (起動して最初や新しい期間の1分足) は、DBの確定した1分足から作る
+func (a *CandleAggregator) mergeClosed(key candleKey, candle *Candle) (*Candle, error) {
+	start := candle.Time.Truncate(key.duration)
+	if closed := a.resampled[key]; closed != nil && closed.Time.Equal(start) {
+		closed.merge(candle)
+		return closed, nil
+	}
+	candles, err := getBaseCandles(key.productCode, start, candle.Time.Add(BaseDuration))
+	if err != nil {
+		return nil, err
+	}
+	resampled := resampleCandles(key.productCode, key.duration, candles)
+	if len(resampled) == 0 {
+		return nil, fmt.Errorf("no %s candles from %s to %s", BaseDuration, start, candle.Time)
+	}
+	a.resampled[key] = resampled[0]
+	return resampled[0], nil
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testProductCode = "TEST_PRODUCT"
+
+// テストで使うキャンドルの時間の起点 (2020-01-01T10:00:00Z)
+var testBase = time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+// CandleAggregator.Add に渡す価格と出来高
+type testTick struct {
+	at     time.Duration
+	price  float64
+	volume float64
+}
+
+// testBase から at 後の duration のキャンドルを返すfunction
+func testCandle(duration, at time.Duration, open, close, high, low, volume float64) Candle {
+	return *NewCandle(testProductCode, duration, testBase.Add(at), open, close, high, low, volume)
+}
+
+// got と want が同じキャンドルの並びか確認するfunction
+func expectCandles(t *testing.T, name string, got, want []Candle) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %+v, want %+v", name, got, want)
+		return
+	}
+	for i := range want {
+		if !sameCandle(got[i], want[i]) {
+			t.Errorf("%s[%d] = %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestCandleAggregator(t *testing.T) {
+	ticks := []testTick{
+		{at: 10 * time.Second, price: 100, volume: 1},
+		{at: 50 * time.Second, price: 105, volume: 2},
+		{at: 65 * time.Second, price: 95, volume: 1},
+		{at: 3 * time.Minute, price: 99, volume: 1},
+		// 遅れて届いた前の期間の価格は捨てる
+		{at: -time.Minute, price: 1, volume: 1},
+	}
+	tests := []struct {
+		name       string
+		fillGaps   bool
+		ticks      []testTick
+		wantMinute []Candle
+		wantHour   []Candle
+		wantEvents []string
+	}{
+		{
+			name:  "builds minute candles and resamples the hour",
+			ticks: ticks,
+			wantMinute: []Candle{
+				testCandle(time.Minute, 0, 100, 105, 105, 100, 3),
+				testCandle(time.Minute, time.Minute, 95, 95, 95, 95, 1),
+				testCandle(time.Minute, 3*time.Minute, 99, 99, 99, 99, 1),
+			},
+			wantHour:   []Candle{testCandle(time.Hour, 0, 100, 99, 105, 95, 5)},
+			wantEvents: []string{"1m0s 10:00", "1m0s 10:01"},
+		},
+		{
+			name:     "fills minutes without ticks",
+			fillGaps: true,
+			ticks:    ticks,
+			wantMinute: []Candle{
+				testCandle(time.Minute, 0, 100, 105, 105, 100, 3),
+				testCandle(time.Minute, time.Minute, 95, 95, 95, 95, 1),
+				testCandle(time.Minute, 2*time.Minute, 95, 95, 95, 95, 0),
+				testCandle(time.Minute, 3*time.Minute, 99, 99, 99, 99, 1),
+			},
+			wantHour:   []Candle{testCandle(time.Hour, 0, 100, 99, 105, 95, 5)},
+			wantEvents: []string{"1m0s 10:00", "1m0s 10:01", "1m0s 10:02"},
+		},
+		{
+			name: "closes the hour",
+			ticks: []testTick{
+				{at: 59*time.Minute + 30*time.Second, price: 100, volume: 1},
+				{at: time.Hour + 10*time.Second, price: 110, volume: 2},
+			},
+			wantMinute: []Candle{
+				testCandle(time.Minute, 59*time.Minute, 100, 100, 100, 100, 1),
+				testCandle(time.Minute, time.Hour, 110, 110, 110, 110, 2),
+			},
+			wantHour: []Candle{
+				testCandle(time.Hour, 0, 100, 100, 100, 100, 1),
+				testCandle(time.Hour, time.Hour, 110, 110, 110, 110, 2),
+			},
+			wantEvents: []string{"1m0s 10:59", "1h0m0s 10:00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := useTestRepository(t, testProductCode, time.Minute, time.Hour)
+			a := NewCandleAggregator(map[string]time.Duration{"1m": time.Minute, "1h": time.Hour})
+			a.FillGaps = tt.fillGaps
+			for _, tick := range tt.ticks {
+				a.Add(testProductCode, testBase.Add(tick.at), tick.price, tick.volume)
+			}
+			a.flush()
+
+			var events []string
+			for len(a.events) > 0 {
+				event := <-a.events
+				events = append(events, fmt.Sprintf("%s %s", event.Candle.Duration, event.Candle.Time.Format("15:04")))
+			}
+			if fmt.Sprint(events) != fmt.Sprint(tt.wantEvents) {
+				t.Errorf("events = %v, want %v", events, tt.wantEvents)
+			}
+			minute, err := repo.GetCandlesInRange(testProductCode, time.Minute, time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatalf("GetCandlesInRange: %v", err)
+			}
+			expectCandles(t, "1m candles", minute, tt.wantMinute)
+			hour, err := repo.GetCandlesInRange(testProductCode, time.Hour, time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatalf("GetCandlesInRange: %v", err)
+			}
+			expectCandles(t, "1h candles", hour, tt.wantHour)
+		})
+	}
+}
+
+func TestCandleAggregatorSetQuote(t *testing.T) {
+	repo := useTestRepository(t, testProductCode, time.Minute)
+	a := NewCandleAggregator(map[string]time.Duration{"1m": time.Minute})
+	// 作成中のキャンドルが無い期間の気配ではキャンドルを作らない
+	a.SetQuote(testProductCode, testBase, 99, 101)
+	a.Add(testProductCode, testBase.Add(time.Second), 100, 1)
+	a.SetQuote(testProductCode, testBase.Add(2*time.Second), 99.5, 100.5)
+	// 0 の気配は前の値を残す
+	a.SetQuote(testProductCode, testBase.Add(3*time.Second), 0, 0)
+	a.flush()
+
+	candle, err := repo.GetCandle(testProductCode, time.Minute, testBase)
+	if err != nil {
+		t.Fatalf("GetCandle: %v", err)
+	}
+	if candle == nil || candle.Bid != 99.5 || candle.Ask != 100.5 {
+		t.Errorf("candle = %+v, want bid 99.5 and ask 100.5", candle)
+	}
+}
+
+func TestCandleAggregatorResampleIncrementally(t *testing.T) {
+	repo := useTestRepository(t, testProductCode, time.Minute, time.Hour)
+	// 再起動する前に確定した1分足は、起動して最初に確定した1分足の時にDBからまとめる
+	before := testCandle(time.Minute, 0, 100, 104, 104, 98, 2)
+	noError(t, repo.SaveCandle(&before), "SaveCandle")
+
+	a := NewCandleAggregator(map[string]time.Duration{"1m": time.Minute, "1h": time.Hour})
+	a.Add(testProductCode, testBase.Add(time.Minute+10*time.Second), 101, 1)
+	a.Add(testProductCode, testBase.Add(2*time.Minute+10*time.Second), 102, 1)
+	a.flush()
+
+	// その後に確定した1分足は、DBの1分足を読み直さずにメモリのキャンドルに足していく
+	edited := before
+	edited.Volume = 100
+	noError(t, repo.SaveCandle(&edited), "SaveCandle")
+	a.Add(testProductCode, testBase.Add(3*time.Minute+10*time.Second), 97, 1)
+	a.flush()
+
+	hour, err := repo.GetCandlesInRange(testProductCode, time.Hour, time.Time{}, time.Time{})
+	noError(t, err, "GetCandlesInRange")
+	expectCandles(t, "1h candles", hour, []Candle{testCandle(time.Hour, 0, 100, 97, 104, 97, 5)})
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+)
+
+// backfill.go 過去の約定履歴からキャンドルを作り直すファイル
+
+// ExecutionSource 約定履歴を新しい順に返す interface
+type ExecutionSource interface {
+	// before (約定ID) より古い約定履歴を新しい順に返す。before が 0 の場合は最新から返し、無くなったら空を返す
+	Executions(ctx context.Context, before int) ([]bitflyer.Execution, error)
+}
+
+// BackfillCheckpoint どこまでバックフィルしたかを格納するStruct
+type BackfillCheckpoint struct {
+	ProductCode string
+	Start       time.Time
+	End         time.Time
+	// 次はこの約定IDより古い約定履歴から取得する (0 は最新から)
+	BeforeID int
+	// 書き込み済みの中で一番古いキャンドルの時間
+	Oldest time.Time
+	Done   bool
+}
+
+// チェックポイントを取得するfunction (まだ無ければ最初から始めるチェックポイントを返す)
+func GetBackfillCheckpoint(productCode string, start, end time.Time) *BackfillCheckpoint {
+	checkpoint, err := Repo.GetBackfillCheckpoint(productCode, start, end)
+	if err != nil {
+		log.Printf("action=GetBackfillCheckpoint err=%s", err.Error())
+	}
+	if checkpoint == nil {
+		checkpoint = &BackfillCheckpoint{ProductCode: productCode, Start: start, End: end, Oldest: end}
+	}
+	return checkpoint
+}
+
+// チェックポイントを削除するfunction (次回は範囲の最初からやり直す)
+func (c *BackfillCheckpoint) delete() error {
+	return Repo.DeleteBackfillCheckpoint(c)
+}
+
+// BackfillCandles start から end までの約定履歴を遡って、durations ごとのキャンドルを作り直すfunction
+// 範囲は一番長い duration の区切りに広げる。一番長い duration の区切りごとにキャンドルとチェックポイントを
+// 同じトランザクションで書き込むので、途中で止まっても次回は続きから再開できる
+func BackfillCandles(ctx context.Context, source ExecutionSource, productCode string, durations []time.Duration, start, end time.Time) error {
+	var unit time.Duration
+	for _, duration := range durations {
+		if duration > unit {
+			unit = duration
+		}
+	}
+	if unit == 0 {
+		return nil
+	}
+	start = start.UTC().Truncate(unit)
+	if truncated := end.UTC().Truncate(unit); truncated.Before(end) {
+		end = truncated.Add(unit)
+	} else {
+		end = truncated
+	}
+
+	checkpoint := GetBackfillCheckpoint(productCode, start, end)
+	if checkpoint.Done {
+		log.Printf("action=BackfillCandles status=already_done product_code=%s start=%s end=%s", productCode, start, end)
+		return nil
+	}
+	log.Printf("action=BackfillCandles status=start product_code=%s start=%s end=%s before_id=%d", productCode, start, end, checkpoint.BeforeID)
+
+	// 書き込み待ちの一番古い区切りの約定履歴 (新しい順)
+	var pending []bitflyer.Execution
+	var pendingTime time.Time
+	before := checkpoint.BeforeID
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		executions, err := source.Executions(ctx, before)
+		if err != nil {
+			return err
+		}
+		// 約定履歴が無くなった場合は、取得できた所までで終了する
+		if len(executions) == 0 {
+			return checkpoint.finish(durations, pending, pendingTime)
+		}
+		for _, execution := range executions {
+			dateTime := execution.DateTime()
+			if !dateTime.Before(end) {
+				continue
+			}
+			bucket := dateTime.Truncate(unit)
+			// 区切りを遡ったら、その前の区切りの約定履歴は全て揃っているので書き込む
+			if len(pending) > 0 && bucket.Before(pendingTime) {
+				if err := checkpoint.flush(durations, pending, pendingTime, false); err != nil {
+					return err
+				}
+				pending = nil
+			}
+			if dateTime.Before(start) {
+				return checkpoint.finish(durations, pending, pendingTime)
+			}
+			pendingTime = bucket
+			pending = append(pending, execution)
+		}
+		before = executions[len(executions)-1].ID
+	}
+}
+
+// 残りの約定履歴を書き込んでバックフィルを終了するfunction
+// 範囲の終わりがまだ来ていない場合は、次回また最初からやり直せるようにチェックポイントを消す
+func (c *BackfillCheckpoint) finish(durations []time.Duration, pending []bitflyer.Execution, pendingTime time.Time) error {
+	if err := c.flush(durations, pending, pendingTime, true); err != nil {
+		return err
+	}
+	log.Printf("action=BackfillCandles status=done product_code=%s start=%s end=%s oldest=%s", c.ProductCode, c.Start, c.End, c.Oldest)
+	if c.End.After(time.Now()) {
+		return c.delete()
+	}
+	return nil
+}
+
+// 新しい順に並んだ約定履歴からキャンドルを作って、チェックポイントと一緒に書き込むfunction
+func (c *BackfillCheckpoint) flush(durations []time.Duration, executions []bitflyer.Execution, bucket time.Time, done bool) error {
+	return Repo.RunInTx(func(repo Repository) error {
+		for _, duration := range durations {
+			for _, candle := range candlesFromExecutions(c.ProductCode, duration, executions) {
+				if err := repo.SaveCandle(candle); err != nil {
+					log.Printf("action=BackfillCandles err=%s", err.Error())
+					return err
+				}
+			}
+		}
+		if len(executions) > 0 {
+			c.BeforeID = executions[len(executions)-1].ID
+			c.Oldest = bucket
+		}
+		c.Done = done
+		if err := repo.SaveBackfillCheckpoint(c); err != nil {
+			log.Printf("action=BackfillCandles err=%s", err.Error())
+			return err
+		}
+		return nil
+	})
+}
+
+// 新しい順に並んだ約定履歴を duration ごとのキャンドルにまとめるfunction
+func candlesFromExecutions(productCode string, duration time.Duration, executions []bitflyer.Execution) []*Candle {
+	var candles []*Candle
+	candleByTime := map[time.Time]*Candle{}
+	// 古い順に見て始値と終値を決める
+	for i := len(executions) - 1; i >= 0; i-- {
+		execution := executions[i]
+		dateTime := execution.TruncateDateTime(duration)
+		current, ok := candleByTime[dateTime]
+		if !ok {
+			current = NewCandle(productCode, duration, dateTime,
+				execution.Price, execution.Price, execution.Price, execution.Price, 0)
+			candleByTime[dateTime] = current
+			candles = append(candles, current)
+		}
+		if current.High < execution.Price {
+			current.High = execution.Price
+		}
+		if current.Low > execution.Price {
+			current.Low = execution.Price
+		}
+		current.Close = execution.Price
+		current.Volume += execution.Size
+	}
+	return candles
+}
@@ -1,9 +1,7 @@
 package models
 
 import (
-	"database/sql"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
@@ -15,48 +13,35 @@ import (
 
 // テーブルネームの指定
 const (
-	tableNameSignalEvents = "signal_events"
+	tableNameSignalEvents        = "signal_events"
+	tableNameBackfillCheckpoints = "backfill_checkpoints"
 )
 
-var DbConnection *sql.DB
-
 // GetCandleTableName テーブルネームをGetするfunction
 func GetCandleTableName(productCode string, duration time.Duration) string {
 	return fmt.Sprintf("%s_%s", productCode, duration)
 }
 
-// DBスキーマの作成
-func init() {
-	var err error
-	DbConnection, err = sql.Open(config.Config.SQLDriver, config.Config.DbName)
+// OpenDB config.ini の [db] の保存先を開いて Repo に設定するfunction
+// 適用されていないマイグレーションを適用してから、商品と期間ごとのキャンドルのテーブルを作成する
+// DB のスキーマがこのプログラムより新しい場合は ErrSchemaTooNew を返して何もしない
+func OpenDB() error {
+	repo, err := OpenRepository(config.Config.SQLDriver, config.Config.DbName)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	// クエリの作成
-	// ビットコインの売買のイベントを書き込むテーブルを作成
-	cmd := fmt.Sprintf(`
-	CREATE TABLE IF NOT EXISTS %s (
-		time DATETIME PRIMARY KEY NOT NULL,
-		product_code STRING,
-		side STRING,
-		price FLOAT,
-		size FLOAT)`, tableNameSignalEvents)
-
-	// SQL実行
-	DbConnection.Exec(cmd)
-
+	if err := repo.Migrate(); err != nil {
+		repo.Close()
+		return err
+	}
+	var durations []time.Duration
 	for _, duration := range config.Config.Durations {
-		tableName := GetCandleTableName(config.Config.ProductCode, duration)
-
-		// キャンドルスティックの情報を入れるテーブルを作成
-		c := fmt.Sprintf(`
-	CREATE TABLE IF NOT EXISTS %s (
-		time DATETIME PRIMARY KEY NOT NULL,
-		open FLOAT,
-		close FLOAT,
-		high FLOAT,
-		low FLOAT,
-		volume FLOAT)`, tableName)
-		DbConnection.Exec(c)
+		durations = append(durations, duration)
+	}
+	if err := repo.CreateCandleTables(config.Config.ProductCodes, durations); err != nil {
+		repo.Close()
+		return err
 	}
+	Repo = repo
+	return nil
 }
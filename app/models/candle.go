@@ -1,10 +1,11 @@
 package models
 
 import (
-	"fmt"
+	"log"
 	"time"
 
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/bitflyer"
+	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
 )
 
 // Candle キャンドルスティックのモデルを作成
@@ -17,19 +18,40 @@ type Candle struct {
 	High        float64       `json:"high"`
 	Low         float64       `json:"low"`
 	Volume      float64       `json:"volume"`
+	// キャンドルが確定した時点の最良気配 (記録していない場合は0)
+	Bid float64 `json:"bid,omitempty"`
+	Ask float64 `json:"ask,omitempty"`
+}
+
+// キャンドルのテーブルから読み込むカラム (scan と同じ順番にする)
+const candleColumns = "time, open, close, high, low, volume, bid, ask"
+
+// *sql.Row と *sql.Rows のどちらからでも読み込めるようにする interface
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// candleColumns の順番でキャンドルを読み込むfunction
+// DB によってはセッションのタイムゾーンで返してくるので UTC に揃える
+func (c *Candle) scan(row scanner) error {
+	if err := row.Scan(&c.Time, &c.Open, &c.Close, &c.High, &c.Low, &c.Volume, &c.Bid, &c.Ask); err != nil {
+		return err
+	}
+	c.Time = c.Time.UTC()
+	return nil
 }
 
 // NewCandle Candleを作成するfunction
 func NewCandle(productCode string, duration time.Duration, timeDate time.Time, open, close, high, low, volume float64) *Candle {
 	return &Candle{
-		productCode,
-		duration,
-		timeDate,
-		open,
-		close,
-		high,
-		low,
-		volume,
+		ProductCode: productCode,
+		Duration:    duration,
+		Time:        timeDate,
+		Open:        open,
+		Close:       close,
+		High:        high,
+		Low:         low,
+		Volume:      volume,
 	}
 }
 
@@ -40,89 +62,161 @@ func (c *Candle) TableName() string {
 
 // Create テーブル作成する(キャンドルスティックを作成する)function
 func (c *Candle) Create() error {
-	cmd := fmt.Sprintf("INSERT INTO %s (time, open, close, high, low, volume) VALUES (?, ?, ?, ?, ?, ?)", c.TableName())
-	_, err := DbConnection.Exec(cmd, c.Time.Format(time.RFC3339), c.Open, c.Close, c.High, c.Low, c.Volume)
-	if err != nil {
-		return err
-	}
-	return err
+	return Repo.SaveCandle(c)
 }
 
 // Save テーブルをアップデートする(キャンドルスティックを更新する)function
 func (c *Candle) Save() error {
-	cmd := fmt.Sprintf("UPDATE %s SET open = ?, close = ?, high = ?, low = ?, volume = ? WHERE time = ?", c.TableName())
-	_, err := DbConnection.Exec(cmd, c.Open, c.Close, c.High, c.Low, c.Volume, c.Time.Format(time.RFC3339))
-	if err != nil {
-		return err
-	}
-	return err
+	return Repo.SaveCandle(c)
 }
 
 // GetCandle Selectするfunction
 func GetCandle(productCode string, duration time.Duration, dateTime time.Time) *Candle {
-	tableName := GetCandleTableName(productCode, duration)
-	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume FROM  %s WHERE time = ?", tableName)
-	row := DbConnection.QueryRow(cmd, dateTime.Format(time.RFC3339))
-	var candle Candle
-	err := row.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume)
+	candle, err := Repo.GetCandle(productCode, duration, dateTime)
 	if err != nil {
+		log.Printf("action=GetCandle err=%s", err.Error())
 		return nil
 	}
-	return NewCandle(productCode, duration, candle.Time, candle.Open, candle.Close, candle.High, candle.Low, candle.Volume)
+	return candle
 }
 
 // CreateCandleWithDuration Tickerで取得した情報をもとにDBに書き込みキャンドルスティックを作成するfunction
 func CreateCandleWithDuration(ticker bitflyer.Ticker, productCode string, duration time.Duration) bool {
+	// 商品ごとに設定した種類の価格を使う
+	return createCandle(productCode, duration, ticker.TruncateDateTime(duration), ticker.GetPrice(config.Config.PriceSources[productCode]), ticker.Volume)
+}
+
+// CreateCandleWithExecution 約定履歴をもとにDBに書き込みキャンドルスティックを作成するfunction
+// 実際の約定価格とサイズを使うので、出来高がそのキャンドルの期間の取引量になる
+func CreateCandleWithExecution(execution bitflyer.Execution, productCode string, duration time.Duration) bool {
+	return createCandle(productCode, duration, execution.TruncateDateTime(duration), execution.Price, execution.Size)
+}
+
+// 価格と出来高でキャンドルを作成・更新するfunction
+func createCandle(productCode string, duration time.Duration, dateTime time.Time, price, volume float64) bool {
 	// 直近のキャンドルを定義
-	currentCandle := GetCandle(productCode, duration, ticker.TruncateDateTime(duration))
-	// 金額の中間地点を取得
-	price := ticker.GetMidPrice()
+	currentCandle := GetCandle(productCode, duration, dateTime)
 	// currentCandle が存在しない場合、DBにcurrentCandleを作成する
 	if currentCandle == nil {
-		candle := NewCandle(productCode, duration, ticker.TruncateDateTime(duration),
-			price, price, price, price, ticker.Volume)
+		candle := NewCandle(productCode, duration, dateTime,
+			price, price, price, price, volume)
 		candle.Create()
 		return true
 	}
-	// 存在するキャンドルと取得したキャンドルの価格に差異があった場合、書き換える
-	if currentCandle.High <= price {
-		currentCandle.High = price
-	} else if currentCandle.Low >= price {
-		currentCandle.Low = price
+	// 高値・安値・終値と出来高を更新する
+	currentCandle.update(price, volume)
+	currentCandle.Save()
+	return false
+}
+
+// 価格と出来高をキャンドルに反映するfunction
+// 1つの価格で高値と安値の両方が更新されることもあるので、それぞれ判定する
+func (c *Candle) update(price, volume float64) {
+	if c.High < price {
+		c.High = price
+	}
+	if c.Low > price {
+		c.Low = price
 	}
 	// 出来高を蓄積
-	currentCandle.Volume += ticker.Volume
+	c.Volume += volume
 	// マーケットがクローズした時の金額を格納
-	currentCandle.Close = price
-	currentCandle.Save()
-	return false
+	c.Close = price
+}
+
+// 最良気配をキャンドルに記録するfunction (0 の場合は気配が無いので前の値を残す)
+func (c *Candle) setQuote(bid, ask float64) {
+	if bid > 0 {
+		c.Bid = bid
+	}
+	if ask > 0 {
+		c.Ask = ask
+	}
+}
+
+// バックテストで買う時の価格を返すfunction
+// back_test_fill = quote の場合は売り気配で買ったことにする (気配が無いキャンドルは終値)
+func (c *Candle) BuyPrice() float64 {
+	if config.Config.BackTestFill == "quote" && c.Ask > 0 {
+		return c.Ask
+	}
+	return c.Close
+}
+
+// バックテストで売る時の価格を返すfunction
+// back_test_fill = quote の場合は買い気配で売ったことにする (気配が無いキャンドルは終値)
+func (c *Candle) SellPrice() float64 {
+	if config.Config.BackTestFill == "quote" && c.Bid > 0 {
+		return c.Bid
+	}
+	return c.Close
 }
 
 // 最新のTicker情報を取得してデータフレームに返すfunction
 func GetAllCandle(productCode string, duration time.Duration, limit int) (dfCandle *DataFrameCandle, err error) {
-	tableName := GetCandleTableName(productCode, duration)
-	cmd := fmt.Sprintf(`SELECT * FROM (
-	SELECT time, open, close, high, low, volume FROM %s ORDER BY time DESC LIMIT ?
-) ORDER BY time ASC;`, tableName)
-	rows, err := DbConnection.Query(cmd, limit)
+	candles, err := Repo.GetLatestCandles(productCode, duration, limit)
 	if err != nil {
 		return
 	}
-	defer rows.Close()
-
 	dfCandle = &DataFrameCandle{}
 	dfCandle.ProductCode = productCode
 	dfCandle.Duration = duration
-	for rows.Next() {
-		var candle Candle
-		candle.ProductCode = productCode
-		candle.Duration = duration
-		rows.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume)
-		dfCandle.Candles = append(dfCandle.Candles, candle)
-	}
-	err = rows.Err()
+	dfCandle.Candles = candles
+	return dfCandle, nil
+}
+
+// GetCandlesBetween from 以上 to 未満のキャンドルをデータフレームで返すfunction (ゼロ値の方は制限しない)
+// 暴落した週などの期間を指定してバックテストする時に使う
+func GetCandlesBetween(productCode string, duration time.Duration, from, to time.Time) (*DataFrameCandle, error) {
+	candles, err := Repo.GetCandlesInRange(productCode, duration, from, to)
 	if err != nil {
-		return
+		return nil, err
 	}
-	return dfCandle, nil
+	return &DataFrameCandle{ProductCode: productCode, Duration: duration, Candles: candles}, nil
+}
+
+// CandlePage 1ページ分のキャンドルと、前後のページを取得するためのカーソル
+type CandlePage struct {
+	*DataFrameCandle
+	// より古いキャンドルがある場合に、to に指定すると前のページを取得できる時間
+	PrevCursor *time.Time `json:"prev_cursor,omitempty"`
+	// より新しいキャンドルがある場合に、from に指定すると次のページを取得できる時間
+	NextCursor *time.Time `json:"next_cursor,omitempty"`
+}
+
+// GetCandlePage from 以上 to 未満のキャンドルを limit 件ずつ取得するfunction
+// from を指定した場合は古い方から、指定しない場合は新しい方 (to の直前) から limit 件を返す
+// カーソルは範囲に関係なく、そのページより古い・新しいキャンドルがある場合に返す
+func GetCandlePage(productCode string, duration time.Duration, from, to time.Time, limit int) (*CandlePage, error) {
+	var candles []Candle
+	var err error
+	if from.IsZero() {
+		candles, err = Repo.GetLatestCandlesInRange(productCode, duration, from, to, limit)
+	} else {
+		candles, err = Repo.GetOldestCandlesInRange(productCode, duration, from, to, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	page := &CandlePage{DataFrameCandle: &DataFrameCandle{ProductCode: productCode, Duration: duration, Candles: candles}}
+	if len(candles) == 0 {
+		return page, nil
+	}
+
+	first, next := candles[0].Time, candles[len(candles)-1].Time.Add(duration)
+	older, err := Repo.GetLatestCandlesInRange(productCode, duration, time.Time{}, first, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(older) > 0 {
+		page.PrevCursor = &first
+	}
+	newer, err := Repo.GetOldestCandlesInRange(productCode, duration, next, time.Time{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(newer) > 0 {
+		page.NextCursor = &next
+	}
+	return page, nil
 }
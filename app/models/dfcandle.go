@@ -236,8 +236,8 @@ func (df *DataFrameCandle) AddHv(period int) bool {
 
 // 指定時間以降の Events を取得するfunction
 func (df *DataFrameCandle) AddEvents(timeTime time.Time) bool {
-	signalEvents := GetSignalEventsAfterTime(timeTime)
-	if len(signalEvents.Signals) > 0 {
+	signalEvents := GetSignalEventsAfterTime(df.ProductCode, timeTime)
+	if signalEvents != nil && len(signalEvents.Signals) > 0 {
 		df.Events = signalEvents
 		return true
 	}
@@ -262,11 +262,11 @@ func (df *DataFrameCandle) BackTestEma(period1, period2 int) *SignalEvents {
 		}
 		// ゴールデンクロス(EMAの上昇) が起きたとき、ビットコインを購入する
 		if emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] {
-			SignalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			SignalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].BuyPrice(), 1.0, false)
 		}
 		// デッドクロス(EMAの下降)が起きたとき、ビットコインを売却する
 		if emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] {
-			SignalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			SignalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].SellPrice(), 1.0, false)
 		}
 
 	}
@@ -316,11 +316,11 @@ func (df *DataFrameCandle) BackTestBb(n int, k float64) *SignalEvents {
 		}
 		// ボリンジャーバンドの下端より、キャンドルスティックの終値が高くて上昇している時に購入
 		if bbDown[i-1] > df.Candles[i-1].Close && bbDown[i] <= df.Candles[i].Close {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].BuyPrice(), 1.0, false)
 		}
 		// ボリンジャーバンドの上端より、キャンドルスティックの終値が低くて下降している時に売却
 		if bbUp[i-1] < df.Candles[i-1].Close && bbUp[i] >= df.Candles[i].Close {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].SellPrice(), 1.0, false)
 		}
 	}
 	return signalEvents
@@ -367,14 +367,14 @@ func (df *DataFrameCandle) BackTestIchimoku() *SignalEvents {
 		if chikou[i-1] < df.Candles[i-1].High && chikou[i] >= df.Candles[i].High &&
 			senkouA[i] < df.Candles[i].Low && senkouB[i] < df.Candles[i].Low &&
 			tenkan[i] > kijun[i] {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].BuyPrice(), 1.0, false)
 		}
 
 		// キャンドルスティックが上端が遅行線を下回り、下端が先行線よりも下の場合売却
 		if chikou[i-1] > df.Candles[i-1].Low && chikou[i] <= df.Candles[i].Low &&
 			senkouA[i] > df.Candles[i].High && senkouB[i] > df.Candles[i].High &&
 			tenkan[i] < kijun[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].SellPrice(), 1.0, false)
 		}
 	}
 	return &signalEvents
@@ -410,7 +410,7 @@ func (df *DataFrameCandle) BackTestMacd(macdFastPeriod, macdSlowPeriod, macdSign
 			// 前日のMACDがSignalを下回っていて、本日上回っていたら購入
 			outMACD[i-1] < outMACDSignal[i-1] &&
 			outMACD[i] >= outMACDSignal[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].SellPrice(), 1.0, false)
 		}
 
 		// 売却の条件
@@ -419,7 +419,7 @@ func (df *DataFrameCandle) BackTestMacd(macdFastPeriod, macdSlowPeriod, macdSign
 			// 前日のMACDがSignalを上回っていて、本日下回っていたら売却
 			outMACD[i-1] > outMACDSignal[i-1] &&
 			outMACD[i] <= outMACDSignal[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].SellPrice(), 1.0, false)
 		}
 
 	}
@@ -468,12 +468,12 @@ func (df *DataFrameCandle) BackTestRsi(period int, buyThread, sellThread float64
 		}
 		// 前日のRSIが下端の線より下で、本日上回れば購入
 		if values[i-1] < buyThread && values[i] >= buyThread {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].BuyPrice(), 1.0, false)
 		}
 
 		// 前日のRSIが上端の線より上で、本日下回れば売却
 		if values[i-1] > sellThread && values[i] <= sellThread {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false)
+			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].SellPrice(), 1.0, false)
 		}
 	}
 	return signalEvents
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// mysql is SQLDriver
+	_ "github.com/go-sql-driver/mysql"
+	// postgres is SQLDriver
+	_ "github.com/lib/pq"
+)
+
+// dialect.go DB の種類ごとの SQL の違いをまとめるファイル
+
+// dialect DB の種類ごとのカラムの型や SQL の書き方
+type dialect struct {
+	// SQLDriver の名前
+	name string
+	// プレースホルダを ? ではなく $1, $2 ... で書く
+	numberedPlaceholders bool
+
+	timeType  string
+	floatType string
+	intType   string
+	boolType  string
+	// 主キーにも使う文字列の型
+	textType string
+
+	// マイグレーションを導入する前に作成したキャンドルのテーブルを、導入した時点のカラムに合わせる SQL
+	// (既にカラムがある場合の isDuplicateColumn のエラーだけ無視する)
+	candleTableUpgrades []string
+	// 現在のスキーマのテーブル名の一覧を返す SQL
+	listTables string
+	// DB 全体のバイト数を返す SQL
+	databaseBytes string
+	// ? のテーブルのインデックスを含むバイト数を返す SQL
+	tableBytes string
+
+	// 時間を DB に渡す値に変換する
+	timeValue func(t time.Time) interface{}
+	// columns を書き込み、keys が同じ行があれば置き換える INSERT 文を返す
+	upsert func(table string, columns, keys []string) string
+	// 一意制約の違反のエラーか判定する
+	isDuplicate func(err error) bool
+	// 追加しようとしたカラムが既にある時のエラーか判定する
+	isDuplicateColumn func(err error) bool
+	// 削除した行の領域を空けて統計情報を更新する SQL を返す
+	vacuum func(tables []string) []string
+}
+
+// SQLDriver の名前ごとの dialect
+var dialects = map[string]*dialect{
+	"sqlite3":  sqliteDialect,
+	"postgres": postgresDialect,
+	"mysql":    mysqlDialect,
+}
+
+// SQLite ではキャンドルの時間を UTC の RFC3339 の文字列で保存しているので、文字列のまま比較できる
+// テーブルごとの容量は dbstat が有効な SQLite でだけ取得できる
+var sqliteDialect = &dialect{
+	name:      "sqlite3",
+	timeType:  "DATETIME",
+	floatType: "FLOAT",
+	intType:   "INTEGER",
+	boolType:  "BOOLEAN",
+	textType:  "TEXT",
+	candleTableUpgrades: []string{
+		"ALTER TABLE %s ADD COLUMN bid FLOAT NOT NULL DEFAULT 0",
+		"ALTER TABLE %s ADD COLUMN ask FLOAT NOT NULL DEFAULT 0",
+	},
+	listTables:    "SELECT name FROM sqlite_master WHERE type = 'table'",
+	databaseBytes: "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+	tableBytes:    "SELECT SUM(pgsize) FROM dbstat WHERE name = ?",
+	// 文字列のまま比較されるので、タイムゾーンを UTC に揃えてから書式にする
+	timeValue: func(t time.Time) interface{} {
+		return t.UTC().Format(time.RFC3339)
+	},
+	upsert: func(table string, columns, keys []string) string {
+		return fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders(len(columns)))
+	},
+	isDuplicate: func(err error) bool {
+		return strings.Contains(err.Error(), "UNIQUE constraint failed")
+	},
+	isDuplicateColumn: func(err error) bool {
+		return strings.Contains(err.Error(), "duplicate column name")
+	},
+	vacuum: func(tables []string) []string {
+		return []string{"VACUUM", "ANALYZE"}
+	},
+}
+
+var postgresDialect = &dialect{
+	name:                 "postgres",
+	numberedPlaceholders: true,
+	timeType:             "TIMESTAMPTZ",
+	floatType:            "DOUBLE PRECISION",
+	intType:              "BIGINT",
+	boolType:             "BOOLEAN",
+	textType:             "TEXT",
+	listTables:           "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()",
+	databaseBytes:        "SELECT pg_database_size(current_database())",
+	tableBytes:           "SELECT pg_total_relation_size(CAST(? AS TEXT)::regclass)",
+	timeValue: func(t time.Time) interface{} {
+		return t.UTC()
+	},
+	upsert: func(table string, columns, keys []string) string {
+		var updates []string
+		for _, column := range columns {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+		}
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+			table, strings.Join(columns, ", "), placeholders(len(columns)), strings.Join(keys, ", "), strings.Join(updates, ", "))
+	},
+	isDuplicate: func(err error) bool {
+		// unique_violation (23505)
+		return strings.Contains(err.Error(), "duplicate key value")
+	},
+	isDuplicateColumn: func(err error) bool {
+		// duplicate_column (42701)
+		return strings.Contains(err.Error(), "already exists")
+	},
+	vacuum: func(tables []string) []string {
+		return []string{"VACUUM ANALYZE"}
+	},
+}
+
+// DATETIME を time.Time で読み込むので、dsn には parseTime=true を付ける
+var mysqlDialect = &dialect{
+	name:          "mysql",
+	timeType:      "DATETIME",
+	floatType:     "DOUBLE",
+	intType:       "BIGINT",
+	boolType:      "BOOLEAN",
+	textType:      "VARCHAR(64)",
+	listTables:    "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE()",
+	databaseBytes: "SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()",
+	tableBytes:    "SELECT data_length + index_length FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+	timeValue: func(t time.Time) interface{} {
+		return t.UTC()
+	},
+	upsert: func(table string, columns, keys []string) string {
+		var updates []string
+		for _, column := range columns {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+		}
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s",
+			table, strings.Join(columns, ", "), placeholders(len(columns)), strings.Join(updates, ", "))
+	},
+	isDuplicate: func(err error) bool {
+		// ER_DUP_ENTRY (1062)
+		return strings.Contains(err.Error(), "Error 1062")
+	},
+	isDuplicateColumn: func(err error) bool {
+		// ER_DUP_FIELDNAME (1060)
+		return strings.Contains(err.Error(), "Error 1060")
+	},
+	// InnoDB の OPTIMIZE TABLE はテーブルを作り直して領域を空ける
+	vacuum: func(tables []string) []string {
+		if len(tables) == 0 {
+			return nil
+		}
+		return []string{"OPTIMIZE TABLE " + strings.Join(tables, ", "), "ANALYZE TABLE " + strings.Join(tables, ", ")}
+	},
+}
+
+// n 個の ? をカンマ区切りで返すfunction
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// ? で書いた SQL を DB のプレースホルダの書き方に変換するfunction
+func (d *dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// 最新のスキーマでキャンドルのテーブルを作成する SQL を返すfunction
+// 作成済みのテーブルは変わらないので、カラムを変える場合はマイグレーションも追加する
+func (d *dialect) createCandleTable(tableName string) string {
+	return fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		time %s PRIMARY KEY NOT NULL,
+		open %s,
+		close %s,
+		high %s,
+		low %s,
+		volume %s,
+		bid %s NOT NULL DEFAULT 0,
+		ask %s NOT NULL DEFAULT 0,
+		product_code %s NOT NULL DEFAULT '')`, tableName, d.timeType,
+		d.floatType, d.floatType, d.floatType, d.floatType, d.floatType, d.floatType, d.floatType, d.textType)
+}
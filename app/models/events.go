@@ -2,12 +2,9 @@ package models
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
-	"strings"
 	"time"
-
-	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/config"
 )
 
 // ビットコインを売買したイベントをDBに格納していく
@@ -21,16 +18,28 @@ type SignalEvent struct {
 	Size        float64   `json:"size"`
 }
 
+// 売買のイベントのテーブルから読み込むカラム (scan と同じ順番にする)
+const signalEventColumns = "time, product_code, side, price, size"
+
+// signalEventColumns の順番で売買のイベントを読み込むfunction
+func (s *SignalEvent) scan(row scanner) error {
+	if err := row.Scan(&s.Time, &s.ProductCode, &s.Side, &s.Price, &s.Size); err != nil {
+		return err
+	}
+	s.Time = s.Time.UTC()
+	return nil
+}
+
 // tableNameSignalEvents にデータを格納するfunction
 func (s *SignalEvent) Save() bool {
-	cmd := fmt.Sprintf("INSERT INTO %s (time, product_code, side, price, size) VALUES (?, ?, ?, ?, ?)", tableNameSignalEvents)
-	_, err := DbConnection.Exec(cmd, s.Time.Format(time.RFC3339), s.ProductCode, s.Side, s.Price, s.Size)
+	err := Repo.SaveSignalEvent(s)
 	if err != nil {
 		// 間違って同じ時間で購入してしまう時のエラーハンドリング
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		if errors.Is(err, ErrDuplicateSignalEvent) {
 			log.Panicln(err)
 			return true
 		}
+		log.Printf("action=SignalEvent.Save err=%s", err.Error())
 		return false
 	}
 	return true
@@ -39,6 +48,10 @@ func (s *SignalEvent) Save() bool {
 // 売買の記録を順番通りに格納するスライスを定義する
 type SignalEvents struct {
 	Signals []SignalEvent `json:"signals,omitempty"`
+	// 証拠金取引でショートを許可する場合は true にする
+	AllowShort bool `json:"-"`
+	// AllowShort の場合の保有中のポジション
+	Position Position `json:"-"`
 }
 
 func NewSignalEvents() *SignalEvents {
@@ -48,53 +61,31 @@ func NewSignalEvents() *SignalEvents {
 // 損益を計算する
 
 // もしDBにイベント情報があったら順番を入れ替えて tableNameSignalEvents　に格納するfunction
-func GetSignalEventsByCount(loadEvents int) *SignalEvents {
-	cmd := fmt.Sprintf(`SELECT * FROM (
-		SELECT time, product_code, side, price, size FROM %s WHERE product_code = ? ORDER BY time DESC LIMIT ?)
-		ORDER BY time ASC;`, tableNameSignalEvents)
-	rows, err := DbConnection.Query(cmd, config.Config.ProductCode, loadEvents)
-	if err != nil {
-		return nil
-	}
-	defer rows.Close()
-
-	var signalEvents SignalEvents
-	for rows.Next() {
-		var signalEvent SignalEvent
-		rows.Scan(&signalEvent.Time, &signalEvent.ProductCode, &signalEvent.Side, &signalEvent.Price, &signalEvent.Size)
-		signalEvents.Signals = append(signalEvents.Signals, signalEvent)
-	}
-	err = rows.Err()
+func GetSignalEventsByCount(productCode string, loadEvents int) *SignalEvents {
+	signals, err := Repo.GetLatestSignalEvents(productCode, loadEvents)
 	if err != nil {
+		log.Printf("action=GetSignalEventsByCount err=%s", err.Error())
 		return nil
 	}
-	return &signalEvents
+	return &SignalEvents{Signals: signals}
 }
 
 // 指定した時間以降の売買のデータを取得して tableNameSignalEvents　に格納するfunction
-func GetSignalEventsAfterTime(timeTime time.Time) *SignalEvents {
-	cmd := fmt.Sprintf(`SELECT * FROM (
-		SELECT time, product_code, side, price, size FROM %s
-		WHERE DATETIME(time) >= DATETIME(?)
-		ORDER BY time DESC
-	) ORDER BY time ASC;`, tableNameSignalEvents)
-	rows, err := DbConnection.Query(cmd, timeTime.Format(time.RFC3339))
+func GetSignalEventsAfterTime(productCode string, timeTime time.Time) *SignalEvents {
+	signals, err := Repo.GetSignalEventsAfter(productCode, timeTime)
 	if err != nil {
+		log.Printf("action=GetSignalEventsAfterTime err=%s", err.Error())
 		return nil
 	}
-	defer rows.Close()
-
-	var signalEvents SignalEvents
-	for rows.Next() {
-		var signalEvent SignalEvent
-		rows.Scan(&signalEvent.Time, &signalEvent.ProductCode, &signalEvent.Side, &signalEvent.Price, &signalEvent.Size)
-		signalEvents.Signals = append(signalEvents.Signals, signalEvent)
-	}
-	return &signalEvents
+	return &SignalEvents{Signals: signals}
 }
 
 // 実際に購入できるか判定する function
 func (s *SignalEvents) CanBuy(time time.Time) bool {
+	// ショートを許可する場合は、ロングを保有していなければ購入 (もしくはショートの決済) 可能
+	if s.AllowShort {
+		return !s.IsLong() && s.isAfterLastSignal(time)
+	}
 	// SignalEvents の中にはデータがあるか判定
 	lenSignals := len(s.Signals)
 	if lenSignals == 0 {
@@ -111,6 +102,10 @@ func (s *SignalEvents) CanBuy(time time.Time) bool {
 
 // 実際に売却できるか判定する function
 func (s *SignalEvents) CanSell(time time.Time) bool {
+	// ショートを許可する場合は、ショートを保有していなければ売却 (もしくはショートを新規で) 可能
+	if s.AllowShort {
+		return !s.IsShort() && s.isAfterLastSignal(time)
+	}
 	// SignalEvents の中にはデータがあるか判定
 	lenSignals := len(s.Signals)
 	if lenSignals == 0 {
@@ -125,6 +120,16 @@ func (s *SignalEvents) CanSell(time time.Time) bool {
 	return false
 }
 
+// 最後の購入で約定したサイズを返す function (最後のデータが購入でなければ0)
+// DB から読み込んだ最後の売買も含むので、再起動してもボットが購入した分だけを売却できる
+func (s *SignalEvents) BoughtSize() float64 {
+	lenSignals := len(s.Signals)
+	if lenSignals == 0 || s.Signals[lenSignals-1].Side != "BUY" {
+		return 0
+	}
+	return s.Signals[lenSignals-1].Size
+}
+
 // 購入を行う function
 func (s *SignalEvents) Buy(ProductCode string, time time.Time, price, size float64, save bool) bool {
 
@@ -143,6 +148,9 @@ func (s *SignalEvents) Buy(ProductCode string, time time.Time, price, size float
 	if save {
 		signalEvent.Save()
 	}
+	if s.AllowShort {
+		s.applyPosition(signalEvent)
+	}
 	s.Signals = append(s.Signals, signalEvent)
 	return true
 }
@@ -165,12 +173,18 @@ func (s *SignalEvents) Sell(ProductCode string, time time.Time, price, size floa
 	if save {
 		signalEvent.Save()
 	}
+	if s.AllowShort {
+		s.applyPosition(signalEvent)
+	}
 	s.Signals = append(s.Signals, signalEvent)
 	return true
 }
 
 // 売買の profit(利益)を計算する function
 func (s *SignalEvents) Profit() float64 {
+	if s.AllowShort {
+		return s.marginProfit()
+	}
 	total := 0.0
 	beforeSell := 0.0
 	// 購入したがまだ売却していない状況の変数
@@ -220,7 +234,7 @@ func (s *SignalEvents) CollectAfter(time time.Time) *SignalEvents {
 		if time.After(signal.Time) {
 			continue
 		}
-		return &SignalEvents{Signals: s.Signals[i:]}
+		return &SignalEvents{Signals: s.Signals[i:], AllowShort: s.AllowShort}
 	}
 	return nil
 }
@@ -0,0 +1,508 @@
+package models
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// export.go キャンドルと売買のイベントを CSV・Parquet で書き出し、読み込むファイル
+// pandas で分析したり、取引所のダンプなど他の OHLCV の履歴をバックテスト用に取り込んだりするのに使う
+
+// 書き出し・読み込みできる形式
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// ExportFormats 書き出し・読み込みできる形式の一覧
+var ExportFormats = []string{FormatCSV, FormatParquet}
+
+// 一度に DB から読み込んで書き出すキャンドルの数 (テーブル全体をメモリに読み込まないようにする)
+const exportPageSize = 10000
+
+// candleEncoder キャンドルを少しずつ書き出すinterface
+type candleEncoder interface {
+	encode(candles []Candle) error
+	close() error
+}
+
+// signalEventEncoder 売買のイベントを少しずつ書き出すinterface
+type signalEventEncoder interface {
+	encode(events []SignalEvent) error
+	close() error
+}
+
+// 書き出す CSV のヘッダー (pandas の read_csv でそのまま読めるように OHLCV の順にする)
+var (
+	candleCSVHeader      = []string{"time", "open", "high", "low", "close", "volume", "bid", "ask"}
+	signalEventCSVHeader = []string{"time", "product_code", "side", "price", "size"}
+)
+
+// 読み込む CSV のヘッダーの別名。取引所のダンプなどでよく使われる名前も受け付ける
+var csvColumnAliases = map[string]string{
+	"timestamp": "time",
+	"date":      "time",
+	"datetime":  "time",
+	"open_time": "time",
+	"unix":      "time",
+	"o":         "open",
+	"h":         "high",
+	"l":         "low",
+	"c":         "close",
+	"vol":       "volume",
+	"v":         "volume",
+	"product":   "product_code",
+	"qty":       "size",
+	"amount":    "size",
+}
+
+// ファイル名の拡張子から形式を返すfunction (.parquet 以外は CSV として扱う)
+func FormatFromFileName(name string) string {
+	if strings.EqualFold(filepath.Ext(name), ".parquet") {
+		return FormatParquet
+	}
+	return FormatCSV
+}
+
+// ExportCandles start 以上 end 未満のキャンドルを format で w に書き出して、書き出した数を返すfunction
+// start と end がゼロ値の場合は制限しない。exportPageSize 件ずつ読み込んで書き出す
+// 最初の読み込みに失敗した場合は w に何も書き出さずにエラーを返す
+func ExportCandles(w io.Writer, format, productCode string, duration time.Duration, start, end time.Time) (int, error) {
+	candles, err := Repo.GetOldestCandlesInRange(productCode, duration, start, end, exportPageSize)
+	if err != nil {
+		return 0, err
+	}
+	enc, err := newCandleEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+	exported := 0
+	for {
+		if err := enc.encode(candles); err != nil {
+			return exported, err
+		}
+		exported += len(candles)
+		if len(candles) < exportPageSize {
+			break
+		}
+		start = candles[len(candles)-1].Time.Add(duration)
+		if candles, err = Repo.GetOldestCandlesInRange(productCode, duration, start, end, exportPageSize); err != nil {
+			return exported, err
+		}
+	}
+	return exported, enc.close()
+}
+
+// ExportSignalEvents start 以上 end 未満の売買のイベントを format で w に書き出して、書き出した数を返すfunction
+func ExportSignalEvents(w io.Writer, format, productCode string, start, end time.Time) (int, error) {
+	signals, err := Repo.GetSignalEventsAfter(productCode, start)
+	if err != nil {
+		return 0, err
+	}
+	for i, signal := range signals {
+		if !end.IsZero() && !signal.Time.Before(end) {
+			signals = signals[:i]
+			break
+		}
+	}
+	enc, err := newSignalEventEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+	if err := enc.encode(signals); err != nil {
+		return 0, err
+	}
+	return len(signals), enc.close()
+}
+
+// ImportCandles 読み込んだキャンドルを1つのトランザクションで保存するfunction
+// 同じ時間のキャンドルは置き換える。上位の期間のキャンドルは RebuildCandles で作り直す
+func ImportCandles(candles []Candle) error {
+	if len(candles) == 0 {
+		return nil
+	}
+	if err := Repo.CreateCandleTables([]string{candles[0].ProductCode}, []time.Duration{candles[0].Duration}); err != nil {
+		return err
+	}
+	return Repo.RunInTx(func(repo Repository) error {
+		for i := range candles {
+			if err := repo.SaveCandle(&candles[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportSignalEvents 読み込んだ売買のイベントを保存して、保存した数を返すfunction
+// 既に同じ商品・時間のイベントがある場合は保存せずに飛ばす
+// PostgreSQL は一意制約の違反でトランザクションが使えなくなるので、1件ずつ保存する
+func ImportSignalEvents(events []SignalEvent) (int, error) {
+	saved := 0
+	for i := range events {
+		err := Repo.SaveSignalEvent(&events[i])
+		if errors.Is(err, ErrDuplicateSignalEvent) {
+			continue
+		}
+		if err != nil {
+			return saved, err
+		}
+		saved++
+	}
+	return saved, nil
+}
+
+// format で w にキャンドルを書き出す candleEncoder を返すfunction
+func newCandleEncoder(w io.Writer, format string) (candleEncoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVCandleEncoder(w)
+	case FormatParquet:
+		return newParquetCandleEncoder(w)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// format で w に売買のイベントを書き出す signalEventEncoder を返すfunction
+func newSignalEventEncoder(w io.Writer, format string) (signalEventEncoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVSignalEventEncoder(w)
+	case FormatParquet:
+		return newParquetSignalEventEncoder(w)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// キャンドルを format で w に書き出すfunction
+func (df *DataFrameCandle) Write(w io.Writer, format string) error {
+	enc, err := newCandleEncoder(w, format)
+	if err != nil {
+		return err
+	}
+	if err := enc.encode(df.Candles); err != nil {
+		return err
+	}
+	return enc.close()
+}
+
+// 売買のイベントを format で w に書き出すfunction
+func (s *SignalEvents) Write(w io.Writer, format string) error {
+	enc, err := newSignalEventEncoder(w, format)
+	if err != nil {
+		return err
+	}
+	if err := enc.encode(s.Signals); err != nil {
+		return err
+	}
+	return enc.close()
+}
+
+// ReadCandles format の r からキャンドルを読み込んで古い順に返すfunction
+func ReadCandles(r io.Reader, format, productCode string, duration time.Duration) ([]Candle, error) {
+	var candles []Candle
+	var err error
+	switch format {
+	case FormatCSV:
+		candles, err = ReadCandlesCSV(r, productCode, duration)
+	case FormatParquet:
+		candles, err = ReadCandlesParquet(r, productCode, duration)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return candles, sortImportedCandles(candles)
+}
+
+// ReadSignalEvents format の r から売買のイベントを読み込んで古い順に返すfunction
+// 商品コードが無い行は productCode の商品として扱う
+func ReadSignalEvents(r io.Reader, format, productCode string) ([]SignalEvent, error) {
+	var events []SignalEvent
+	var err error
+	switch format {
+	case FormatCSV:
+		events, err = ReadSignalEventsCSV(r, productCode)
+	case FormatParquet:
+		events, err = ReadSignalEventsParquet(r, productCode)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		events[i].Side = strings.ToUpper(events[i].Side)
+		if events[i].Side != "BUY" && events[i].Side != "SELL" {
+			return nil, fmt.Errorf("event at %s has invalid side %q", events[i].Time.Format(time.RFC3339), events[i].Side)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// キャンドルを古い順に並べ直し、期間の区切りに合っているか確認するfunction
+// ダンプは新しい順のことがあるので並べ直し、同じ時間のキャンドルが重なっている場合はエラーにする
+func sortImportedCandles(candles []Candle) error {
+	sort.SliceStable(candles, func(i, j int) bool { return candles[i].Time.Before(candles[j].Time) })
+	for i, candle := range candles {
+		if !candle.Time.Truncate(candle.Duration).Equal(candle.Time) {
+			return fmt.Errorf("candle at %s is not aligned to %s", candle.Time.Format(time.RFC3339), candle.Duration)
+		}
+		if i > 0 && candles[i-1].Time.Equal(candle.Time) {
+			return fmt.Errorf("duplicate candle at %s", candle.Time.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// キャンドルを CSV で w に書き出すfunction (時間は UTC の RFC3339)
+func (df *DataFrameCandle) WriteCSV(w io.Writer) error {
+	return df.Write(w, FormatCSV)
+}
+
+// 売買のイベントを CSV で w に書き出すfunction
+func (s *SignalEvents) WriteCSV(w io.Writer) error {
+	return s.Write(w, FormatCSV)
+}
+
+// csvEncoder ヘッダーを書き出してから、encode のたびに行を書き出すStruct
+type csvEncoder struct {
+	cw *csv.Writer
+}
+
+// ヘッダーを書き出した csvEncoder を返すfunction
+func newCSVEncoder(w io.Writer, header []string) (*csvEncoder, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvEncoder{cw: cw}, nil
+}
+
+// 行を書き出して、途中までの分を w に送るfunction
+func (e *csvEncoder) write(records [][]string) error {
+	if err := e.cw.WriteAll(records); err != nil {
+		return err
+	}
+	return e.cw.Error()
+}
+
+func (e *csvEncoder) close() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// csvCandleEncoder キャンドルを CSV で書き出すStruct
+type csvCandleEncoder struct {
+	*csvEncoder
+}
+
+func newCSVCandleEncoder(w io.Writer) (*csvCandleEncoder, error) {
+	enc, err := newCSVEncoder(w, candleCSVHeader)
+	if err != nil {
+		return nil, err
+	}
+	return &csvCandleEncoder{enc}, nil
+}
+
+func (e *csvCandleEncoder) encode(candles []Candle) error {
+	records := make([][]string, 0, len(candles))
+	for _, c := range candles {
+		records = append(records, []string{c.Time.UTC().Format(time.RFC3339), formatFloat(c.Open), formatFloat(c.High), formatFloat(c.Low),
+			formatFloat(c.Close), formatFloat(c.Volume), formatFloat(c.Bid), formatFloat(c.Ask)})
+	}
+	return e.write(records)
+}
+
+// csvSignalEventEncoder 売買のイベントを CSV で書き出すStruct
+type csvSignalEventEncoder struct {
+	*csvEncoder
+}
+
+func newCSVSignalEventEncoder(w io.Writer) (*csvSignalEventEncoder, error) {
+	enc, err := newCSVEncoder(w, signalEventCSVHeader)
+	if err != nil {
+		return nil, err
+	}
+	return &csvSignalEventEncoder{enc}, nil
+}
+
+func (e *csvSignalEventEncoder) encode(events []SignalEvent) error {
+	records := make([][]string, 0, len(events))
+	for _, event := range events {
+		records = append(records, []string{event.Time.UTC().Format(time.RFC3339), event.ProductCode, event.Side,
+			formatFloat(event.Price), formatFloat(event.Size)})
+	}
+	return e.write(records)
+}
+
+// ReadCandlesCSV ヘッダー付きの CSV からキャンドルを読み込むfunction
+// time・open・high・low・close の列が必要で、volume・bid・ask は無ければ0にする
+func ReadCandlesCSV(r io.Reader, productCode string, duration time.Duration) ([]Candle, error) {
+	records, columns, err := readCSV(r, "time", "open", "high", "low", "close")
+	if err != nil {
+		return nil, err
+	}
+	var candles []Candle
+	for i, record := range records {
+		row := csvRow{record: record, columns: columns}
+		candle := Candle{ProductCode: productCode, Duration: duration}
+		candle.Time = row.time("time")
+		candle.Open, candle.High, candle.Low, candle.Close = row.float("open"), row.float("high"), row.float("low"), row.float("close")
+		candle.Volume, candle.Bid, candle.Ask = row.float("volume"), row.float("bid"), row.float("ask")
+		if row.err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, row.err)
+		}
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
+
+// ReadSignalEventsCSV ヘッダー付きの CSV から売買のイベントを読み込むfunction
+func ReadSignalEventsCSV(r io.Reader, productCode string) ([]SignalEvent, error) {
+	records, columns, err := readCSV(r, "time", "side", "price", "size")
+	if err != nil {
+		return nil, err
+	}
+	var events []SignalEvent
+	for i, record := range records {
+		row := csvRow{record: record, columns: columns}
+		event := SignalEvent{Time: row.time("time"), ProductCode: row.text("product_code"), Side: row.text("side")}
+		event.Price, event.Size = row.float("price"), row.float("size")
+		if row.err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, row.err)
+		}
+		if event.ProductCode == "" {
+			event.ProductCode = productCode
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// CSV を読み込んで、ヘッダー以外の行と列名ごとの位置を返すfunction
+// 列名は大文字・小文字を区別せず、csvColumnAliases の別名も使える。required の列が無い場合はエラーにする
+func readCSV(r io.Reader, required ...string) ([][]string, map[string]int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("empty csv")
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		// Excel などで付く BOM を取り除く
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if alias, ok := csvColumnAliases[name]; ok {
+			name = alias
+		}
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("csv has no %s column", name)
+		}
+	}
+	return records[1:], columns, nil
+}
+
+// csvRow CSV の1行を列名で読み、最初に失敗したエラーを覚えておくStruct
+type csvRow struct {
+	record  []string
+	columns map[string]int
+	err     error
+}
+
+// 列の値を返すfunction (列が無い場合は空文字)
+func (row *csvRow) text(name string) string {
+	i, ok := row.columns[name]
+	if !ok || i >= len(row.record) {
+		return ""
+	}
+	return strings.TrimSpace(row.record[i])
+}
+
+// 列の値を数値で返すfunction (空の場合は0)
+func (row *csvRow) float(name string) float64 {
+	value := row.text(name)
+	if value == "" || row.err != nil {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		row.err = fmt.Errorf("%s: %w", name, err)
+	}
+	return f
+}
+
+// 列の値を時間で返すfunction
+func (row *csvRow) time(name string) time.Time {
+	if row.err != nil {
+		return time.Time{}
+	}
+	t, err := parseExportTime(row.text(name))
+	if err != nil {
+		row.err = fmt.Errorf("%s: %w", name, err)
+	}
+	return t
+}
+
+// タイムゾーンの無い時間は UTC として読み込む形式
+var exportTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// RFC3339 などの文字列か、UNIX 時間の数値を UTC の時間に変換するfunction
+func parseExportTime(value string) (time.Time, error) {
+	for _, layout := range exportTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	// 1e11 (5138年) より小さい値は秒として、小数点以下をミリ秒まで使う
+	if math.Abs(f) < 1e11 {
+		return epochTime(int64(math.Round(f * 1000))), nil
+	}
+	return epochTime(int64(f)), nil
+}
+
+// UNIX 時間をミリ秒・マイクロ秒・ナノ秒の桁数から判定して UTC の時間に変換するfunction
+func epochTime(value int64) time.Time {
+	switch {
+	case value < 1e14:
+		return time.UnixMilli(value).UTC()
+	case value < 1e17:
+		return time.UnixMicro(value).UTC()
+	}
+	return time.Unix(0, value).UTC()
+}
+
+// 数値を必要な桁数だけの文字列にするfunction
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
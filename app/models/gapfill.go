@@ -0,0 +1,77 @@
+package models
+
+import (
+	"log"
+	"time"
+)
+
+// gapfill.go Tick が無かった期間のキャンドルを埋めるファイル
+// キャンドルが抜けているとインディケータの計算で期間がずれてしまうので、前の終値の出来高0のキャンドルで埋める
+
+// ライブで一度に埋めるキャンドルの上限 (長く止まっていた場合は FillCandleGaps で埋める)
+const maxLiveGapCandles = 1000
+
+// FillCandleGaps で一度に読み込むキャンドルの数
+const fillGapsPageSize = 10000
+
+// previous の次の期間から next の前までを、previous の終値で埋めるキャンドルを返すfunction
+func flatCandles(previous *Candle, next time.Time) []*Candle {
+	var candles []*Candle
+	for dateTime := previous.Time.Add(previous.Duration); dateTime.Before(next); dateTime = dateTime.Add(previous.Duration) {
+		candle := NewCandle(previous.ProductCode, previous.Duration, dateTime,
+			previous.Close, previous.Close, previous.Close, previous.Close, 0)
+		candle.setQuote(previous.Bid, previous.Ask)
+		candles = append(candles, candle)
+	}
+	return candles
+}
+
+// FillCandleGaps start 以上 end 未満で抜けている期間のキャンドルを埋めて、埋めた数を返すfunction (ゼロ値の方は制限しない)
+// start の直前のキャンドルから埋め、最初のキャンドルより前と範囲内の最後のキャンドルより後は埋めない
+// テーブル全体を読み込まないように fillGapsPageSize 件ずつ処理する
+func FillCandleGaps(productCode string, duration time.Duration, start, end time.Time) (int, error) {
+	var previous *Candle
+	if !start.IsZero() {
+		before, err := Repo.GetLatestCandlesInRange(productCode, duration, time.Time{}, start, 1)
+		if err != nil {
+			return 0, err
+		}
+		if len(before) > 0 {
+			previous = &before[0]
+		}
+	}
+
+	filled := 0
+	pageStart := start
+	for {
+		candles, err := Repo.GetOldestCandlesInRange(productCode, duration, pageStart, end, fillGapsPageSize)
+		if err != nil {
+			return filled, err
+		}
+		var gaps []*Candle
+		for i := range candles {
+			if previous != nil {
+				gaps = append(gaps, flatCandles(previous, candles[i].Time)...)
+			}
+			previous = &candles[i]
+		}
+		err = Repo.RunInTx(func(repo Repository) error {
+			for _, candle := range gaps {
+				if err := repo.SaveCandle(candle); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return filled, err
+		}
+		filled += len(gaps)
+		if len(candles) < fillGapsPageSize {
+			break
+		}
+		pageStart = previous.Time.Add(duration)
+	}
+	log.Printf("action=FillCandleGaps product_code=%s duration=%s start=%s end=%s filled=%d", productCode, duration, start, end, filled)
+	return filled, nil
+}
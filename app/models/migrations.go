@@ -0,0 +1,269 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// migrations.go DB のスキーマを番号付きのマイグレーションで変更するファイル
+// 適用したマイグレーションは schema_migrations に記録し、起動時に足りない分を適用する
+// MySQL は DDL でトランザクションがコミットされてしまうので、途中で失敗した場合は手で戻す必要がある
+
+const tableNameSchemaMigrations = "schema_migrations"
+
+// ErrSchemaTooNew DB のスキーマがこのプログラムの知らないマイグレーションまで適用されている時のエラー
+var ErrSchemaTooNew = errors.New("database schema is newer than this program")
+
+// migration 1つ分のスキーマの変更と、それを戻す処理
+// 一度リリースしたマイグレーションは書き換えず、変更する場合は新しい番号で追加する
+type migration struct {
+	Version int
+	Name    string
+	Up      func(r *sqlRepository) error
+	Down    func(r *sqlRepository) error
+}
+
+// 番号順に並べたマイグレーションの一覧
+var migrations = []migration{
+	{Version: 1, Name: "add_product_code", Up: addProductCodeUp, Down: addProductCodeDown},
+}
+
+// LatestSchemaVersion このプログラムが知っている一番新しいマイグレーションの番号を返すfunction
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func (r *sqlRepository) Migrate() error {
+	return r.MigrateTo(LatestSchemaVersion())
+}
+
+// マイグレーションの記録のテーブルが無ければ作成するfunction
+func (r *sqlRepository) createSchemaMigrationsTable() error {
+	cmd := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		version %s PRIMARY KEY NOT NULL,
+		name %s,
+		applied_at %s)`, tableNameSchemaMigrations, r.dialect.intType, r.dialect.textType, r.dialect.timeType)
+	_, err := r.exec(cmd)
+	return err
+}
+
+// DB を変更しないように、マイグレーションの記録のテーブルが無い場合は作成せずに0を返す
+func (r *sqlRepository) SchemaVersion() (int, error) {
+	names, err := r.tableNames()
+	if err != nil {
+		return 0, err
+	}
+	exists := false
+	for _, name := range names {
+		if name == tableNameSchemaMigrations {
+			exists = true
+		}
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	cmd := fmt.Sprintf("SELECT MAX(version) FROM %s", tableNameSchemaMigrations)
+	if err := r.queryRow(cmd).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func (r *sqlRepository) MigrateTo(version int) error {
+	if err := r.createSchemaMigrationsTable(); err != nil {
+		return err
+	}
+	current, err := r.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := LatestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, this program supports up to %d", ErrSchemaTooNew, current, latest)
+	}
+	if version < 0 || version > latest {
+		return fmt.Errorf("unknown schema version %d (latest is %d)", version, latest)
+	}
+	// マイグレーションを導入する前のスキーマを作成する (導入前のDBの場合はそのまま使う)
+	if current == 0 && version > 0 {
+		if err := r.inTx(createBaselineSchema); err != nil {
+			return fmt.Errorf("baseline schema: %w", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > version {
+			continue
+		}
+		err := r.inTx(func(tx *sqlRepository) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			cmd := fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (?, ?, ?)", tableNameSchemaMigrations)
+			_, err := tx.exec(cmd, m.Version, m.Name, r.dialect.timeValue(time.Now().UTC()))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d_%s up: %w", m.Version, m.Name, err)
+		}
+		log.Printf("action=MigrateTo status=up version=%d name=%s", m.Version, m.Name)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= version {
+			continue
+		}
+		err := r.inTx(func(tx *sqlRepository) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			cmd := fmt.Sprintf("DELETE FROM %s WHERE version = ?", tableNameSchemaMigrations)
+			_, err := tx.exec(cmd, m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d_%s down: %w", m.Version, m.Name, err)
+		}
+		log.Printf("action=MigrateTo status=down version=%d name=%s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// candleTable DB にあるキャンドルのテーブル
+type candleTable struct {
+	name        string
+	productCode string
+	duration    time.Duration
+}
+
+// GetCandleTableName の形式の名前のテーブルを全て返すfunction
+// PostgreSQL ではテーブル名が小文字になるので、商品コードは大文字に戻す
+func (r *sqlRepository) candleTables() ([]candleTable, error) {
+	names, err := r.tableNames()
+	if err != nil {
+		return nil, err
+	}
+	var tables []candleTable
+	for _, name := range names {
+		i := strings.LastIndex(name, "_")
+		if i <= 0 {
+			continue
+		}
+		duration, err := time.ParseDuration(name[i+1:])
+		if err != nil || duration <= 0 {
+			continue
+		}
+		tables = append(tables, candleTable{name: name, productCode: strings.ToUpper(name[:i]), duration: duration})
+	}
+	return tables, nil
+}
+
+// マイグレーションを導入する前に models.init() で作成していたスキーマを作成するfunction
+func createBaselineSchema(r *sqlRepository) error {
+	d := r.dialect
+	cmd := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		time %s PRIMARY KEY NOT NULL,
+		product_code %s,
+		side %s,
+		price %s,
+		size %s)`, tableNameSignalEvents, d.timeType, d.textType, d.textType, d.floatType, d.floatType)
+	if _, err := r.exec(cmd); err != nil {
+		return err
+	}
+	cmd = fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		product_code %s NOT NULL,
+		start_time %s NOT NULL,
+		end_time %s NOT NULL,
+		before_id %s,
+		oldest %s,
+		done %s,
+		PRIMARY KEY (product_code, start_time, end_time))`, tableNameBackfillCheckpoints,
+		d.textType, d.timeType, d.timeType, d.intType, d.timeType, d.boolType)
+	if _, err := r.exec(cmd); err != nil {
+		return err
+	}
+	if len(d.candleTableUpgrades) == 0 {
+		return nil
+	}
+	tables, err := r.candleTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		for _, upgrade := range d.candleTableUpgrades {
+			if _, err := r.exec(fmt.Sprintf(upgrade, table.name)); err != nil && !d.isDuplicateColumn(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 1: キャンドルの行に商品コードを持たせ、売買のイベントを商品ごとに同じ時間でも記録できるようにする
+func addProductCodeUp(r *sqlRepository) error {
+	tables, err := r.candleTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		cmd := fmt.Sprintf("ALTER TABLE %s ADD COLUMN product_code %s NOT NULL DEFAULT ''", table.name, r.dialect.textType)
+		if _, err := r.exec(cmd); err != nil {
+			return err
+		}
+		if _, err := r.exec(fmt.Sprintf("UPDATE %s SET product_code = ?", table.name), table.productCode); err != nil {
+			return err
+		}
+	}
+	return r.rebuildSignalEvents("signal_events_v1", "PRIMARY KEY (product_code, time)")
+}
+
+func addProductCodeDown(r *sqlRepository) error {
+	tables, err := r.candleTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if _, err := r.exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN product_code", table.name)); err != nil {
+			return err
+		}
+	}
+	// 商品が違っても同じ時間の売買があると、ここで一意制約の違反になって戻せない
+	return r.rebuildSignalEvents("signal_events_v0", "PRIMARY KEY (time)")
+}
+
+// 主キーを変えた売買のイベントのテーブルを newTable に作成して移し替えるfunction
+// SQLite は作成済みのテーブルの主キーを変更できないので、どの DB でもテーブルごと作り直す
+// PostgreSQL の主キーのインデックス名が重ならないように、newTable はマイグレーションごとに変える
+func (r *sqlRepository) rebuildSignalEvents(newTable, primaryKey string) error {
+	d := r.dialect
+	cmd := fmt.Sprintf(`
+	CREATE TABLE %s (
+		time %s NOT NULL,
+		product_code %s NOT NULL,
+		side %s,
+		price %s,
+		size %s,
+		%s)`, newTable, d.timeType, d.textType, d.textType, d.floatType, d.floatType, primaryKey)
+	if _, err := r.exec(cmd); err != nil {
+		return err
+	}
+	cmd = fmt.Sprintf("INSERT INTO %s (%s) SELECT time, COALESCE(product_code, ''), side, price, size FROM %s",
+		newTable, signalEventColumns, tableNameSignalEvents)
+	if _, err := r.exec(cmd); err != nil {
+		return err
+	}
+	if _, err := r.exec(fmt.Sprintf("DROP TABLE %s", tableNameSignalEvents)); err != nil {
+		return err
+	}
+	_, err := r.exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", newTable, tableNameSignalEvents))
+	return err
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// マイグレーションを導入する前の models.init() で作成していたテーブル
+var legacySchema = []string{
+	`CREATE TABLE signal_events (
+		time DATETIME PRIMARY KEY NOT NULL,
+		product_code STRING,
+		side STRING,
+		price FLOAT,
+		size FLOAT)`,
+	`CREATE TABLE BTC_JPY_1m0s (
+		time DATETIME PRIMARY KEY NOT NULL,
+		open FLOAT,
+		close FLOAT,
+		high FLOAT,
+		low FLOAT,
+		volume FLOAT)`,
+}
+
+// マイグレーションを導入する前のスキーマとデータの SQLite を返すfunction
+func openLegacyRepository(t *testing.T, base time.Time) *sqlRepository {
+	t.Helper()
+	r := openTestRepository(t).(*sqlRepository)
+	for _, cmd := range legacySchema {
+		if _, err := r.exec(cmd); err != nil {
+			t.Fatalf("create legacy schema: %v", err)
+		}
+	}
+	if _, err := r.exec("INSERT INTO BTC_JPY_1m0s (time, open, close, high, low, volume) VALUES (?, 100, 101, 102, 99, 1)", r.dialect.timeValue(base)); err != nil {
+		t.Fatalf("insert legacy candle: %v", err)
+	}
+	if _, err := r.exec("INSERT INTO signal_events (time, product_code, side, price, size) VALUES (?, 'BTC_JPY', 'BUY', 100, 0.01)", r.dialect.timeValue(base)); err != nil {
+		t.Fatalf("insert legacy signal event: %v", err)
+	}
+	return r
+}
+
+func TestMigrateToLegacyDatabase(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := openLegacyRepository(t, base)
+	// 戻してから適用し直す場合は、既にある bid / ask のカラムを追加しようとしても失敗しないこと
+	for _, version := range []int{1, 0, 1} {
+		t.Run(fmt.Sprintf("to %d", version), func(t *testing.T) {
+			if err := r.MigrateTo(version); err != nil {
+				t.Fatalf("MigrateTo(%d): %v", version, err)
+			}
+			got, err := r.SchemaVersion()
+			if err != nil || got != version {
+				t.Errorf("SchemaVersion = %d, %v, want %d", got, err, version)
+			}
+
+			candle, err := r.GetCandle("BTC_JPY", time.Minute, base)
+			if err != nil {
+				t.Fatalf("GetCandle: %v", err)
+			}
+			want := NewCandle("BTC_JPY", time.Minute, base, 100, 101, 102, 99, 1)
+			if candle == nil || !sameCandle(*candle, *want) {
+				t.Errorf("GetCandle = %+v, want %+v", candle, want)
+			}
+			events, err := r.GetLatestSignalEvents("BTC_JPY", 10)
+			if err != nil || len(events) != 1 || events[0].Side != "BUY" {
+				t.Errorf("GetLatestSignalEvents = %+v, %v, want the legacy event", events, err)
+			}
+
+			var productCode string
+			err = r.queryRow("SELECT product_code FROM BTC_JPY_1m0s").Scan(&productCode)
+			if version == 0 && err == nil {
+				t.Error("product_code of the candle table exists after migrating down")
+			}
+			if version == 1 && (err != nil || productCode != "BTC_JPY") {
+				t.Errorf("product_code of the candle table = %q, %v, want BTC_JPY", productCode, err)
+			}
+		})
+	}
+}
+
+func TestSchemaVersionIsReadOnly(t *testing.T) {
+	r := openLegacyRepository(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	// migrate -status で見るだけの場合は、マイグレーションの記録のテーブルを作らない
+	version, err := r.SchemaVersion()
+	if err != nil || version != 0 {
+		t.Errorf("SchemaVersion = %d, %v, want 0", version, err)
+	}
+	names, err := r.tableNames()
+	if err != nil {
+		t.Fatalf("tableNames: %v", err)
+	}
+	for _, name := range names {
+		if name == tableNameSchemaMigrations {
+			t.Errorf("SchemaVersion created %s", tableNameSchemaMigrations)
+		}
+	}
+}
+
+func TestMigrateToErrors(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		setup       func(r *sqlRepository) error
+		version     int
+		wantIs      error
+		wantVersion int
+	}{
+		{
+			name:        "unknown version",
+			version:     LatestSchemaVersion() + 1,
+			wantVersion: LatestSchemaVersion(),
+		},
+		{
+			name:        "negative version",
+			version:     -1,
+			wantVersion: LatestSchemaVersion(),
+		},
+		{
+			name: "database is newer than the program",
+			setup: func(r *sqlRepository) error {
+				_, err := r.exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (99, 'future', ?)", r.dialect.timeValue(base))
+				return err
+			},
+			version:     LatestSchemaVersion(),
+			wantIs:      ErrSchemaTooNew,
+			wantVersion: 99,
+		},
+		{
+			// 同じ時間に商品の違う売買があると、down が失敗してスキーマは元のまま残る
+			name: "down with signal events of two products at the same time",
+			setup: func(r *sqlRepository) error {
+				for _, productCode := range []string{"BTC_JPY", "ETH_JPY"} {
+					if err := r.SaveSignalEvent(&SignalEvent{Time: base, ProductCode: productCode, Side: "BUY", Price: 1, Size: 1}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			version:     0,
+			wantVersion: LatestSchemaVersion(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := openTestRepository(t).(*sqlRepository)
+			if err := r.Migrate(); err != nil {
+				t.Fatalf("Migrate: %v", err)
+			}
+			if tt.setup != nil {
+				if err := tt.setup(r); err != nil {
+					t.Fatalf("setup: %v", err)
+				}
+			}
+			err := r.MigrateTo(tt.version)
+			if err == nil {
+				t.Errorf("MigrateTo(%d) returned nil, want an error", tt.version)
+			}
+			if tt.wantIs != nil && !errors.Is(err, tt.wantIs) {
+				t.Errorf("MigrateTo(%d) returned %v, want %v", tt.version, err, tt.wantIs)
+			}
+			if version, err := r.SchemaVersion(); err != nil || version != tt.wantVersion {
+				t.Errorf("SchemaVersion = %d, %v, want %d", version, err, tt.wantVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"io"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquet.go キャンドルと売買のイベントを Parquet で書き出し、読み込むファイル
+// 列名は CSV と同じにして、pandas の read_parquet で時間を datetime として読めるようにする
+
+// Parquet の読み書きを並列に行う数
+const parquetParallel = 4
+
+// candleParquetRow Parquet のキャンドルの1行
+type candleParquetRow struct {
+	Time   int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Open   float64 `parquet:"name=open, type=DOUBLE"`
+	High   float64 `parquet:"name=high, type=DOUBLE"`
+	Low    float64 `parquet:"name=low, type=DOUBLE"`
+	Close  float64 `parquet:"name=close, type=DOUBLE"`
+	Volume float64 `parquet:"name=volume, type=DOUBLE"`
+	Bid    float64 `parquet:"name=bid, type=DOUBLE"`
+	Ask    float64 `parquet:"name=ask, type=DOUBLE"`
+}
+
+// signalEventParquetRow Parquet の売買のイベントの1行
+type signalEventParquetRow struct {
+	Time        int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	ProductCode string  `parquet:"name=product_code, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Side        string  `parquet:"name=side, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Price       float64 `parquet:"name=price, type=DOUBLE"`
+	Size        float64 `parquet:"name=size, type=DOUBLE"`
+}
+
+// キャンドルを Snappy で圧縮した Parquet で w に書き出すfunction
+func (df *DataFrameCandle) WriteParquet(w io.Writer) error {
+	return df.Write(w, FormatParquet)
+}
+
+// 売買のイベントを Snappy で圧縮した Parquet で w に書き出すfunction
+func (s *SignalEvents) WriteParquet(w io.Writer) error {
+	return s.Write(w, FormatParquet)
+}
+
+// schema の行を Snappy で圧縮して w に書き出す ParquetWriter を返すfunction
+// 行は row group ごとにまとめて w に書き出される
+func newParquetWriter(w io.Writer, schema interface{}) (*writer.ParquetWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, schema, parquetParallel)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return pw, nil
+}
+
+// parquetCandleEncoder キャンドルを Parquet で書き出すStruct
+type parquetCandleEncoder struct {
+	pw *writer.ParquetWriter
+}
+
+func newParquetCandleEncoder(w io.Writer) (*parquetCandleEncoder, error) {
+	pw, err := newParquetWriter(w, new(candleParquetRow))
+	if err != nil {
+		return nil, err
+	}
+	return &parquetCandleEncoder{pw: pw}, nil
+}
+
+func (e *parquetCandleEncoder) encode(candles []Candle) error {
+	for _, c := range candles {
+		row := candleParquetRow{Time: c.Time.UnixMilli(), Open: c.Open, High: c.High, Low: c.Low,
+			Close: c.Close, Volume: c.Volume, Bid: c.Bid, Ask: c.Ask}
+		if err := e.pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *parquetCandleEncoder) close() error {
+	return e.pw.WriteStop()
+}
+
+// parquetSignalEventEncoder 売買のイベントを Parquet で書き出すStruct
+type parquetSignalEventEncoder struct {
+	pw *writer.ParquetWriter
+}
+
+func newParquetSignalEventEncoder(w io.Writer) (*parquetSignalEventEncoder, error) {
+	pw, err := newParquetWriter(w, new(signalEventParquetRow))
+	if err != nil {
+		return nil, err
+	}
+	return &parquetSignalEventEncoder{pw: pw}, nil
+}
+
+func (e *parquetSignalEventEncoder) encode(events []SignalEvent) error {
+	for _, event := range events {
+		row := signalEventParquetRow{Time: event.Time.UnixMilli(), ProductCode: event.ProductCode, Side: event.Side, Price: event.Price, Size: event.Size}
+		if err := e.pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *parquetSignalEventEncoder) close() error {
+	return e.pw.WriteStop()
+}
+
+// ReadCandlesParquet WriteParquet と同じ列名の Parquet からキャンドルを読み込むfunction
+// 時間はミリ秒の他に、pandas が書き出すマイクロ秒・ナノ秒の値も読み込める
+func ReadCandlesParquet(r io.Reader, productCode string, duration time.Duration) ([]Candle, error) {
+	pr, err := openParquet(r, new(candleParquetRow))
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+	rows := make([]candleParquetRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		return nil, err
+	}
+	candles := make([]Candle, 0, len(rows))
+	for _, row := range rows {
+		candles = append(candles, Candle{ProductCode: productCode, Duration: duration, Time: epochTime(row.Time),
+			Open: row.Open, High: row.High, Low: row.Low, Close: row.Close, Volume: row.Volume, Bid: row.Bid, Ask: row.Ask})
+	}
+	return candles, nil
+}
+
+// ReadSignalEventsParquet WriteParquet と同じ列名の Parquet から売買のイベントを読み込むfunction
+func ReadSignalEventsParquet(r io.Reader, productCode string) ([]SignalEvent, error) {
+	pr, err := openParquet(r, new(signalEventParquetRow))
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+	rows := make([]signalEventParquetRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		return nil, err
+	}
+	events := make([]SignalEvent, 0, len(rows))
+	for _, row := range rows {
+		event := SignalEvent{Time: epochTime(row.Time), ProductCode: row.ProductCode, Side: row.Side, Price: row.Price, Size: row.Size}
+		if event.ProductCode == "" {
+			event.ProductCode = productCode
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// schema の列を読み込む ParquetReader を返すfunction
+// Parquet はファイルの最後にあるメタデータから読むので、一度メモリに読み込む
+func openParquet(r io.Reader, schema interface{}) (*reader.ParquetReader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return reader.NewParquetReader(buffer.NewBufferFileFromBytes(data), schema, parquetParallel)
+}
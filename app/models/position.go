@@ -0,0 +1,72 @@
+package models
+
+import (
+	"log"
+	"time"
+)
+
+// position.go ショートを含めた保有中のポジションを扱うファイル
+
+// Position 保有しているポジションを格納するStruct
+type Position struct {
+	// "BUY": ロング / "SELL": ショート / "": ノーポジション
+	Side  string  `json:"side"`
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"`
+}
+
+// ロングを保有しているか判定するfunction
+func (s *SignalEvents) IsLong() bool {
+	return s.Position.Side == "BUY"
+}
+
+// ショートを保有しているか判定するfunction
+func (s *SignalEvents) IsShort() bool {
+	return s.Position.Side == "SELL"
+}
+
+// 最後の売買よりも後の時間か判定するfunction
+func (s *SignalEvents) isAfterLastSignal(time time.Time) bool {
+	lenSignals := len(s.Signals)
+	if lenSignals == 0 {
+		return true
+	}
+	return s.Signals[lenSignals-1].Time.Before(time)
+}
+
+// 売買をポジションに反映するfunction
+// ノーポジションであれば新しく建て、反対のポジションを保有していれば決済する
+func (s *SignalEvents) applyPosition(signalEvent SignalEvent) {
+	if s.Position.Side == "" {
+		s.Position = Position{Side: signalEvent.Side, Price: signalEvent.Price, Size: signalEvent.Size}
+		return
+	}
+	if s.Position.Side != signalEvent.Side {
+		if s.Position.Size != signalEvent.Size {
+			log.Printf("action=applyPosition status=size_mismatch position=%+v signal=%+v", s.Position, signalEvent)
+		}
+		s.Position = Position{}
+	}
+}
+
+// ショートを含めて、決済した分の損益を計算するfunction
+func (s *SignalEvents) marginProfit() float64 {
+	total := 0.0
+	var position Position
+	for _, signalEvent := range s.Signals {
+		if position.Side == "" {
+			position = Position{Side: signalEvent.Side, Price: signalEvent.Price, Size: signalEvent.Size}
+			continue
+		}
+		if position.Side == signalEvent.Side {
+			continue
+		}
+		if position.Side == "BUY" {
+			total += (signalEvent.Price - position.Price) * position.Size
+		} else {
+			total += (position.Price - signalEvent.Price) * position.Size
+		}
+		position = Position{}
+	}
+	return total
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// repository.go キャンドルと売買のイベントの保存先を DB の種類ごとに切り替えられるようにするファイル
+
+// ErrDuplicateSignalEvent 同じ商品・時間の売買のイベントが既に保存されている時のエラー
+var ErrDuplicateSignalEvent = errors.New("signal event already exists")
+
+// CandleRepository キャンドルを保存・取得する interface
+type CandleRepository interface {
+	// dateTime のキャンドルを取得する (無い場合は nil を返す)
+	GetCandle(productCode string, duration time.Duration, dateTime time.Time) (*Candle, error)
+	// キャンドルを作成、もしくは置き換える
+	SaveCandle(candle *Candle) error
+	// 新しい方から limit 件のキャンドルを古い順に返す
+	GetLatestCandles(productCode string, duration time.Duration, limit int) ([]Candle, error)
+	// start 以上 end 未満のキャンドルを古い順に返す (ゼロ値の方は制限しない)
+	GetCandlesInRange(productCode string, duration time.Duration, start, end time.Time) ([]Candle, error)
+	// start 以上 end 未満のキャンドルのうち、新しい方から limit 件を古い順に返す (ゼロ値の方は制限しない)
+	GetLatestCandlesInRange(productCode string, duration time.Duration, start, end time.Time, limit int) ([]Candle, error)
+	// start 以上 end 未満のキャンドルのうち、古い方から limit 件を古い順に返す (ゼロ値の方は制限しない)
+	GetOldestCandlesInRange(productCode string, duration time.Duration, start, end time.Time, limit int) ([]Candle, error)
+	// start 以上 end 未満のキャンドルを削除する (ゼロ値の方は制限しない)
+	DeleteCandlesInRange(productCode string, duration time.Duration, start, end time.Time) error
+	// 一番古いキャンドルを取得する (無い場合は nil を返す)
+	GetOldestCandle(productCode string, duration time.Duration) (*Candle, error)
+}
+
+// SignalEventRepository 売買のイベントを保存・取得する interface
+type SignalEventRepository interface {
+	// 売買のイベントを保存する (既にある場合は ErrDuplicateSignalEvent を返す)
+	SaveSignalEvent(event *SignalEvent) error
+	// 新しい方から limit 件の売買のイベントを古い順に返す
+	GetLatestSignalEvents(productCode string, limit int) ([]SignalEvent, error)
+	// dateTime 以降の売買のイベントを古い順に返す
+	GetSignalEventsAfter(productCode string, dateTime time.Time) ([]SignalEvent, error)
+}
+
+// BackfillCheckpointRepository バックフィルのチェックポイントを保存・取得する interface
+type BackfillCheckpointRepository interface {
+	// チェックポイントを取得する (無い場合は nil を返す)
+	GetBackfillCheckpoint(productCode string, start, end time.Time) (*BackfillCheckpoint, error)
+	// チェックポイントを作成、もしくは置き換える
+	SaveBackfillCheckpoint(checkpoint *BackfillCheckpoint) error
+	DeleteBackfillCheckpoint(checkpoint *BackfillCheckpoint) error
+}
+
+// Repository キャンドル・売買のイベント・チェックポイントの保存先をまとめた interface
+type Repository interface {
+	CandleRepository
+	SignalEventRepository
+	BackfillCheckpointRepository
+
+	// 適用されていないマイグレーションを全て適用する
+	Migrate() error
+	// version までマイグレーションを適用する (今より古い version の場合は down で戻す)
+	MigrateTo(version int) error
+	// 適用済みの一番新しいマイグレーションの番号を返す (まだ何も適用していない場合は0)
+	SchemaVersion() (int, error)
+	// 商品と期間ごとのキャンドルのテーブルが無ければ最新のスキーマで作成する
+	CreateCandleTables(productCodes []string, durations []time.Duration) error
+	// fn に渡した Repository への書き込みを1つのトランザクションで行う (fn がエラーを返したら取り消す)
+	RunInTx(fn func(repo Repository) error) error
+	// テーブルごとの行数と使用しているディスクの容量を返す
+	GetStorageStats() (*StorageStats, error)
+	// 削除した行の領域を空けて、クエリの統計情報を更新する (トランザクション中は実行できない)
+	Vacuum() error
+	Close() error
+}
+
+// TableStats 1つのテーブルの行数と使用している容量
+type TableStats struct {
+	Name string `json:"name"`
+	// キャンドルのテーブルの場合だけ入る
+	ProductCode string `json:"product_code,omitempty"`
+	Duration    string `json:"duration,omitempty"`
+	Rows        int64  `json:"rows"`
+	// インデックスを含むバイト数 (DB から取得できない場合は -1)
+	Bytes int64 `json:"bytes"`
+}
+
+// StorageStats DB 全体とテーブルごとの容量
+type StorageStats struct {
+	Driver        string       `json:"driver"`
+	DatabaseBytes int64        `json:"database_bytes"`
+	Tables        []TableStats `json:"tables"`
+}
+
+// Repo config.ini の [db] で指定した保存先
+var Repo Repository
+
+// driver の種類の DB を dsn で開いて Repository を返すfunction
+// sqlite3 の場合は dsn にファイル名、postgres と mysql の場合は接続文字列を指定する
+// スキーマには触らないので、使う前に Migrate と CreateCandleTables を呼ぶ
+func OpenRepository(driver, dsn string) (Repository, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported db driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRepository{db: db, conn: db, dialect: d}, nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// resample.go 1分足から上位の期間のキャンドルをまとめて作るファイル
+
+// Ticker や約定から直接書き込む期間の上限。これより長い期間はこの期間のキャンドルからまとめて作る
+const BaseDuration = time.Minute
+
+// 1分足からまとめて作る期間か判定するfunction
+func IsResampledDuration(duration time.Duration) bool {
+	return duration > BaseDuration
+}
+
+// 1分足の start から end までのキャンドルを古い順に取得するfunction
+func getBaseCandles(productCode string, start, end time.Time) ([]Candle, error) {
+	return Repo.GetCandlesInRange(productCode, BaseDuration, start, end)
+}
+
+// 古い順に並んだキャンドルを duration ごとにまとめるfunction
+// 始値は最初、終値と気配は最後のキャンドルの値を使い、高値・安値は最大・最小、出来高は合計にする
+func resampleCandles(productCode string, duration time.Duration, candles []Candle) []*Candle {
+	var resampled []*Candle
+	var current *Candle
+	for _, candle := range candles {
+		dateTime := candle.Time.Truncate(duration)
+		if current == nil || !current.Time.Equal(dateTime) {
+			current = NewCandle(productCode, duration, dateTime, candle.Open, candle.Close, candle.High, candle.Low, 0)
+			resampled = append(resampled, current)
+		}
+		current.merge(&candle)
+	}
+	return resampled
+}
+
+// 上位の期間のキャンドルに、その後のキャンドルをまとめるfunction
+func (c *Candle) merge(candle *Candle) {
+	if c.High < candle.High {
+		c.High = candle.High
+	}
+	if c.Low > candle.Low {
+		c.Low = candle.Low
+	}
+	c.Close = candle.Close
+	c.Volume += candle.Volume
+	c.setQuote(candle.Bid, candle.Ask)
+}
+
+// ResampleCandle dateTime を含む duration のキャンドルを1分足から作り直して、新しく作成したかどうかを返すfunction
+func ResampleCandle(productCode string, duration time.Duration, dateTime time.Time) (bool, error) {
+	start := dateTime.Truncate(duration)
+	candles, err := getBaseCandles(productCode, start, start.Add(duration))
+	if err != nil || len(candles) == 0 {
+		return false, err
+	}
+	isCreated := GetCandle(productCode, duration, start) == nil
+	for _, candle := range resampleCandles(productCode, duration, candles) {
+		if err := Repo.SaveCandle(candle); err != nil {
+			return false, err
+		}
+	}
+	return isCreated, nil
+}
+
+// RebuildCandles start から end までの duration のキャンドルを1分足から全て作り直すfunction
+// start と end がゼロ値の場合は1分足がある全期間を作り直す
+func RebuildCandles(productCode string, duration time.Duration, start, end time.Time) error {
+	if !IsResampledDuration(duration) {
+		return fmt.Errorf("duration %s is not resampled from %s", duration, BaseDuration)
+	}
+	// retention で1分足を削除した期間のキャンドルを消さないように、一番古い1分足の期間からにする
+	// その期間のキャンドルが既にある場合は、削除した1分足からも作っているので次の期間からにする
+	oldest, err := Repo.GetOldestCandle(productCode, BaseDuration)
+	if err != nil || oldest == nil {
+		return err
+	}
+	first := oldest.Time.Truncate(duration)
+	if first.Before(oldest.Time) && GetCandle(productCode, duration, first) != nil {
+		first = first.Add(duration)
+	}
+	start = start.Truncate(duration)
+	if start.Before(first) {
+		start = first
+	}
+	if end.IsZero() {
+		end = time.Now().Add(duration)
+	}
+	candles, err := getBaseCandles(productCode, start, end.Truncate(duration).Add(duration))
+	if err != nil {
+		return err
+	}
+
+	// 1分足が無くなった期間のキャンドルが残らないように、範囲内を消してから書き込む
+	resampled := resampleCandles(productCode, duration, candles)
+	err = Repo.RunInTx(func(repo Repository) error {
+		if err := repo.DeleteCandlesInRange(productCode, duration, start, end.Truncate(duration).Add(duration)); err != nil {
+			return err
+		}
+		for _, candle := range resampled {
+			if err := repo.SaveCandle(candle); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("action=RebuildCandles product_code=%s duration=%s start=%s end=%s candles=%d", productCode, duration, start, end, len(resampled))
+	return nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// 気配を記録したキャンドルを返すfunction
+func withQuote(candle Candle, bid, ask float64) Candle {
+	candle.setQuote(bid, ask)
+	return candle
+}
+
+func TestResampleCandles(t *testing.T) {
+	minutes := []Candle{
+		withQuote(testCandle(time.Minute, 0, 1, 2, 3, 0.5, 1), 1.9, 2.1),
+		withQuote(testCandle(time.Minute, time.Minute, 2, 4, 5, 1, 2), 3.9, 4.1),
+		testCandle(time.Minute, 5*time.Minute, 4, 3, 4, 2, 1),
+	}
+	tests := []struct {
+		name     string
+		duration time.Duration
+		candles  []Candle
+		want     []Candle
+	}{
+		{name: "no candles", duration: 5 * time.Minute},
+		{
+			name:     "groups candles by duration",
+			duration: 5 * time.Minute,
+			candles:  minutes,
+			want: []Candle{
+				withQuote(testCandle(5*time.Minute, 0, 1, 4, 5, 0.5, 3), 3.9, 4.1),
+				testCandle(5*time.Minute, 5*time.Minute, 4, 3, 4, 2, 1),
+			},
+		},
+		{
+			name:     "keeps the last quote",
+			duration: time.Hour,
+			candles:  minutes,
+			want:     []Candle{withQuote(testCandle(time.Hour, 0, 1, 3, 5, 0.5, 4), 3.9, 4.1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Candle
+			for _, candle := range resampleCandles(testProductCode, tt.duration, tt.candles) {
+				got = append(got, *candle)
+			}
+			expectCandles(t, "resampled", got, tt.want)
+		})
+	}
+}
+
+func TestRebuildCandles(t *testing.T) {
+	repo := useTestRepository(t, testProductCode, time.Minute, time.Hour)
+	for _, candle := range []Candle{
+		testCandle(time.Minute, 0, 100, 101, 102, 99, 1),
+		testCandle(time.Minute, time.Minute, 101, 103, 104, 100, 2),
+		testCandle(time.Minute, 90*time.Minute, 110, 111, 112, 109, 3),
+		// 1分足と食い違っているキャンドルと、1分足が無い期間のキャンドル
+		testCandle(time.Hour, 0, 1, 1, 1, 1, 1),
+		testCandle(time.Hour, 2*time.Hour, 1, 1, 1, 1, 1),
+	} {
+		candle := candle
+		if err := repo.SaveCandle(&candle); err != nil {
+			t.Fatalf("SaveCandle: %v", err)
+		}
+	}
+
+	if err := RebuildCandles(testProductCode, time.Minute, time.Time{}, time.Time{}); err == nil {
+		t.Error("RebuildCandles of the base duration returned nil, want an error")
+	}
+	if err := RebuildCandles(testProductCode, time.Hour, time.Time{}, time.Time{}); err != nil {
+		t.Fatalf("RebuildCandles: %v", err)
+	}
+	got, err := repo.GetCandlesInRange(testProductCode, time.Hour, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("GetCandlesInRange: %v", err)
+	}
+	expectCandles(t, "1h candles", got, []Candle{
+		testCandle(time.Hour, 0, 100, 103, 104, 99, 3),
+		testCandle(time.Hour, time.Hour, 110, 111, 112, 109, 3),
+	})
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// retention.go 期間ごとに決めた長さより古いキャンドルを、上位の期間にまとめてから削除するファイル
+// 1秒足は1日に商品ごとに86,400行増えるので、古い分は1分足などに残して消す
+
+// 一度のトランザクションでまとめて削除する長さ (1日分の1秒足を読み込む程度)
+const compactChunk = 24 * time.Hour
+
+// CandleCompactor 商品・期間ごとに retention より古いキャンドルを定期的に削除するStruct
+type CandleCompactor struct {
+	// retention を適用する間隔 (0 で無効)
+	Interval time.Duration
+	// VACUUM / ANALYZE する間隔 (0 で無効)
+	VacuumInterval time.Duration
+
+	productCodes []string
+	durations    map[string]time.Duration
+	retentions   map[string]time.Duration
+}
+
+// durations のうち retentions で長さを決めた期間のキャンドルを削除する CandleCompactor を返すfunction
+func NewCandleCompactor(productCodes []string, durations, retentions map[string]time.Duration) *CandleCompactor {
+	return &CandleCompactor{
+		productCodes: productCodes,
+		durations:    durations,
+		retentions:   retentions,
+	}
+}
+
+// 削除する前に duration のキャンドルをまとめる期間を返すfunction (無い場合は0)
+// duration の倍数で、duration より長く残す期間のうち一番短いものを使う
+func (c *CandleCompactor) coarserDuration(duration time.Duration) time.Duration {
+	keep := c.retentionOf(duration)
+	var coarser time.Duration
+	for _, d := range c.durations {
+		if d <= duration || d%duration != 0 {
+			continue
+		}
+		if k := c.retentionOf(d); k != 0 && k <= keep {
+			continue
+		}
+		if coarser == 0 || d < coarser {
+			coarser = d
+		}
+	}
+	return coarser
+}
+
+// duration のキャンドルを残す長さを返すfunction (ずっと残す場合は0)
+func (c *CandleCompactor) retentionOf(duration time.Duration) time.Duration {
+	for name, d := range c.durations {
+		if d == duration {
+			return c.retentions[name]
+		}
+	}
+	return 0
+}
+
+// Interval ごとに retention を適用し、VacuumInterval ごとに VACUUM / ANALYZE するfunction
+// 起動した時にも一度 retention を適用する。ctx がキャンセルされたら終了する
+func (c *CandleCompactor) Run(ctx context.Context) {
+	var compact, vacuum <-chan time.Time
+	if c.Interval > 0 && len(c.retentions) > 0 {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		compact = ticker.C
+		c.Compact(time.Now().UTC())
+	}
+	if c.VacuumInterval > 0 {
+		ticker := time.NewTicker(c.VacuumInterval)
+		defer ticker.Stop()
+		vacuum = ticker.C
+	}
+	if compact == nil && vacuum == nil {
+		return
+	}
+	for {
+		select {
+		case <-compact:
+			c.Compact(time.Now().UTC())
+		case <-vacuum:
+			start := time.Now()
+			if err := Repo.Vacuum(); err != nil {
+				log.Printf("action=CandleCompactor.Run err=%s", err.Error())
+				continue
+			}
+			log.Printf("action=CandleCompactor.Run vacuum=done elapsed=%s", time.Since(start))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 全ての商品と期間に now 時点の retention を適用するfunction
+// キャンドルの時間は UTC で保存しているので、cutoff も UTC で計算する
+// 短い期間からまとめた分も上位の期間の retention で削除されるように、短い期間から順に適用する
+func (c *CandleCompactor) Compact(now time.Time) {
+	var durations []time.Duration
+	for name := range c.retentions {
+		durations = append(durations, c.durations[name])
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	for _, productCode := range c.productCodes {
+		for _, duration := range durations {
+			if err := CompactCandles(productCode, duration, c.coarserDuration(duration), now.UTC().Add(-c.retentionOf(duration))); err != nil {
+				log.Printf("action=CandleCompactor.Compact product_code=%s duration=%s err=%s", productCode, duration, err.Error())
+			}
+		}
+	}
+}
+
+// CompactCandles cutoff より前の duration のキャンドルを削除するfunction
+// coarser が0でなければ、削除する前に coarser のテーブルに無いキャンドルをまとめて作成する
+// まとめ途中の coarser の期間が残らないように、cutoff は coarser の区切りまで戻す
+func CompactCandles(productCode string, duration, coarser time.Duration, cutoff time.Time) error {
+	if coarser != 0 {
+		cutoff = cutoff.Truncate(coarser)
+	}
+	oldest, err := Repo.GetOldestCandle(productCode, duration)
+	if err != nil || oldest == nil || !oldest.Time.Before(cutoff) {
+		return err
+	}
+	if coarser == 0 {
+		if err := Repo.DeleteCandlesInRange(productCode, duration, time.Time{}, cutoff); err != nil {
+			return err
+		}
+		log.Printf("action=CompactCandles product_code=%s duration=%s cutoff=%s", productCode, duration, cutoff)
+		return nil
+	}
+
+	// coarser の区切りを跨がないように、coarser の倍数ずつ処理する
+	chunk := (compactChunk + coarser - 1) / coarser * coarser
+	deleted, created := 0, 0
+	for start := oldest.Time.Truncate(coarser); start.Before(cutoff); start = start.Add(chunk) {
+		end := start.Add(chunk)
+		if end.After(cutoff) {
+			end = cutoff
+		}
+		n, m, err := compactChunkCandles(productCode, duration, coarser, start, end)
+		if err != nil {
+			return err
+		}
+		deleted += n
+		created += m
+	}
+	log.Printf("action=CompactCandles product_code=%s duration=%s coarser=%s cutoff=%s deleted=%d created=%d",
+		productCode, duration, coarser, cutoff, deleted, created)
+	return nil
+}
+
+// start から end までの duration のキャンドルを coarser にまとめてから削除し、削除した数と作成した数を返すfunction
+// coarser のテーブルに既にあるキャンドルは Tick や1分足から作ったものなので、そのまま残す
+func compactChunkCandles(productCode string, duration, coarser time.Duration, start, end time.Time) (int, int, error) {
+	candles, err := Repo.GetCandlesInRange(productCode, duration, start, end)
+	if err != nil || len(candles) == 0 {
+		return 0, 0, err
+	}
+	existing, err := Repo.GetCandlesInRange(productCode, coarser, start, end)
+	if err != nil {
+		return 0, 0, err
+	}
+	exists := map[int64]bool{}
+	for _, candle := range existing {
+		exists[candle.Time.Unix()] = true
+	}
+	var missing []*Candle
+	for _, candle := range resampleCandles(productCode, coarser, candles) {
+		if !exists[candle.Time.Unix()] {
+			missing = append(missing, candle)
+		}
+	}
+
+	err = Repo.RunInTx(func(repo Repository) error {
+		for _, candle := range missing {
+			if err := repo.SaveCandle(candle); err != nil {
+				return err
+			}
+		}
+		return repo.DeleteCandlesInRange(productCode, duration, start, end)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(candles), len(missing), nil
+}
@@ -0,0 +1,328 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlrepository.go database/sql で SQLite・PostgreSQL・MySQL に保存する Repository のファイル
+
+// sqlConn *sql.DB と *sql.Tx のどちらでも読み書きできるようにする interface
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlRepository dialect で SQL の違いを吸収して Repository を実装するStruct
+type sqlRepository struct {
+	db *sql.DB
+	// トランザクション中は *sql.Tx、それ以外は db
+	conn    sqlConn
+	dialect *dialect
+}
+
+func (r *sqlRepository) exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.conn.Exec(r.dialect.rebind(query), args...)
+}
+
+func (r *sqlRepository) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.conn.Query(r.dialect.rebind(query), args...)
+}
+
+func (r *sqlRepository) queryRow(query string, args ...interface{}) *sql.Row {
+	return r.conn.QueryRow(r.dialect.rebind(query), args...)
+}
+
+// start 以上 end 未満の条件と引数を返すfunction (ゼロ値の方は条件に入れない)
+func (r *sqlRepository) timeRange(start, end time.Time) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if !start.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, r.dialect.timeValue(start))
+	}
+	if !end.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, r.dialect.timeValue(end))
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (r *sqlRepository) CreateCandleTables(productCodes []string, durations []time.Duration) error {
+	for _, productCode := range productCodes {
+		for _, duration := range durations {
+			if _, err := r.exec(r.dialect.createCandleTable(GetCandleTableName(productCode, duration))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *sqlRepository) RunInTx(fn func(repo Repository) error) error {
+	return r.inTx(func(tx *sqlRepository) error {
+		return fn(tx)
+	})
+}
+
+// fn に渡した sqlRepository への読み書きを1つのトランザクションで行うfunction
+// 既にトランザクション中の場合はそのまま使う
+func (r *sqlRepository) inTx(fn func(tx *sqlRepository) error) error {
+	if _, ok := r.conn.(*sql.Tx); ok {
+		return fn(r)
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(&sqlRepository{db: r.db, conn: tx, dialect: r.dialect}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 現在のスキーマのテーブル名を全て返すfunction
+func (r *sqlRepository) tableNames() ([]string, error) {
+	rows, err := r.query(r.dialect.listTables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (r *sqlRepository) GetStorageStats() (*StorageStats, error) {
+	stats := &StorageStats{Driver: r.dialect.name}
+	if err := r.queryRow(r.dialect.databaseBytes).Scan(&stats.DatabaseBytes); err != nil {
+		return nil, err
+	}
+	names, err := r.tableNames()
+	if err != nil {
+		return nil, err
+	}
+	candleTables, err := r.candleTables()
+	if err != nil {
+		return nil, err
+	}
+	candleTableByName := map[string]candleTable{}
+	for _, table := range candleTables {
+		candleTableByName[table.name] = table
+	}
+
+	for _, name := range names {
+		table := TableStats{Name: name, Bytes: -1}
+		if candleTable, ok := candleTableByName[name]; ok {
+			table.ProductCode = candleTable.productCode
+			table.Duration = candleTable.duration.String()
+		}
+		if err := r.queryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", name)).Scan(&table.Rows); err != nil {
+			return nil, err
+		}
+		// 容量を取得できない DB でも行数は返す
+		var bytes sql.NullInt64
+		if err := r.queryRow(r.dialect.tableBytes, name).Scan(&bytes); err == nil && bytes.Valid {
+			table.Bytes = bytes.Int64
+		}
+		stats.Tables = append(stats.Tables, table)
+	}
+	return stats, nil
+}
+
+func (r *sqlRepository) Vacuum() error {
+	if _, ok := r.conn.(*sql.Tx); ok {
+		return fmt.Errorf("vacuum cannot run in a transaction")
+	}
+	names, err := r.tableNames()
+	if err != nil {
+		return err
+	}
+	for _, cmd := range r.dialect.vacuum(names) {
+		if _, err := r.exec(cmd); err != nil {
+			return fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+func (r *sqlRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *sqlRepository) GetCandle(productCode string, duration time.Duration, dateTime time.Time) (*Candle, error) {
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE time = ?", candleColumns, GetCandleTableName(productCode, duration))
+	candle := &Candle{ProductCode: productCode, Duration: duration}
+	err := candle.scan(r.queryRow(cmd, r.dialect.timeValue(dateTime)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return candle, nil
+}
+
+func (r *sqlRepository) SaveCandle(candle *Candle) error {
+	columns := append([]string{"product_code"}, strings.Split(candleColumns, ", ")...)
+	cmd := r.dialect.upsert(candle.TableName(), columns, []string{"time"})
+	_, err := r.exec(cmd, candle.ProductCode, r.dialect.timeValue(candle.Time), candle.Open, candle.Close, candle.High, candle.Low, candle.Volume, candle.Bid, candle.Ask)
+	return err
+}
+
+// キャンドルを読み込むfunction
+func (r *sqlRepository) queryCandles(productCode string, duration time.Duration, query string, args ...interface{}) ([]Candle, error) {
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candles []Candle
+	for rows.Next() {
+		candle := Candle{ProductCode: productCode, Duration: duration}
+		if err := candle.scan(rows); err != nil {
+			return nil, err
+		}
+		candles = append(candles, candle)
+	}
+	return candles, rows.Err()
+}
+
+func (r *sqlRepository) GetOldestCandle(productCode string, duration time.Duration) (*Candle, error) {
+	cmd := fmt.Sprintf("SELECT %s FROM %s ORDER BY time ASC LIMIT 1", candleColumns, GetCandleTableName(productCode, duration))
+	candle := &Candle{ProductCode: productCode, Duration: duration}
+	err := candle.scan(r.queryRow(cmd))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return candle, nil
+}
+
+func (r *sqlRepository) GetLatestCandles(productCode string, duration time.Duration, limit int) ([]Candle, error) {
+	return r.GetLatestCandlesInRange(productCode, duration, time.Time{}, time.Time{}, limit)
+}
+
+func (r *sqlRepository) GetLatestCandlesInRange(productCode string, duration time.Duration, start, end time.Time, limit int) ([]Candle, error) {
+	where, args := r.timeRange(start, end)
+	cmd := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY time DESC LIMIT ?", candleColumns, GetCandleTableName(productCode, duration), where)
+	candles, err := r.queryCandles(productCode, duration, cmd, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	// 新しい順に取得したので古い順に並べ直す
+	for i, j := 0, len(candles)-1; i < j; i, j = i+1, j-1 {
+		candles[i], candles[j] = candles[j], candles[i]
+	}
+	return candles, nil
+}
+
+func (r *sqlRepository) GetOldestCandlesInRange(productCode string, duration time.Duration, start, end time.Time, limit int) ([]Candle, error) {
+	where, args := r.timeRange(start, end)
+	cmd := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY time ASC LIMIT ?", candleColumns, GetCandleTableName(productCode, duration), where)
+	return r.queryCandles(productCode, duration, cmd, append(args, limit)...)
+}
+
+func (r *sqlRepository) GetCandlesInRange(productCode string, duration time.Duration, start, end time.Time) ([]Candle, error) {
+	where, args := r.timeRange(start, end)
+	cmd := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY time ASC", candleColumns, GetCandleTableName(productCode, duration), where)
+	return r.queryCandles(productCode, duration, cmd, args...)
+}
+
+func (r *sqlRepository) DeleteCandlesInRange(productCode string, duration time.Duration, start, end time.Time) error {
+	where, args := r.timeRange(start, end)
+	cmd := fmt.Sprintf("DELETE FROM %s%s", GetCandleTableName(productCode, duration), where)
+	_, err := r.exec(cmd, args...)
+	return err
+}
+
+func (r *sqlRepository) SaveSignalEvent(event *SignalEvent) error {
+	cmd := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?)", tableNameSignalEvents, signalEventColumns)
+	_, err := r.exec(cmd, r.dialect.timeValue(event.Time), event.ProductCode, event.Side, event.Price, event.Size)
+	if err != nil && r.dialect.isDuplicate(err) {
+		return fmt.Errorf("%w: %s", ErrDuplicateSignalEvent, err.Error())
+	}
+	return err
+}
+
+// 売買のイベントを読み込むfunction
+func (r *sqlRepository) querySignalEvents(query string, args ...interface{}) ([]SignalEvent, error) {
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var signalEvents []SignalEvent
+	for rows.Next() {
+		var signalEvent SignalEvent
+		if err := signalEvent.scan(rows); err != nil {
+			return nil, err
+		}
+		signalEvents = append(signalEvents, signalEvent)
+	}
+	return signalEvents, rows.Err()
+}
+
+func (r *sqlRepository) GetLatestSignalEvents(productCode string, limit int) ([]SignalEvent, error) {
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE product_code = ? ORDER BY time DESC LIMIT ?", signalEventColumns, tableNameSignalEvents)
+	signalEvents, err := r.querySignalEvents(cmd, productCode, limit)
+	if err != nil {
+		return nil, err
+	}
+	// 新しい順に取得したので古い順に並べ直す
+	for i, j := 0, len(signalEvents)-1; i < j; i, j = i+1, j-1 {
+		signalEvents[i], signalEvents[j] = signalEvents[j], signalEvents[i]
+	}
+	return signalEvents, nil
+}
+
+func (r *sqlRepository) GetSignalEventsAfter(productCode string, dateTime time.Time) ([]SignalEvent, error) {
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE product_code = ? AND time >= ? ORDER BY time ASC", signalEventColumns, tableNameSignalEvents)
+	return r.querySignalEvents(cmd, productCode, r.dialect.timeValue(dateTime))
+}
+
+func (r *sqlRepository) GetBackfillCheckpoint(productCode string, start, end time.Time) (*BackfillCheckpoint, error) {
+	cmd := fmt.Sprintf("SELECT before_id, oldest, done FROM %s WHERE product_code = ? AND start_time = ? AND end_time = ?", tableNameBackfillCheckpoints)
+	checkpoint := &BackfillCheckpoint{ProductCode: productCode, Start: start, End: end}
+	row := r.queryRow(cmd, productCode, r.dialect.timeValue(start), r.dialect.timeValue(end))
+	err := row.Scan(&checkpoint.BeforeID, &checkpoint.Oldest, &checkpoint.Done)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.Oldest = checkpoint.Oldest.UTC()
+	return checkpoint, nil
+}
+
+func (r *sqlRepository) SaveBackfillCheckpoint(c *BackfillCheckpoint) error {
+	columns := []string{"product_code", "start_time", "end_time", "before_id", "oldest", "done"}
+	cmd := r.dialect.upsert(tableNameBackfillCheckpoints, columns, columns[:3])
+	_, err := r.exec(cmd, c.ProductCode, r.dialect.timeValue(c.Start), r.dialect.timeValue(c.End), c.BeforeID, r.dialect.timeValue(c.Oldest), c.Done)
+	return err
+}
+
+func (r *sqlRepository) DeleteBackfillCheckpoint(c *BackfillCheckpoint) error {
+	cmd := fmt.Sprintf("DELETE FROM %s WHERE product_code = ? AND start_time = ? AND end_time = ?", tableNameBackfillCheckpoints)
+	_, err := r.exec(cmd, c.ProductCode, r.dialect.timeValue(c.Start), r.dialect.timeValue(c.End))
+	return err
+}
@@ -0,0 +1,247 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// account.go 約定履歴や残高の履歴など、照合や会計に使う API をまとめたファイル
+
+// ページングで1回に取得する件数 (bitflyer の上限)
+const maxPageCount = 500
+
+// MyExecution 自分の約定履歴の1件分を格納するStruct
+type MyExecution struct {
+	ID                     int     `json:"id"`
+	ChildOrderID           string  `json:"child_order_id"`
+	Side                   string  `json:"side"`
+	Price                  float64 `json:"price"`
+	Size                   float64 `json:"size"`
+	Commission             float64 `json:"commission"`
+	ExecDate               string  `json:"exec_date"`
+	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
+}
+
+// 約定した時間を取得するfunction
+func (e *MyExecution) DateTime() time.Time {
+	return parseTime(e.ExecDate)
+}
+
+// MyExecutionsParams 自分の約定履歴を取得する時の絞り込み条件を格納するStruct
+type MyExecutionsParams struct {
+	ProductCode            string
+	ChildOrderID           string
+	ChildOrderAcceptanceID string
+	Count                  int
+	Before                 int
+	After                  int
+}
+
+// 絞り込み条件をクエリに変換するfunction (空の条件は送らない)
+func (p *MyExecutionsParams) query() map[string]string {
+	query := map[string]string{"product_code": p.ProductCode}
+	if p.ChildOrderID != "" {
+		query["child_order_id"] = p.ChildOrderID
+	}
+	if p.ChildOrderAcceptanceID != "" {
+		query["child_order_acceptance_id"] = p.ChildOrderAcceptanceID
+	}
+	if p.Count > 0 {
+		query["count"] = strconv.Itoa(p.Count)
+	}
+	if p.Before > 0 {
+		query["before"] = strconv.Itoa(p.Before)
+	}
+	if p.After > 0 {
+		query["after"] = strconv.Itoa(p.After)
+	}
+	return query
+}
+
+// BalanceHistory 残高の変動履歴の1件分を格納するStruct
+type BalanceHistory struct {
+	ID           int     `json:"id"`
+	TradeDate    string  `json:"trade_date"`
+	EventDate    string  `json:"event_date"`
+	ProductCode  string  `json:"product_code"`
+	CurrencyCode string  `json:"currency_code"`
+	TradeType    string  `json:"trade_type"`
+	Price        float64 `json:"price"`
+	Amount       float64 `json:"amount"`
+	Quantity     float64 `json:"quantity"`
+	Commission   float64 `json:"commission"`
+	Balance      float64 `json:"balance"`
+	OrderID      string  `json:"order_id"`
+}
+
+// 変動した時間を取得するfunction
+func (h *BalanceHistory) DateTime() time.Time {
+	return parseTime(h.EventDate)
+}
+
+// BalanceHistoryParams 残高の変動履歴を取得する時の絞り込み条件を格納するStruct
+type BalanceHistoryParams struct {
+	CurrencyCode string
+	Count        int
+	Before       int
+	After        int
+}
+
+// 絞り込み条件をクエリに変換するfunction (空の条件は送らない)
+func (p *BalanceHistoryParams) query() map[string]string {
+	query := map[string]string{"currency_code": p.CurrencyCode}
+	if p.Count > 0 {
+		query["count"] = strconv.Itoa(p.Count)
+	}
+	if p.Before > 0 {
+		query["before"] = strconv.Itoa(p.Before)
+	}
+	if p.After > 0 {
+		query["after"] = strconv.Itoa(p.After)
+	}
+	return query
+}
+
+// TradingCommission 取引手数料の割合を格納するStruct
+type TradingCommission struct {
+	CommissionRate float64 `json:"commission_rate"`
+}
+
+// 自分の約定履歴を新しい順に取得するfunction
+func (api *APIClient) GetMyExecutionsContext(ctx context.Context, params *MyExecutionsParams) ([]MyExecution, error) {
+	url := "me/getexecutions"
+	resp, err := api.doRequest(ctx, "GET", url, params.query(), nil)
+	if err != nil {
+		log.Printf("action=GetMyExecutions err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var executions []MyExecution
+	err = json.Unmarshal(resp, &executions)
+	if err != nil {
+		log.Printf("action=GetMyExecutions err=%s", err.Error())
+		return nil, err
+	}
+	return executions, nil
+}
+
+// GetMyExecutions は GetMyExecutionsContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetMyExecutions(params *MyExecutionsParams) ([]MyExecution, error) {
+	return api.GetMyExecutionsContext(context.Background(), params)
+}
+
+// 自分の約定履歴を無くなるまで遡って、新しい順に1件ずつ fn に渡すfunction
+// fn が false を返したらそこで止める。params.After を指定した場合はそのIDより新しい分だけを取得する
+func (api *APIClient) EachMyExecutionsContext(ctx context.Context, params *MyExecutionsParams, fn func(MyExecution) bool) error {
+	page := *params
+	if page.Count <= 0 {
+		page.Count = maxPageCount
+	}
+	for {
+		executions, err := api.GetMyExecutionsContext(ctx, &page)
+		if err != nil {
+			return err
+		}
+		for _, execution := range executions {
+			if !fn(execution) {
+				return nil
+			}
+		}
+		if len(executions) < page.Count {
+			return nil
+		}
+		page.Before = executions[len(executions)-1].ID
+	}
+}
+
+// 条件に合う自分の約定履歴を全て取得するfunction
+func (api *APIClient) ListAllMyExecutionsContext(ctx context.Context, params *MyExecutionsParams) ([]MyExecution, error) {
+	var executions []MyExecution
+	err := api.EachMyExecutionsContext(ctx, params, func(execution MyExecution) bool {
+		executions = append(executions, execution)
+		return true
+	})
+	return executions, err
+}
+
+// 残高の変動履歴を新しい順に取得するfunction
+func (api *APIClient) GetBalanceHistoryContext(ctx context.Context, params *BalanceHistoryParams) ([]BalanceHistory, error) {
+	url := "me/getbalancehistory"
+	resp, err := api.doRequest(ctx, "GET", url, params.query(), nil)
+	if err != nil {
+		log.Printf("action=GetBalanceHistory err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var histories []BalanceHistory
+	err = json.Unmarshal(resp, &histories)
+	if err != nil {
+		log.Printf("action=GetBalanceHistory err=%s", err.Error())
+		return nil, err
+	}
+	return histories, nil
+}
+
+// GetBalanceHistory は GetBalanceHistoryContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetBalanceHistory(params *BalanceHistoryParams) ([]BalanceHistory, error) {
+	return api.GetBalanceHistoryContext(context.Background(), params)
+}
+
+// 残高の変動履歴を無くなるまで遡って、新しい順に1件ずつ fn に渡すfunction (fn が false を返したらそこで止める)
+func (api *APIClient) EachBalanceHistoryContext(ctx context.Context, params *BalanceHistoryParams, fn func(BalanceHistory) bool) error {
+	page := *params
+	if page.Count <= 0 {
+		page.Count = maxPageCount
+	}
+	for {
+		histories, err := api.GetBalanceHistoryContext(ctx, &page)
+		if err != nil {
+			return err
+		}
+		for _, history := range histories {
+			if !fn(history) {
+				return nil
+			}
+		}
+		if len(histories) < page.Count {
+			return nil
+		}
+		page.Before = histories[len(histories)-1].ID
+	}
+}
+
+// 条件に合う残高の変動履歴を全て取得するfunction
+func (api *APIClient) ListAllBalanceHistoryContext(ctx context.Context, params *BalanceHistoryParams) ([]BalanceHistory, error) {
+	var histories []BalanceHistory
+	err := api.EachBalanceHistoryContext(ctx, params, func(history BalanceHistory) bool {
+		histories = append(histories, history)
+		return true
+	})
+	return histories, err
+}
+
+// 取引手数料の割合を取得するfunction
+func (api *APIClient) GetTradingCommissionContext(ctx context.Context, productCode string) (*TradingCommission, error) {
+	url := "me/gettradingcommission"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"product_code": productCode}, nil)
+	if err != nil {
+		log.Printf("action=GetTradingCommission err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var commission TradingCommission
+	err = json.Unmarshal(resp, &commission)
+	if err != nil {
+		log.Printf("action=GetTradingCommission err=%s", err.Error())
+		return nil, err
+	}
+	return &commission, nil
+}
+
+// GetTradingCommission は GetTradingCommissionContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetTradingCommission(productCode string) (*TradingCommission, error) {
+	return api.GetTradingCommissionContext(context.Background(), productCode)
+}
@@ -2,41 +2,114 @@ package bitflyer
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 // ベースとなるURL
-const baseURL = "https://api.bitflyer.com/v1/"
+const (
+	defaultBaseURL      = "https://api.bitflyer.com/v1/"
+	defaultWebSocketURL = "wss://ws.lightstream.bitflyer.com/json-rpc"
+)
 
 // APIClient　　APIのキーとシークレットキーをStructで用意しておく
 type APIClient struct {
-	key        string
-	secret     string
-	httpClient *http.Client
+	key          string
+	secret       string
+	httpClient   *http.Client
+	baseURL      string
+	webSocketURL string
+	userAgent    string
+	now          func() time.Time
+
+	// API 制限とリトライの設定
+	publicLimit    int
+	privateLimit   int
+	orderLimit     int
+	publicLimiter  *RateLimiter
+	privateLimiter *RateLimiter
+	orderLimiter   *RateLimiter
+	maxRetries     int
+	retryBaseWait  time.Duration
+}
+
+// Option New に渡して APIClient の接続先などを差し替えるための function
+type Option func(*APIClient)
+
+// REST API の接続先を変更する (ローカルのモックサーバーやプロキシ向け)
+func WithBaseURL(baseURL string) Option {
+	return func(api *APIClient) {
+		api.baseURL = baseURL
+	}
+}
+
+// Realtime API (WebSocket) の接続先を変更する
+func WithWebSocketURL(webSocketURL string) Option {
+	return func(api *APIClient) {
+		api.webSocketURL = webSocketURL
+	}
+}
+
+// リクエストに使う http.Client を変更する (タイムアウトやトランスポートの設定用)
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(api *APIClient) {
+		api.httpClient = httpClient
+	}
+}
+
+// リクエストに付ける User-Agent を設定する
+func WithUserAgent(userAgent string) Option {
+	return func(api *APIClient) {
+		api.userAgent = userAgent
+	}
+}
+
+// 署名のタイムスタンプに使う時計を変更する (テストで時間を固定する用)
+func WithClock(now func() time.Time) Option {
+	return func(api *APIClient) {
+		api.now = now
+	}
 }
 
 // APIClient のStructを返すfunction
-func New(key, secret string) *APIClient {
-	apiClient := &APIClient{key, secret, &http.Client{}}
+func New(key, secret string, opts ...Option) *APIClient {
+	apiClient := &APIClient{
+		key:          key,
+		secret:       secret,
+		httpClient:   &http.Client{},
+		baseURL:      defaultBaseURL,
+		webSocketURL: defaultWebSocketURL,
+		now:          time.Now,
+
+		publicLimit:   defaultPublicLimit,
+		privateLimit:  defaultPrivateLimit,
+		orderLimit:    defaultOrderLimit,
+		maxRetries:    defaultMaxRetries,
+		retryBaseWait: defaultRetryBaseWait,
+	}
+	for _, opt := range opts {
+		opt(apiClient)
+	}
+	apiClient.publicLimiter = NewRateLimiter(apiClient.publicLimit, rateLimitWindow, apiClient.now)
+	apiClient.privateLimiter = NewRateLimiter(apiClient.privateLimit, rateLimitWindow, apiClient.now)
+	apiClient.orderLimiter = NewRateLimiter(apiClient.orderLimit, rateLimitWindow, apiClient.now)
 	return apiClient
 }
 
 // header を作成するfunction
 func (api APIClient) header(method, endpoint string, body []byte) map[string]string {
 	// timestamp
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	timestamp := strconv.FormatInt(api.now().Unix(), 10)
 	message := timestamp + method + endpoint + string(body)
 
 	mac := hmac.New(sha256.New, []byte(api.secret))
@@ -50,10 +123,59 @@ func (api APIClient) header(method, endpoint string, body []byte) map[string]str
 	}
 }
 
+// AuthParams Realtime API の auth に渡す認証情報を格納するStruct
+type AuthParams struct {
+	APIKey    string `json:"api_key"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// Realtime API の認証情報を作成するfunction (header と同じく secret で HMAC-SHA256 の署名を作る)
+func (api APIClient) authParams() (*AuthParams, error) {
+	timestamp := api.now().UnixNano() / int64(time.Millisecond)
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	message := strconv.FormatInt(timestamp, 10) + nonce
+
+	mac := hmac.New(sha256.New, []byte(api.secret))
+	mac.Write([]byte(message))
+	sign := hex.EncodeToString(mac.Sum(nil))
+	return &AuthParams{
+		APIKey:    api.key,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: sign,
+	}, nil
+}
+
+// API 制限を守りながらリクエストを投げ、GET で一時的なエラーの場合はリトライするfunction
+func (api *APIClient) doRequest(ctx context.Context, method, urlPath string, query map[string]string, data []byte) (body []byte, err error) {
+	for attempt := 0; ; attempt++ {
+		if err := api.waitRateLimit(ctx, urlPath); err != nil {
+			return nil, err
+		}
+		body, err = api.sendRequest(ctx, method, urlPath, query, data)
+		if attempt >= api.maxRetries || ctx.Err() != nil || !shouldRetry(method, err) {
+			return body, err
+		}
+		wait := api.retryWait(attempt)
+		log.Printf("action=doRequest status=retry attempt=%d wait=%s err=%s", attempt+1, wait, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // header を使ってリクエストを投げるfunction
-func (api *APIClient) doRequest(method, urlPath string, query map[string]string, data []byte) (body []byte, err error) {
+func (api *APIClient) sendRequest(ctx context.Context, method, urlPath string, query map[string]string, data []byte) (body []byte, err error) {
 	// URL の確認
-	baseURL, err := url.Parse(baseURL)
+	baseURL, err := url.Parse(api.baseURL)
 	if err != nil {
 		return
 	}
@@ -67,7 +189,7 @@ func (api *APIClient) doRequest(method, urlPath string, query map[string]string,
 	log.Printf("action=doRequest endpoint=%s", endpoint)
 
 	// リクエストの作成
-	req, err := http.NewRequest(method, endpoint, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewBuffer(data))
 	if err != nil {
 		return
 	}
@@ -81,6 +203,9 @@ func (api *APIClient) doRequest(method, urlPath string, query map[string]string,
 	for key, value := range api.header(method, req.URL.RequestURI(), data) {
 		req.Header.Add(key, value)
 	}
+	if api.userAgent != "" {
+		req.Header.Set("User-Agent", api.userAgent)
+	}
 	resp, err := api.httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -90,6 +215,10 @@ func (api *APIClient) doRequest(method, urlPath string, query map[string]string,
 	if err != nil {
 		return nil, err
 	}
+	// エラーの本文を Balance などに Unmarshal してしまわないように、ここでエラーにする
+	if err := checkResponse(endpoint, resp.StatusCode, body); err != nil {
+		return nil, err
+	}
 	return body, nil
 }
 
@@ -101,9 +230,9 @@ type Balance struct {
 }
 
 // bitflyer のGetBalance APIにアクセスするfunction
-func (api *APIClient) GetBalance() ([]Balance, error) {
+func (api *APIClient) GetBalanceContext(ctx context.Context) ([]Balance, error) {
 	url := "me/getbalance"
-	resp, err := api.doRequest("GET", url, map[string]string{}, nil)
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{}, nil)
 	log.Printf("url=%s resp=%s", url, string(resp))
 	if err != nil {
 		log.Printf("action=GetBalance err=%s", err.Error())
@@ -119,6 +248,11 @@ func (api *APIClient) GetBalance() ([]Balance, error) {
 	return balance, nil
 }
 
+// GetBalance は GetBalanceContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetBalance() ([]Balance, error) {
+	return api.GetBalanceContext(context.Background())
+}
+
 // Ticker API でビットコインの情報を取ってくるためのStructを作成
 type Ticker struct {
 	ProductCode     string  `json:"product_code"`
@@ -140,6 +274,43 @@ func (t *Ticker) GetMidPrice() float64 {
 	return (t.BestBid + t.BestAsk) / 2
 }
 
+// キャンドルに使う Ticker の価格の種類
+const (
+	PriceSourceMid        = "mid"
+	PriceSourceLtp        = "ltp"
+	PriceSourceBid        = "bid"
+	PriceSourceAsk        = "ask"
+	PriceSourceMicroPrice = "microprice"
+)
+
+// PriceSources 指定できる価格の種類の一覧
+var PriceSources = []string{PriceSourceMid, PriceSourceLtp, PriceSourceBid, PriceSourceAsk, PriceSourceMicroPrice}
+
+// 最良気配の数量で重み付けした価格を返すfunction
+// 買いの数量が多いほど次は上がりやすいので、売り気配の方に寄せる
+func (t *Ticker) GetMicroPrice() float64 {
+	totalSize := t.BestBidSize + t.BestAskSize
+	if totalSize <= 0 {
+		return t.GetMidPrice()
+	}
+	return (t.BestBid*t.BestAskSize + t.BestAsk*t.BestBidSize) / totalSize
+}
+
+// source で指定した種類の価格を返すfunction (知らない種類の場合は中間価格)
+func (t *Ticker) GetPrice(source string) float64 {
+	switch source {
+	case PriceSourceLtp:
+		return t.Ltp
+	case PriceSourceBid:
+		return t.BestBid
+	case PriceSourceAsk:
+		return t.BestAsk
+	case PriceSourceMicroPrice:
+		return t.GetMicroPrice()
+	}
+	return t.GetMidPrice()
+}
+
 // 情報をGetした時間を取得するfunction
 func (t *Ticker) DateTime() time.Time {
 	dateTime, err := time.Parse(time.RFC3339, t.Timestamp)
@@ -154,10 +325,45 @@ func (t *Ticker) TruncateDateTime(duration time.Duration) time.Time {
 	return t.DateTime().Truncate(duration)
 }
 
+// Execution 約定履歴の1件分を格納するStruct
+type Execution struct {
+	ID                         int     `json:"id"`
+	Side                       string  `json:"side"`
+	Price                      float64 `json:"price"`
+	Size                       float64 `json:"size"`
+	ExecDate                   string  `json:"exec_date"`
+	BuyChildOrderAcceptanceID  string  `json:"buy_child_order_acceptance_id"`
+	SellChildOrderAcceptanceID string  `json:"sell_child_order_acceptance_id"`
+}
+
+// 約定した時間を取得するfunction
+func (e *Execution) DateTime() time.Time {
+	return parseTime(e.ExecDate)
+}
+
+// duration で約定した時間の不要な部分を切り捨てる function
+func (e *Execution) TruncateDateTime(duration time.Duration) time.Time {
+	return e.DateTime().Truncate(duration)
+}
+
+// bitflyer の時間を time.Time に変換するfunction
+// Realtime API は "Z" 付き、REST API はタイムゾーン無しのUTCで返してくるので両方に対応する
+func parseTime(value string) time.Time {
+	dateTime, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return dateTime
+	}
+	dateTime, err = time.Parse("2006-01-02T15:04:05", value)
+	if err != nil {
+		log.Printf("action=parseTime, err=%s", err.Error())
+	}
+	return dateTime
+}
+
 // bitflyer のTicker APIにアクセスして、Ticker structに情報を入れて返すfunction
-func (api *APIClient) GetTicker(productCode string) (*Ticker, error) {
+func (api *APIClient) GetTickerContext(ctx context.Context, productCode string) (*Ticker, error) {
 	url := "ticker"
-	resp, err := api.doRequest("GET", url, map[string]string{"product_code": productCode}, nil)
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"product_code": productCode}, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -170,64 +376,319 @@ func (api *APIClient) GetTicker(productCode string) (*Ticker, error) {
 	return &ticker, nil
 }
 
-type JsonRPC2 struct {
-	Version string      `json:"jsonrpc"`
-	Method  string      `json:"method"`
-	Params  interface{} `json:"params"`
-	Result  interface{} `json:"result,omitempty"`
-	Id      *int        `json:"id,omitempty"`
+// GetTicker は GetTickerContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetTicker(productCode string) (*Ticker, error) {
+	return api.GetTickerContext(context.Background(), productCode)
 }
 
-type SubscribeParams struct {
-	Channel string `json:"channel"`
+// Order 新規注文の内容を格納するStruct
+type Order struct {
+	ProductCode     string  `json:"product_code"`
+	ChildOrderType  string  `json:"child_order_type"`
+	Side            string  `json:"side"`
+	Price           float64 `json:"price,omitempty"`
+	Size            float64 `json:"size"`
+	MinuteToExpires int     `json:"minute_to_expire,omitempty"`
+	TimeInForce     string  `json:"time_in_force,omitempty"`
 }
 
-// JSON-RPC 2.0 over WebSocket APIでリアルタイムでTickerを取得するためのfunction
-func (api *APIClient) GetRealTimeTicker(symbol string, ch chan<- Ticker) {
+// ChildOrder bitflyerから返ってくる注文の状態を格納するStruct
+type ChildOrder struct {
+	ID                     int     `json:"id"`
+	ChildOrderID           string  `json:"child_order_id"`
+	ProductCode            string  `json:"product_code"`
+	Side                   string  `json:"side"`
+	ChildOrderType         string  `json:"child_order_type"`
+	Price                  float64 `json:"price"`
+	AveragePrice           float64 `json:"average_price"`
+	Size                   float64 `json:"size"`
+	ChildOrderState        string  `json:"child_order_state"`
+	ExpireDate             string  `json:"expire_date"`
+	ChildOrderDate         string  `json:"child_order_date"`
+	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
+	OutstandingSize        float64 `json:"outstanding_size"`
+	CancelSize             float64 `json:"cancel_size"`
+	ExecutedSize           float64 `json:"executed_size"`
+	TotalCommission        float64 `json:"total_commission"`
+}
 
-	u := url.URL{Scheme: "wss", Host: "ws.lightstream.bitflyer.com", Path: "/json-rpc"}
-	log.Printf("connecting to %s", u.String())
+// 注文を受け付けた時間を取得するfunction (bitflyer はタイムゾーン無しのUTCで返す)
+func (o *ChildOrder) DateTime() time.Time {
+	dateTime, err := time.Parse("2006-01-02T15:04:05", o.ChildOrderDate)
+	if err != nil {
+		log.Printf("action=ChildOrder.DateTime, err=%s", err.Error())
+	}
+	return dateTime
+}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+// ResponseSendChildOrder 注文を送信した時に返ってくる受付IDを格納するStruct
+type ResponseSendChildOrder struct {
+	ChildOrderAcceptanceID string `json:"child_order_acceptance_id"`
+}
+
+// 新規注文(MARKET/LIMIT)を送信するfunction
+func (api *APIClient) SendChildOrderContext(ctx context.Context, order *Order) (*ResponseSendChildOrder, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	url := "me/sendchildorder"
+	resp, err := api.doRequest(ctx, "POST", url, map[string]string{}, data)
 	if err != nil {
-		log.Fatal("dial:", err)
+		log.Printf("action=SendChildOrder err=%s", err.Error())
+		return nil, err
 	}
-	defer c.Close()
+	// Unmarshal するためにvarを用意する
+	var response ResponseSendChildOrder
+	err = json.Unmarshal(resp, &response)
+	if err != nil {
+		log.Printf("action=SendChildOrder err=%s", err.Error())
+		return nil, err
+	}
+	return &response, nil
+}
 
-	channel := fmt.Sprintf("lightning_ticker_%s", symbol)
-	if err := c.WriteJSON(&JsonRPC2{Version: "2.0", Method: "subscribe", Params: &SubscribeParams{channel}}); err != nil {
-		log.Fatal("subscribe:", err)
-		return
+// SendChildOrder は SendChildOrderContext を context.Background() で呼ぶfunction
+func (api *APIClient) SendChildOrder(order *Order) (*ResponseSendChildOrder, error) {
+	return api.SendChildOrderContext(context.Background(), order)
+}
+
+// ListChildOrdersParams 注文一覧を取得する時の絞り込み条件を格納するStruct
+type ListChildOrdersParams struct {
+	ProductCode            string
+	ChildOrderState        string
+	ChildOrderID           string
+	ChildOrderAcceptanceID string
+	ParentOrderID          string
+	Count                  int
+	Before                 int
+	After                  int
+}
+
+// 絞り込み条件をクエリに変換するfunction (空の条件は送らない)
+func (p *ListChildOrdersParams) query() map[string]string {
+	query := map[string]string{"product_code": p.ProductCode}
+	if p.ChildOrderState != "" {
+		query["child_order_state"] = p.ChildOrderState
+	}
+	if p.ChildOrderID != "" {
+		query["child_order_id"] = p.ChildOrderID
+	}
+	if p.ChildOrderAcceptanceID != "" {
+		query["child_order_acceptance_id"] = p.ChildOrderAcceptanceID
+	}
+	if p.ParentOrderID != "" {
+		query["parent_order_id"] = p.ParentOrderID
+	}
+	if p.Count > 0 {
+		query["count"] = strconv.Itoa(p.Count)
 	}
+	if p.Before > 0 {
+		query["before"] = strconv.Itoa(p.Before)
+	}
+	if p.After > 0 {
+		query["after"] = strconv.Itoa(p.After)
+	}
+	return query
+}
 
-	// OUTER　APIから取得した情報をTickerに適した部分のみ表示するように編集してチャネルに送信する
-OUTER:
-	for {
-		message := new(JsonRPC2)
-		if err := c.ReadJSON(message); err != nil {
-			log.Println("read:", err)
-			return
-		}
+// 注文の一覧を取得するfunction
+func (api *APIClient) ListChildOrdersContext(ctx context.Context, params *ListChildOrdersParams) ([]ChildOrder, error) {
+	url := "me/getchildorders"
+	resp, err := api.doRequest(ctx, "GET", url, params.query(), nil)
+	if err != nil {
+		log.Printf("action=ListChildOrders err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var orders []ChildOrder
+	err = json.Unmarshal(resp, &orders)
+	if err != nil {
+		log.Printf("action=ListChildOrders err=%s", err.Error())
+		return nil, err
+	}
+	return orders, nil
+}
 
-		if message.Method == "channelMessage" {
-			switch v := message.Params.(type) {
-			case map[string]interface{}:
-				for key, binary := range v {
-					if key == "message" {
-						marshaTic, err := json.Marshal(binary)
-						fmt.Println(marshaTic)
-						if err != nil {
-							continue OUTER
-						}
-						var ticker Ticker
-						if err := json.Unmarshal(marshaTic, &ticker); err != nil {
-							fmt.Println(marshaTic)
-							continue OUTER
-						}
-						ch <- ticker
-					}
-				}
-			}
-		}
+// ListChildOrders は ListChildOrdersContext を context.Background() で呼ぶfunction
+func (api *APIClient) ListChildOrders(params *ListChildOrdersParams) ([]ChildOrder, error) {
+	return api.ListChildOrdersContext(context.Background(), params)
+}
+
+// 受付IDから注文の状態を取得するfunction
+func (api *APIClient) GetChildOrderContext(ctx context.Context, productCode, childOrderAcceptanceID string) (*ChildOrder, error) {
+	orders, err := api.ListChildOrdersContext(ctx, &ListChildOrdersParams{
+		ProductCode:            productCode,
+		ChildOrderAcceptanceID: childOrderAcceptanceID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// まだ注文が一覧に反映されていない場合
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	return &orders[0], nil
+}
+
+// GetChildOrder は GetChildOrderContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetChildOrder(productCode, childOrderAcceptanceID string) (*ChildOrder, error) {
+	return api.GetChildOrderContext(context.Background(), productCode, childOrderAcceptanceID)
+}
+
+// cancelRequest 注文をキャンセルする時のリクエストボディを格納するStruct
+type cancelRequest struct {
+	ProductCode            string `json:"product_code"`
+	ChildOrderID           string `json:"child_order_id,omitempty"`
+	ChildOrderAcceptanceID string `json:"child_order_acceptance_id,omitempty"`
+}
+
+// 受付IDを指定して注文をキャンセルするfunction
+func (api *APIClient) CancelChildOrderContext(ctx context.Context, productCode, childOrderAcceptanceID string) error {
+	data, err := json.Marshal(&cancelRequest{ProductCode: productCode, ChildOrderAcceptanceID: childOrderAcceptanceID})
+	if err != nil {
+		return err
+	}
+	url := "me/cancelchildorder"
+	_, err = api.doRequest(ctx, "POST", url, map[string]string{}, data)
+	if err != nil {
+		log.Printf("action=CancelChildOrder err=%s", err.Error())
+		return err
 	}
+	return nil
+}
+
+// CancelChildOrder は CancelChildOrderContext を context.Background() で呼ぶfunction
+func (api *APIClient) CancelChildOrder(productCode, childOrderAcceptanceID string) error {
+	return api.CancelChildOrderContext(context.Background(), productCode, childOrderAcceptanceID)
+}
+
+// 指定したプロダクトの注文を全てキャンセルするfunction
+func (api *APIClient) CancelAllChildOrdersContext(ctx context.Context, productCode string) error {
+	data, err := json.Marshal(&cancelRequest{ProductCode: productCode})
+	if err != nil {
+		return err
+	}
+	url := "me/cancelallchildorders"
+	_, err = api.doRequest(ctx, "POST", url, map[string]string{}, data)
+	if err != nil {
+		log.Printf("action=CancelAllChildOrders err=%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// CancelAllChildOrders は CancelAllChildOrdersContext を context.Background() で呼ぶfunction
+func (api *APIClient) CancelAllChildOrders(productCode string) error {
+	return api.CancelAllChildOrdersContext(context.Background(), productCode)
+}
+
+// ParentOrderParameter 特殊注文を構成するそれぞれの注文を格納するStruct
+type ParentOrderParameter struct {
+	ProductCode   string  `json:"product_code"`
+	ConditionType string  `json:"condition_type"`
+	Side          string  `json:"side"`
+	Price         float64 `json:"price,omitempty"`
+	Size          float64 `json:"size"`
+	TriggerPrice  float64 `json:"trigger_price,omitempty"`
+	Offset        float64 `json:"offset,omitempty"`
+}
+
+// ParentOrder 特殊注文(IFD, OCO, IFDOCO)の内容を格納するStruct
+type ParentOrder struct {
+	OrderMethod     string                 `json:"order_method"`
+	MinuteToExpires int                    `json:"minute_to_expire,omitempty"`
+	TimeInForce     string                 `json:"time_in_force,omitempty"`
+	Parameters      []ParentOrderParameter `json:"parameters"`
+}
+
+// ResponseSendParentOrder 特殊注文を送信した時に返ってくる受付IDを格納するStruct
+type ResponseSendParentOrder struct {
+	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+}
+
+// ParentOrderDetail bitflyerから返ってくる特殊注文の詳細を格納するStruct
+type ParentOrderDetail struct {
+	ID                      int                    `json:"id"`
+	ParentOrderID           string                 `json:"parent_order_id"`
+	OrderMethod             string                 `json:"order_method"`
+	MinuteToExpires         int                    `json:"minute_to_expire"`
+	Parameters              []ParentOrderParameter `json:"parameters"`
+	ParentOrderAcceptanceID string                 `json:"parent_order_acceptance_id"`
+}
+
+// 特殊注文を送信するfunction
+func (api *APIClient) SendParentOrderContext(ctx context.Context, order *ParentOrder) (*ResponseSendParentOrder, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	url := "me/sendparentorder"
+	resp, err := api.doRequest(ctx, "POST", url, map[string]string{}, data)
+	if err != nil {
+		log.Printf("action=SendParentOrder err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var response ResponseSendParentOrder
+	err = json.Unmarshal(resp, &response)
+	if err != nil {
+		log.Printf("action=SendParentOrder err=%s", err.Error())
+		return nil, err
+	}
+	return &response, nil
+}
+
+// SendParentOrder は SendParentOrderContext を context.Background() で呼ぶfunction
+func (api *APIClient) SendParentOrder(order *ParentOrder) (*ResponseSendParentOrder, error) {
+	return api.SendParentOrderContext(context.Background(), order)
+}
+
+// 受付IDから特殊注文の詳細を取得するfunction
+func (api *APIClient) GetParentOrderContext(ctx context.Context, parentOrderAcceptanceID string) (*ParentOrderDetail, error) {
+	url := "me/getparentorder"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"parent_order_acceptance_id": parentOrderAcceptanceID}, nil)
+	if err != nil {
+		log.Printf("action=GetParentOrder err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var detail ParentOrderDetail
+	err = json.Unmarshal(resp, &detail)
+	if err != nil {
+		log.Printf("action=GetParentOrder err=%s", err.Error())
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// GetParentOrder は GetParentOrderContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetParentOrder(parentOrderAcceptanceID string) (*ParentOrderDetail, error) {
+	return api.GetParentOrderContext(context.Background(), parentOrderAcceptanceID)
+}
+
+// cancelParentRequest 特殊注文をキャンセルする時のリクエストボディを格納するStruct
+type cancelParentRequest struct {
+	ProductCode             string `json:"product_code"`
+	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+}
+
+// 受付IDを指定して特殊注文をキャンセルするfunction
+func (api *APIClient) CancelParentOrderContext(ctx context.Context, productCode, parentOrderAcceptanceID string) error {
+	data, err := json.Marshal(&cancelParentRequest{productCode, parentOrderAcceptanceID})
+	if err != nil {
+		return err
+	}
+	url := "me/cancelparentorder"
+	_, err = api.doRequest(ctx, "POST", url, map[string]string{}, data)
+	if err != nil {
+		log.Printf("action=CancelParentOrder err=%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// CancelParentOrder は CancelParentOrderContext を context.Background() で呼ぶfunction
+func (api *APIClient) CancelParentOrder(productCode, parentOrderAcceptanceID string) error {
+	return api.CancelParentOrderContext(context.Background(), productCode, parentOrderAcceptanceID)
 }
@@ -0,0 +1,336 @@
+package bitflyer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// テストで署名のタイムスタンプに使う時間 (2020-01-01T00:00:00Z)
+var testNow = time.Unix(1577836800, 0)
+
+// fakeBitflyer bitflyer の REST API (/v1/) と Realtime API (/json-rpc) の代わりに応答する httptest.Server
+type fakeBitflyer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	rest     http.HandlerFunc
+	realtime func(conn *websocket.Conn)
+}
+
+// rest と realtime で応答する fakeBitflyer を起動するfunction (テストが終わったら止める)
+func newFakeBitflyer(t *testing.T, rest http.HandlerFunc, realtime func(conn *websocket.Conn)) *fakeBitflyer {
+	t.Helper()
+	f := &fakeBitflyer{rest: rest, realtime: realtime}
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		rest := f.rest
+		f.mu.Unlock()
+		if rest == nil {
+			http.NotFound(w, r)
+			return
+		}
+		rest(w, r)
+	})
+	mux.HandleFunc("/json-rpc", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if f.realtime != nil {
+			f.realtime(conn)
+		}
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// fakeBitflyer に接続する APIClient を返すfunction
+func (f *fakeBitflyer) client(opts ...Option) *APIClient {
+	opts = append([]Option{
+		WithBaseURL(f.URL + "/v1/"),
+		WithWebSocketURL("ws" + strings.TrimPrefix(f.URL, "http") + "/json-rpc"),
+		WithClock(func() time.Time { return testNow }),
+	}, opts...)
+	return New("key", "secret", opts...)
+}
+
+// secret で message に署名した値を返すfunction
+func sign(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHeader(t *testing.T) {
+	api := New("key", "secret", WithClock(func() time.Time { return testNow }))
+	tests := []struct {
+		name     string
+		method   string
+		endpoint string
+		body     string
+		wantSign string
+	}{
+		{
+			name:     "GET without query",
+			method:   "GET",
+			endpoint: "/v1/me/getbalance",
+			wantSign: "6ba6631b7364242a4357478e8e869838a930af1b7099dfbb2f338d6e93a9881d",
+		},
+		{
+			name:     "GET with query",
+			method:   "GET",
+			endpoint: "/v1/me/getchildorders?product_code=BTC_JPY",
+			wantSign: "37c3314423987125084d50584ba57dce29f728ca29c079585643b90866077668",
+		},
+		{
+			name:     "POST with body",
+			method:   "POST",
+			endpoint: "/v1/me/sendchildorder",
+			body:     `{"product_code":"BTC_JPY","size":0.01}`,
+			wantSign: "54a949b7c3b978d432cce214d001a537e258d4f7581c0568e8b9be8adf15bb83",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := api.header(tt.method, tt.endpoint, []byte(tt.body))
+			if header["ACCESS-KEY"] != "key" {
+				t.Errorf("ACCESS-KEY = %q, want %q", header["ACCESS-KEY"], "key")
+			}
+			if header["ACCESS-TIMESTAMP"] != "1577836800" {
+				t.Errorf("ACCESS-TIMESTAMP = %q, want %q", header["ACCESS-TIMESTAMP"], "1577836800")
+			}
+			if header["ACCESS-SIGN"] != tt.wantSign {
+				t.Errorf("ACCESS-SIGN = %q, want %q", header["ACCESS-SIGN"], tt.wantSign)
+			}
+		})
+	}
+}
+
+func TestSendRequestSignsRequestURI(t *testing.T) {
+	var gotSign, wantSign, gotAgent string
+	f := newFakeBitflyer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotSign = r.Header.Get("ACCESS-SIGN")
+		wantSign = sign("secret", r.Header.Get("ACCESS-TIMESTAMP")+r.Method+r.URL.RequestURI()+string(body))
+		gotAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(`[]`))
+	}, nil)
+	api := f.client(WithUserAgent("gotrading-test"))
+
+	if _, err := api.ListChildOrders(&ListChildOrdersParams{ProductCode: "BTC_JPY"}); err != nil {
+		t.Fatalf("ListChildOrders: %v", err)
+	}
+	if gotSign != wantSign {
+		t.Errorf("ACCESS-SIGN = %q, want the signature of the request URI with the query %q", gotSign, wantSign)
+	}
+	if gotAgent != "gotrading-test" {
+		t.Errorf("User-Agent = %q, want %q", gotAgent, "gotrading-test")
+	}
+}
+
+func TestSendChildOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "accepted",
+			resp: `{"child_order_acceptance_id":"JRF20200101-000000-000001"}`,
+			want: "JRF20200101-000000-000001",
+		},
+		{
+			name: "not accepted",
+			resp: `{}`,
+		},
+		{
+			name:    "invalid response",
+			resp:    `<html>`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, gotSign, wantSign string
+			var got Order
+			f := newFakeBitflyer(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				method, path = r.Method, r.URL.Path
+				gotSign = r.Header.Get("ACCESS-SIGN")
+				wantSign = sign("secret", r.Header.Get("ACCESS-TIMESTAMP")+r.Method+r.URL.RequestURI()+string(body))
+				json.Unmarshal(body, &got)
+				w.Write([]byte(tt.resp))
+			}, nil)
+
+			order := &Order{ProductCode: "BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.01, MinuteToExpires: 1, TimeInForce: "GTC"}
+			resp, err := f.client().SendChildOrder(order)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("SendChildOrder err = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendChildOrder: %v", err)
+			}
+			if resp.ChildOrderAcceptanceID != tt.want {
+				t.Errorf("child_order_acceptance_id = %q, want %q", resp.ChildOrderAcceptanceID, tt.want)
+			}
+			if method != "POST" || path != "/v1/me/sendchildorder" {
+				t.Errorf("request = %s %s, want POST /v1/me/sendchildorder", method, path)
+			}
+			if gotSign != wantSign {
+				t.Errorf("ACCESS-SIGN = %q, want the signature of the body %q", gotSign, wantSign)
+			}
+			if got.ProductCode != order.ProductCode || got.ChildOrderType != order.ChildOrderType || got.Side != order.Side || got.Size != order.Size {
+				t.Errorf("sent order = %+v, want %+v", got, *order)
+			}
+		})
+	}
+}
+
+func TestGetChildOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		resp      string
+		wantState string
+		wantNil   bool
+	}{
+		{
+			name:      "completed",
+			resp:      `[{"child_order_acceptance_id":"JRF20200101-000000-000001","side":"BUY","child_order_state":"COMPLETED","average_price":3000000,"executed_size":0.01}]`,
+			wantState: "COMPLETED",
+		},
+		{
+			name:    "not listed yet",
+			resp:    `[]`,
+			wantNil: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path, gotSign, wantSign string
+			var query map[string][]string
+			f := newFakeBitflyer(t, func(w http.ResponseWriter, r *http.Request) {
+				path, query = r.URL.Path, r.URL.Query()
+				gotSign = r.Header.Get("ACCESS-SIGN")
+				wantSign = sign("secret", r.Header.Get("ACCESS-TIMESTAMP")+r.Method+r.URL.RequestURI())
+				w.Write([]byte(tt.resp))
+			}, nil)
+
+			order, err := f.client().GetChildOrder("BTC_JPY", "JRF20200101-000000-000001")
+			if err != nil {
+				t.Fatalf("GetChildOrder: %v", err)
+			}
+			if path != "/v1/me/getchildorders" {
+				t.Errorf("path = %s, want /v1/me/getchildorders", path)
+			}
+			if got := query["child_order_acceptance_id"]; len(got) != 1 || got[0] != "JRF20200101-000000-000001" {
+				t.Errorf("child_order_acceptance_id = %v", got)
+			}
+			if got := query["product_code"]; len(got) != 1 || got[0] != "BTC_JPY" {
+				t.Errorf("product_code = %v", got)
+			}
+			// クエリも署名に含まれていること
+			if gotSign != wantSign {
+				t.Errorf("ACCESS-SIGN = %q, want the signature of the request URI with the query %q", gotSign, wantSign)
+			}
+			if tt.wantNil {
+				if order != nil {
+					t.Errorf("order = %+v, want nil", *order)
+				}
+				return
+			}
+			if order == nil || order.ChildOrderState != tt.wantState || order.AveragePrice != 3000000 || order.ExecutedSize != 0.01 {
+				t.Errorf("order = %+v, want %s at 3000000 x 0.01", order, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestDoRequestRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		urlPath   string
+		responses []int
+		body      string
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "GET succeeds after server errors", method: "GET", urlPath: "board", responses: []int{500, 502, 200}, wantCalls: 3},
+		{name: "GET gives up after max retries", method: "GET", urlPath: "board", responses: []int{429, 429, 429, 429}, wantCalls: 3, wantErr: ErrRateLimited},
+		{name: "GET does not retry client errors", method: "GET", urlPath: "me/getbalance", responses: []int{401}, wantCalls: 1, wantErr: ErrInvalidSignature},
+		{name: "GET does not retry errors in a 200 body", method: "GET", urlPath: "board", responses: []int{200}, body: `{"status":-2,"error_message":"maintenance"}`, wantCalls: 1, wantErr: ErrUnderMaintenance},
+		{name: "POST is never retried", method: "POST", urlPath: "me/sendchildorder", responses: []int{503}, wantCalls: 1, wantErr: ErrUnderMaintenance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := 0
+			f := newFakeBitflyer(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				status := tt.responses[len(tt.responses)-1]
+				if calls < len(tt.responses) {
+					status = tt.responses[calls]
+				}
+				calls++
+				mu.Unlock()
+				w.WriteHeader(status)
+				if tt.body != "" {
+					w.Write([]byte(tt.body))
+				} else if status == http.StatusOK {
+					w.Write([]byte(`{}`))
+				}
+			}, nil)
+			api := f.client(WithRetry(2, time.Millisecond))
+
+			_, err := api.doRequest(context.Background(), tt.method, tt.urlPath, nil, nil)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("doRequest returned %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("doRequest returned %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("server got %d requests, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDoRequestStopsRetryingWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	f := newFakeBitflyer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		cancel()
+		w.WriteHeader(http.StatusInternalServerError)
+	}, nil)
+	api := f.client(WithRetry(3, time.Hour))
+
+	if _, err := api.doRequest(ctx, "GET", "board", nil, nil); err == nil {
+		t.Fatal("doRequest returned nil, want an error")
+	}
+	if calls != 1 {
+		t.Errorf("server got %d requests after cancel, want 1", calls)
+	}
+}
@@ -0,0 +1,65 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// errors.go bitflyer から返ってきたエラーを扱うファイル
+
+// よく起きるエラーを errors.Is で判定するための値
+var (
+	ErrInsufficientFunds = errors.New("bitflyer: insufficient funds")
+	ErrInvalidSignature  = errors.New("bitflyer: invalid signature")
+	ErrRateLimited       = errors.New("bitflyer: rate limited")
+	ErrUnderMaintenance  = errors.New("bitflyer: under maintenance")
+)
+
+// APIError bitflyer がエラーを返した時の内容を格納するStruct
+// 例: {"status":-208,"error_message":"Order is not accepted","data":null}
+type APIError struct {
+	StatusCode   int    `json:"-"`
+	Endpoint     string `json:"-"`
+	Status       int    `json:"status"`
+	ErrorMessage string `json:"error_message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("bitflyer: endpoint=%s http_status=%d status=%d message=%s", e.Endpoint, e.StatusCode, e.Status, e.ErrorMessage)
+}
+
+// errors.Is で Err〜 と比較できるようにするfunction
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInsufficientFunds:
+		// -200: 残高不足 / -205: 証拠金不足
+		return e.Status == -200 || e.Status == -205
+	case ErrInvalidSignature:
+		return e.StatusCode == http.StatusUnauthorized || e.Status == -500 || e.Status == -501
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrUnderMaintenance:
+		return e.StatusCode == http.StatusServiceUnavailable || e.Status == -2
+	}
+	return false
+}
+
+// レスポンスがエラーであれば APIError を返すfunction
+// HTTP のステータスが 200 番台でも、本文が status < 0 のエラーであればエラーとして扱う
+func checkResponse(endpoint string, statusCode int, body []byte) error {
+	apiError := &APIError{StatusCode: statusCode, Endpoint: endpoint}
+	isHTTPError := statusCode < 200 || statusCode >= 300
+	if len(body) > 0 && body[0] == '{' {
+		if err := json.Unmarshal(body, apiError); err != nil && isHTTPError {
+			apiError.ErrorMessage = string(body)
+		}
+	} else if isHTTPError {
+		apiError.ErrorMessage = string(body)
+	}
+	if isHTTPError || apiError.Status < 0 {
+		return apiError
+	}
+	return nil
+}
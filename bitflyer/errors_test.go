@@ -0,0 +1,78 @@
+package bitflyer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		statusCode  int
+		body        string
+		wantErr     bool
+		wantStatus  int
+		wantMessage string
+	}{
+		{name: "success", statusCode: 200, body: `{"product_code":"BTC_JPY"}`},
+		{name: "success array", statusCode: 200, body: `[{"status":-1}]`},
+		{name: "empty success", statusCode: 200},
+		{name: "error in a 200 body", statusCode: 200, body: `{"status":-208,"error_message":"Order is not accepted","data":null}`, wantErr: true, wantStatus: -208, wantMessage: "Order is not accepted"},
+		{name: "json error", statusCode: 400, body: `{"status":-200,"error_message":"Insufficient funds"}`, wantErr: true, wantStatus: -200, wantMessage: "Insufficient funds"},
+		{name: "text error", statusCode: 503, body: "Service Unavailable", wantErr: true, wantMessage: "Service Unavailable"},
+		{name: "broken json error", statusCode: 500, body: `{"status":`, wantErr: true, wantMessage: `{"status":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResponse("https://example.com/v1/board", tt.statusCode, []byte(tt.body))
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("checkResponse returned %v, want nil", err)
+				}
+				return
+			}
+			var apiError *APIError
+			if !errors.As(err, &apiError) {
+				t.Fatalf("checkResponse returned %v, want *APIError", err)
+			}
+			if apiError.StatusCode != tt.statusCode || apiError.Status != tt.wantStatus || apiError.ErrorMessage != tt.wantMessage {
+				t.Errorf("checkResponse = %+v, want http_status=%d status=%d message=%q", apiError, tt.statusCode, tt.wantStatus, tt.wantMessage)
+			}
+			if apiError.Endpoint != "https://example.com/v1/board" {
+				t.Errorf("Endpoint = %q, want the request endpoint", apiError.Endpoint)
+			}
+		})
+	}
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    *APIError
+		target error
+		want   bool
+	}{
+		{name: "insufficient funds", err: &APIError{StatusCode: 400, Status: -200}, target: ErrInsufficientFunds, want: true},
+		{name: "insufficient margin", err: &APIError{StatusCode: 400, Status: -205}, target: ErrInsufficientFunds, want: true},
+		{name: "other order error", err: &APIError{StatusCode: 400, Status: -208}, target: ErrInsufficientFunds, want: false},
+		{name: "unauthorized", err: &APIError{StatusCode: http.StatusUnauthorized}, target: ErrInvalidSignature, want: true},
+		{name: "invalid signature status", err: &APIError{StatusCode: 400, Status: -500}, target: ErrInvalidSignature, want: true},
+		{name: "invalid key status", err: &APIError{StatusCode: 400, Status: -501}, target: ErrInvalidSignature, want: true},
+		{name: "too many requests", err: &APIError{StatusCode: http.StatusTooManyRequests}, target: ErrRateLimited, want: true},
+		{name: "server error is not rate limited", err: &APIError{StatusCode: 500}, target: ErrRateLimited, want: false},
+		{name: "service unavailable", err: &APIError{StatusCode: http.StatusServiceUnavailable}, target: ErrUnderMaintenance, want: true},
+		{name: "maintenance status", err: &APIError{StatusCode: 200, Status: -2}, target: ErrUnderMaintenance, want: true},
+		{name: "unknown target", err: &APIError{StatusCode: 400, Status: -200}, target: errors.New("other"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 呼び出し元で包まれていても判定できること
+			err := fmt.Errorf("action=test: %w", tt.err)
+			if got := errors.Is(err, tt.target); got != tt.want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, tt.target, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// margin.go Lightning FX などの証拠金取引で使う API をまとめたファイル
+
+// Position 証拠金取引で保有している建玉を格納するStruct
+type Position struct {
+	ProductCode         string  `json:"product_code"`
+	Side                string  `json:"side"`
+	Price               float64 `json:"price"`
+	Size                float64 `json:"size"`
+	Commission          float64 `json:"commission"`
+	SwapPointAccumulate float64 `json:"swap_point_accumulate"`
+	RequireCollateral   float64 `json:"require_collateral"`
+	OpenDate            string  `json:"open_date"`
+	Leverage            float64 `json:"leverage"`
+	Pnl                 float64 `json:"pnl"`
+	Sfd                 float64 `json:"sfd"`
+}
+
+// 建玉を持った時間を取得するfunction
+func (p *Position) DateTime() time.Time {
+	return parseTime(p.OpenDate)
+}
+
+// Collateral 証拠金の状態を格納するStruct
+type Collateral struct {
+	Collateral        float64 `json:"collateral"`
+	OpenPositionPnl   float64 `json:"open_position_pnl"`
+	RequireCollateral float64 `json:"require_collateral"`
+	KeepRate          float64 `json:"keep_rate"`
+}
+
+// 新しい建玉に使える証拠金を返すfunction
+func (c *Collateral) Free() float64 {
+	return c.Collateral + c.OpenPositionPnl - c.RequireCollateral
+}
+
+// CollateralHistory 証拠金の変動履歴の1件分を格納するStruct
+type CollateralHistory struct {
+	ID           int     `json:"id"`
+	CurrencyCode string  `json:"currency_code"`
+	Change       float64 `json:"change"`
+	Amount       float64 `json:"amount"`
+	ReasonCode   string  `json:"reason_code"`
+	Date         string  `json:"date"`
+}
+
+// 変動した時間を取得するfunction
+func (h *CollateralHistory) DateTime() time.Time {
+	return parseTime(h.Date)
+}
+
+// CollateralHistoryParams 証拠金の変動履歴を取得する時のページングの条件を格納するStruct
+type CollateralHistoryParams struct {
+	Count  int
+	Before int
+	After  int
+}
+
+// 条件をクエリに変換するfunction (空の条件は送らない)
+func (p *CollateralHistoryParams) query() map[string]string {
+	query := map[string]string{}
+	if p.Count > 0 {
+		query["count"] = strconv.Itoa(p.Count)
+	}
+	if p.Before > 0 {
+		query["before"] = strconv.Itoa(p.Before)
+	}
+	if p.After > 0 {
+		query["after"] = strconv.Itoa(p.After)
+	}
+	return query
+}
+
+// 保有している建玉の一覧を取得するfunction
+func (api *APIClient) GetPositionsContext(ctx context.Context, productCode string) ([]Position, error) {
+	url := "me/getpositions"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"product_code": productCode}, nil)
+	if err != nil {
+		log.Printf("action=GetPositions err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var positions []Position
+	err = json.Unmarshal(resp, &positions)
+	if err != nil {
+		log.Printf("action=GetPositions err=%s", err.Error())
+		return nil, err
+	}
+	return positions, nil
+}
+
+// GetPositions は GetPositionsContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetPositions(productCode string) ([]Position, error) {
+	return api.GetPositionsContext(context.Background(), productCode)
+}
+
+// 証拠金の状態を取得するfunction
+func (api *APIClient) GetCollateralContext(ctx context.Context) (*Collateral, error) {
+	url := "me/getcollateral"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{}, nil)
+	if err != nil {
+		log.Printf("action=GetCollateral err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var collateral Collateral
+	err = json.Unmarshal(resp, &collateral)
+	if err != nil {
+		log.Printf("action=GetCollateral err=%s", err.Error())
+		return nil, err
+	}
+	return &collateral, nil
+}
+
+// GetCollateral は GetCollateralContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetCollateral() (*Collateral, error) {
+	return api.GetCollateralContext(context.Background())
+}
+
+// 証拠金の変動履歴を新しい順に取得するfunction
+func (api *APIClient) GetCollateralHistoryContext(ctx context.Context, params *CollateralHistoryParams) ([]CollateralHistory, error) {
+	url := "me/getcollateralhistory"
+	resp, err := api.doRequest(ctx, "GET", url, params.query(), nil)
+	if err != nil {
+		log.Printf("action=GetCollateralHistory err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var histories []CollateralHistory
+	err = json.Unmarshal(resp, &histories)
+	if err != nil {
+		log.Printf("action=GetCollateralHistory err=%s", err.Error())
+		return nil, err
+	}
+	return histories, nil
+}
+
+// GetCollateralHistory は GetCollateralHistoryContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetCollateralHistory(params *CollateralHistoryParams) ([]CollateralHistory, error) {
+	return api.GetCollateralHistoryContext(context.Background(), params)
+}
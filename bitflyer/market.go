@@ -0,0 +1,195 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+)
+
+// market.go 認証のいらないマーケット情報の API をまとめたファイル
+
+// 取引所の稼働状況
+const (
+	HealthNormal    = "NORMAL"
+	HealthBusy      = "BUSY"
+	HealthVeryBusy  = "VERY BUSY"
+	HealthSuperBusy = "SUPER BUSY"
+	HealthNoOrder   = "NO ORDER"
+	HealthStop      = "STOP"
+)
+
+// 板の状態
+const (
+	BoardStateRunning  = "RUNNING"
+	BoardStateClosed   = "CLOSED"
+	BoardStateStarting = "STARTING"
+	BoardStatePreOpen  = "PREOPEN"
+	BoardStateCircuit  = "CIRCUIT BREAK"
+	BoardStateAwaitSQ  = "AWAITING SQ"
+	BoardStateMatured  = "MATURED"
+)
+
+// Market 取引できるマーケットの情報を格納するStruct
+type Market struct {
+	ProductCode string `json:"product_code"`
+	MarketType  string `json:"market_type"`
+	Alias       string `json:"alias"`
+}
+
+// Health 取引所の稼働状況を格納するStruct
+type Health struct {
+	Status string `json:"status"`
+}
+
+// BoardState 板の状態を格納するStruct
+type BoardState struct {
+	Health string `json:"health"`
+	State  string `json:"state"`
+	Data   struct {
+		SpecialQuotation float64 `json:"special_quotation"`
+	} `json:"data"`
+}
+
+// ExecutionsParams 約定履歴を取得する時のページングの条件を格納するStruct
+type ExecutionsParams struct {
+	ProductCode string
+	Count       int
+	Before      int
+	After       int
+}
+
+// 条件をクエリに変換するfunction (空の条件は送らない)
+func (p *ExecutionsParams) query() map[string]string {
+	query := map[string]string{"product_code": p.ProductCode}
+	if p.Count > 0 {
+		query["count"] = strconv.Itoa(p.Count)
+	}
+	if p.Before > 0 {
+		query["before"] = strconv.Itoa(p.Before)
+	}
+	if p.After > 0 {
+		query["after"] = strconv.Itoa(p.After)
+	}
+	return query
+}
+
+// マーケットの一覧を取得するfunction
+func (api *APIClient) GetMarketsContext(ctx context.Context) ([]Market, error) {
+	url := "markets"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{}, nil)
+	if err != nil {
+		log.Printf("action=GetMarkets err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var markets []Market
+	err = json.Unmarshal(resp, &markets)
+	if err != nil {
+		log.Printf("action=GetMarkets err=%s", err.Error())
+		return nil, err
+	}
+	return markets, nil
+}
+
+// GetMarkets は GetMarketsContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetMarkets() ([]Market, error) {
+	return api.GetMarketsContext(context.Background())
+}
+
+// 板情報を取得するfunction
+func (api *APIClient) GetBoardContext(ctx context.Context, productCode string) (*Board, error) {
+	url := "board"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"product_code": productCode}, nil)
+	if err != nil {
+		log.Printf("action=GetBoard err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var board Board
+	err = json.Unmarshal(resp, &board)
+	if err != nil {
+		log.Printf("action=GetBoard err=%s", err.Error())
+		return nil, err
+	}
+	return &board, nil
+}
+
+// GetBoard は GetBoardContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetBoard(productCode string) (*Board, error) {
+	return api.GetBoardContext(context.Background(), productCode)
+}
+
+// 約定履歴を新しい順に取得するfunction (before / after は約定IDでページングする)
+func (api *APIClient) GetExecutionsContext(ctx context.Context, params *ExecutionsParams) ([]Execution, error) {
+	url := "executions"
+	resp, err := api.doRequest(ctx, "GET", url, params.query(), nil)
+	if err != nil {
+		log.Printf("action=GetExecutions err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var executions []Execution
+	err = json.Unmarshal(resp, &executions)
+	if err != nil {
+		log.Printf("action=GetExecutions err=%s", err.Error())
+		return nil, err
+	}
+	return executions, nil
+}
+
+// GetExecutions は GetExecutionsContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetExecutions(params *ExecutionsParams) ([]Execution, error) {
+	return api.GetExecutionsContext(context.Background(), params)
+}
+
+// 取引所の稼働状況を取得するfunction
+func (api *APIClient) GetHealthContext(ctx context.Context, productCode string) (*Health, error) {
+	url := "gethealth"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"product_code": productCode}, nil)
+	if err != nil {
+		log.Printf("action=GetHealth err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var health Health
+	err = json.Unmarshal(resp, &health)
+	if err != nil {
+		log.Printf("action=GetHealth err=%s", err.Error())
+		return nil, err
+	}
+	return &health, nil
+}
+
+// GetHealth は GetHealthContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetHealth(productCode string) (*Health, error) {
+	return api.GetHealthContext(context.Background(), productCode)
+}
+
+// 板の状態を取得するfunction
+func (api *APIClient) GetBoardStateContext(ctx context.Context, productCode string) (*BoardState, error) {
+	url := "getboardstate"
+	resp, err := api.doRequest(ctx, "GET", url, map[string]string{"product_code": productCode}, nil)
+	if err != nil {
+		log.Printf("action=GetBoardState err=%s", err.Error())
+		return nil, err
+	}
+	// Unmarshal するためにvarを用意する
+	var boardState BoardState
+	err = json.Unmarshal(resp, &boardState)
+	if err != nil {
+		log.Printf("action=GetBoardState err=%s", err.Error())
+		return nil, err
+	}
+	return &boardState, nil
+}
+
+// GetBoardState は GetBoardStateContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetBoardState(productCode string) (*BoardState, error) {
+	return api.GetBoardStateContext(context.Background(), productCode)
+}
+
+// 注文を受け付けられる状態か判定するfunction
+func (s *BoardState) IsTradable() bool {
+	return s.State == BoardStateRunning && s.Health != HealthStop && s.Health != HealthNoOrder
+}
@@ -0,0 +1,311 @@
+package bitflyer
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// orderbook.go 板情報を受け取り、メモリ上で最新の板を管理するファイル
+
+// BoardLevel 板の1つの価格帯を格納するStruct
+type BoardLevel struct {
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"`
+}
+
+// Board 板情報(スナップショットと差分どちらも同じ形)を格納するStruct
+type Board struct {
+	MidPrice float64      `json:"mid_price"`
+	Bids     []BoardLevel `json:"bids"`
+	Asks     []BoardLevel `json:"asks"`
+}
+
+// 差分の mid_price と板から計算した仲値がこの回数続けて食い違ったら、差分を取りこぼしたとみなす
+const maxMidPriceMismatches = 3
+
+// REST で板を取り直している間に溜めておく差分の上限 (超えたら取り直した板は捨てる)
+const maxPendingDiffs = 1000
+
+// REST で板を取り直す最短の間隔 (食い違いが続いても API 制限を使い切らないようにする)
+const orderBookResyncInterval = 5 * time.Second
+
+// OrderBook スナップショットに差分を当てて最新の板を保持するStruct
+// bitflyer の板の差分には連番が無いので、再接続・板の交差(best bid >= best ask)・
+// 差分の mid_price との食い違いを取りこぼしとみなし、スナップショットで取り直すまで未同期として扱う
+type OrderBook struct {
+	ProductCode string
+
+	mu         sync.RWMutex
+	bids       map[float64]float64
+	asks       map[float64]float64
+	synced     bool
+	updatedAt  time.Time
+	mismatches int
+
+	// REST で取り直している間に届いた差分 (取り直した板に当て直す)
+	resyncing  bool
+	pending    []*Board
+	lastResync time.Time
+	// 溜めきれずに差分を捨てた場合は、取り直した板に当て直せないので使わない
+	overflowed bool
+}
+
+// OrderBook のStructを返すfunction
+func NewOrderBook(productCode string) *OrderBook {
+	return &OrderBook{
+		ProductCode: productCode,
+		bids:        map[float64]float64{},
+		asks:        map[float64]float64{},
+	}
+}
+
+// スナップショットで板を置き換えるfunction
+// REST で取り直している途中であれば、その間に届いた差分も当て直す
+func (b *OrderBook) ApplySnapshot(board *Board) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.applySnapshot(board)
+}
+
+// スナップショットで置き換えるfunction (mu をロックしてから呼ぶ)
+func (b *OrderBook) applySnapshot(board *Board) {
+	b.bids = map[float64]float64{}
+	b.asks = map[float64]float64{}
+	applyLevels(b.bids, board.Bids)
+	applyLevels(b.asks, board.Asks)
+	b.synced = true
+	b.mismatches = 0
+	b.updatedAt = time.Now()
+
+	// 差分は価格帯ごとのサイズそのものなので、スナップショットより前の差分を当て直しても後の差分で上書きされる
+	pending := b.pending
+	b.resyncing = false
+	b.pending = nil
+	b.overflowed = false
+	for _, diff := range pending {
+		if !b.applyDiff(diff) {
+			return
+		}
+	}
+}
+
+// 差分を板に当て、板が使える状態のままか返すfunction (サイズが0の価格帯は削除する)
+// false の場合は REST で取り直す (ResyncStarted) 必要がある
+func (b *OrderBook) ApplyDiff(board *Board) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 取り直している間の差分は、取り直した板に当てるまで溜めておく
+	if b.resyncing {
+		if b.overflowed {
+			return true
+		}
+		if len(b.pending) >= maxPendingDiffs {
+			log.Printf("action=OrderBook.ApplyDiff status=pending_overflow product_code=%s pending=%d", b.ProductCode, len(b.pending))
+			b.overflowed = true
+			b.pending = nil
+			return true
+		}
+		b.pending = append(b.pending, board)
+		return true
+	}
+	// スナップショットが届く前の差分は当てられないので捨てる
+	if !b.synced {
+		return false
+	}
+	return b.applyDiff(board)
+}
+
+// 差分を当てて、取りこぼしが無いか確認するfunction (mu をロックしてから呼ぶ)
+func (b *OrderBook) applyDiff(board *Board) bool {
+	applyLevels(b.bids, board.Bids)
+	applyLevels(b.asks, board.Asks)
+	b.updatedAt = time.Now()
+
+	// 板が交差していれば差分を取りこぼしている
+	bid, okBid := bestLevel(b.bids, true)
+	ask, okAsk := bestLevel(b.asks, false)
+	if okBid && okAsk && bid.Price >= ask.Price {
+		log.Printf("action=OrderBook.ApplyDiff status=crossed product_code=%s bid=%f ask=%f", b.ProductCode, bid.Price, ask.Price)
+		b.synced = false
+		return false
+	}
+	// 差分の mid_price と最良気配の仲値が続けて食い違う場合も、差分を取りこぼしている
+	if board.MidPrice > 0 && okBid && okAsk {
+		mid := (bid.Price + ask.Price) / 2
+		if math.Abs(mid-board.MidPrice) > board.MidPrice*1e-9 {
+			b.mismatches++
+		} else {
+			b.mismatches = 0
+		}
+		if b.mismatches >= maxMidPriceMismatches {
+			log.Printf("action=OrderBook.ApplyDiff status=mid_price_mismatch product_code=%s mid=%f mid_price=%f", b.ProductCode, mid, board.MidPrice)
+			b.synced = false
+			return false
+		}
+	}
+	return true
+}
+
+// 板を未同期にして次のスナップショットを待つfunction
+func (b *OrderBook) Invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.synced = false
+}
+
+// 板を未同期にして REST で取り直し始めるfunction
+// 既に取り直している場合や、前回から orderBookResyncInterval 経っていない場合は false を返す
+func (b *OrderBook) ResyncStarted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.synced = false
+	if b.resyncing || time.Since(b.lastResync) < orderBookResyncInterval {
+		return false
+	}
+	b.resyncing = true
+	b.pending = nil
+	b.overflowed = false
+	b.lastResync = time.Now()
+	return true
+}
+
+// REST で取り直した板で置き換え、同期できたかを返すfunction
+// 取り直している間に WebSocket のスナップショットが届いていれば、そちらの方が新しいので使わない
+// 差分を溜めきれなかった場合や、当て直した差分で取りこぼしが見つかった場合は未同期のままにする
+func (b *OrderBook) ResyncCompleted(board *Board) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.resyncing {
+		return false
+	}
+	if b.overflowed {
+		log.Printf("action=OrderBook.ResyncCompleted status=discarded product_code=%s", b.ProductCode)
+		b.resyncing = false
+		b.overflowed = false
+		return false
+	}
+	b.applySnapshot(board)
+	return b.synced
+}
+
+// REST で取り直せなかった時に、溜めていた差分を捨てて次のスナップショットを待つfunction
+func (b *OrderBook) ResyncFailed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resyncing = false
+	b.pending = nil
+	b.overflowed = false
+}
+
+// スナップショットと同期できているかを返すfunction
+func (b *OrderBook) Synced() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.synced
+}
+
+// 最後に板を更新した時間を返すfunction
+func (b *OrderBook) UpdatedAt() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.updatedAt
+}
+
+// 最良の買い気配を返すfunction
+func (b *OrderBook) BestBid() (BoardLevel, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return bestLevel(b.bids, true)
+}
+
+// 最良の売り気配を返すfunction
+func (b *OrderBook) BestAsk() (BoardLevel, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return bestLevel(b.asks, false)
+}
+
+// 最良気配から n 段分の板を返すfunction
+func (b *OrderBook) Depth(n int) (bids, asks []BoardLevel) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	bids = sortedLevels(b.bids, true)
+	asks = sortedLevels(b.asks, false)
+	if len(bids) > n {
+		bids = bids[:n]
+	}
+	if len(asks) > n {
+		asks = asks[:n]
+	}
+	return bids, asks
+}
+
+// size 分を成行で約定させた時の平均約定価格(VWAP)を返すfunction
+// BUY は売り板を、SELL は買い板を上から食っていく。板が足りなければ ok=false
+func (b *OrderBook) VWAP(side string, size float64) (price float64, ok bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var levels []BoardLevel
+	if side == "BUY" {
+		levels = sortedLevels(b.asks, false)
+	} else {
+		levels = sortedLevels(b.bids, true)
+	}
+
+	remaining := size
+	cost := 0.0
+	for _, level := range levels {
+		if remaining <= 0 {
+			break
+		}
+		fill := level.Size
+		if fill > remaining {
+			fill = remaining
+		}
+		cost += fill * level.Price
+		remaining -= fill
+	}
+	if size <= 0 || remaining > 0 {
+		return 0, false
+	}
+	return cost / size, true
+}
+
+func applyLevels(book map[float64]float64, levels []BoardLevel) {
+	for _, level := range levels {
+		if level.Size == 0 {
+			delete(book, level.Price)
+			continue
+		}
+		book[level.Price] = level.Size
+	}
+}
+
+func bestLevel(book map[float64]float64, highest bool) (BoardLevel, bool) {
+	var best BoardLevel
+	found := false
+	for price, size := range book {
+		if !found || (highest && price > best.Price) || (!highest && price < best.Price) {
+			best = BoardLevel{Price: price, Size: size}
+			found = true
+		}
+	}
+	return best, found
+}
+
+func sortedLevels(book map[float64]float64, descending bool) []BoardLevel {
+	levels := make([]BoardLevel, 0, len(book))
+	for price, size := range book {
+		levels = append(levels, BoardLevel{Price: price, Size: size})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if descending {
+			return levels[i].Price > levels[j].Price
+		}
+		return levels[i].Price < levels[j].Price
+	})
+	return levels
+}
@@ -0,0 +1,227 @@
+package bitflyer
+
+import (
+	"reflect"
+	"testing"
+)
+
+// テストで使う板 (best bid 100 / best ask 101)
+func testBoard() *Board {
+	return &Board{
+		MidPrice: 100.5,
+		Bids:     []BoardLevel{{Price: 100, Size: 1}, {Price: 99, Size: 2}},
+		Asks:     []BoardLevel{{Price: 101, Size: 1}, {Price: 102, Size: 2}},
+	}
+}
+
+func TestOrderBookApplyDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		snapshot    *Board
+		diffs       []*Board
+		wantResults []bool
+		wantSynced  bool
+		wantBids    []BoardLevel
+		wantAsks    []BoardLevel
+	}{
+		{
+			name:     "updates and removes levels",
+			snapshot: testBoard(),
+			diffs: []*Board{
+				{Bids: []BoardLevel{{Price: 100, Size: 0}, {Price: 98, Size: 3}}, Asks: []BoardLevel{{Price: 101, Size: 5}}},
+			},
+			wantResults: []bool{true},
+			wantSynced:  true,
+			wantBids:    []BoardLevel{{Price: 99, Size: 2}, {Price: 98, Size: 3}},
+			wantAsks:    []BoardLevel{{Price: 101, Size: 5}, {Price: 102, Size: 2}},
+		},
+		{
+			name:        "diff before a snapshot is dropped",
+			diffs:       []*Board{{Bids: []BoardLevel{{Price: 100, Size: 1}}}},
+			wantResults: []bool{false},
+			wantSynced:  false,
+			wantBids:    []BoardLevel{},
+			wantAsks:    []BoardLevel{},
+		},
+		{
+			name:        "crossed book",
+			snapshot:    testBoard(),
+			diffs:       []*Board{{Bids: []BoardLevel{{Price: 101.5, Size: 1}}}},
+			wantResults: []bool{false},
+			wantSynced:  false,
+			wantBids:    []BoardLevel{{Price: 101.5, Size: 1}, {Price: 100, Size: 1}, {Price: 99, Size: 2}},
+			wantAsks:    []BoardLevel{{Price: 101, Size: 1}, {Price: 102, Size: 2}},
+		},
+		{
+			name:     "matching mid price",
+			snapshot: testBoard(),
+			diffs: []*Board{
+				{MidPrice: 100.5, Asks: []BoardLevel{{Price: 101, Size: 3}}},
+			},
+			wantResults: []bool{true},
+			wantSynced:  true,
+			wantBids:    []BoardLevel{{Price: 100, Size: 1}, {Price: 99, Size: 2}},
+			wantAsks:    []BoardLevel{{Price: 101, Size: 3}, {Price: 102, Size: 2}},
+		},
+		{
+			name:     "mid price mismatches in a row",
+			snapshot: testBoard(),
+			diffs: []*Board{
+				{MidPrice: 200},
+				{MidPrice: 200},
+				{MidPrice: 200},
+			},
+			wantResults: []bool{true, true, false},
+			wantSynced:  false,
+			wantBids:    []BoardLevel{{Price: 100, Size: 1}, {Price: 99, Size: 2}},
+			wantAsks:    []BoardLevel{{Price: 101, Size: 1}, {Price: 102, Size: 2}},
+		},
+		{
+			name:     "a matching mid price resets the mismatches",
+			snapshot: testBoard(),
+			diffs: []*Board{
+				{MidPrice: 200},
+				{MidPrice: 200},
+				{MidPrice: 100.5},
+				{MidPrice: 200},
+			},
+			wantResults: []bool{true, true, true, true},
+			wantSynced:  true,
+			wantBids:    []BoardLevel{{Price: 100, Size: 1}, {Price: 99, Size: 2}},
+			wantAsks:    []BoardLevel{{Price: 101, Size: 1}, {Price: 102, Size: 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := NewOrderBook("BTC_JPY")
+			if tt.snapshot != nil {
+				book.ApplySnapshot(tt.snapshot)
+			}
+			for i, diff := range tt.diffs {
+				if got := book.ApplyDiff(diff); got != tt.wantResults[i] {
+					t.Errorf("ApplyDiff #%d = %v, want %v", i, got, tt.wantResults[i])
+				}
+			}
+			if got := book.Synced(); got != tt.wantSynced {
+				t.Errorf("Synced = %v, want %v", got, tt.wantSynced)
+			}
+			bids, asks := book.Depth(10)
+			if !reflect.DeepEqual(bids, tt.wantBids) {
+				t.Errorf("bids = %+v, want %+v", bids, tt.wantBids)
+			}
+			if !reflect.DeepEqual(asks, tt.wantAsks) {
+				t.Errorf("asks = %+v, want %+v", asks, tt.wantAsks)
+			}
+		})
+	}
+}
+
+func TestOrderBookResync(t *testing.T) {
+	t.Run("replays diffs received while resyncing", func(t *testing.T) {
+		book := NewOrderBook("BTC_JPY")
+		if !book.ResyncStarted() {
+			t.Fatal("ResyncStarted = false, want true")
+		}
+		if book.ResyncStarted() {
+			t.Error("ResyncStarted while resyncing = true, want false")
+		}
+		if !book.ApplyDiff(&Board{Bids: []BoardLevel{{Price: 100, Size: 5}}}) {
+			t.Error("ApplyDiff while resyncing = false, want true")
+		}
+		if book.Synced() {
+			t.Error("Synced while resyncing = true, want false")
+		}
+		if !book.ResyncCompleted(testBoard()) {
+			t.Fatal("ResyncCompleted = false, want true")
+		}
+		if !book.Synced() {
+			t.Error("Synced after ResyncCompleted = false, want true")
+		}
+		if bid, _ := book.BestBid(); bid != (BoardLevel{Price: 100, Size: 5}) {
+			t.Errorf("BestBid = %+v, want the replayed diff", bid)
+		}
+	})
+
+	t.Run("a websocket snapshot wins over the REST snapshot", func(t *testing.T) {
+		book := NewOrderBook("BTC_JPY")
+		book.ResyncStarted()
+		snapshot := testBoard()
+		snapshot.Bids = []BoardLevel{{Price: 100, Size: 7}}
+		book.ApplySnapshot(snapshot)
+		if book.ResyncCompleted(testBoard()) {
+			t.Error("ResyncCompleted after a websocket snapshot = true, want false")
+		}
+		if bid, _ := book.BestBid(); bid != (BoardLevel{Price: 100, Size: 7}) {
+			t.Errorf("BestBid = %+v, want the websocket snapshot", bid)
+		}
+	})
+
+	t.Run("discards the REST snapshot when diffs overflowed", func(t *testing.T) {
+		book := NewOrderBook("BTC_JPY")
+		book.ResyncStarted()
+		for i := 0; i <= maxPendingDiffs; i++ {
+			book.ApplyDiff(&Board{Bids: []BoardLevel{{Price: 100, Size: float64(i + 1)}}})
+		}
+		if book.ResyncCompleted(testBoard()) {
+			t.Error("ResyncCompleted after dropping diffs = true, want false")
+		}
+		if book.Synced() {
+			t.Error("Synced after dropping diffs = true, want false")
+		}
+		if book.ApplyDiff(&Board{Bids: []BoardLevel{{Price: 100, Size: 1}}}) {
+			t.Error("ApplyDiff after the discarded resync = true, want false")
+		}
+	})
+
+	t.Run("stays unsynced when a replayed diff crosses the book", func(t *testing.T) {
+		book := NewOrderBook("BTC_JPY")
+		book.ResyncStarted()
+		book.ApplyDiff(&Board{Bids: []BoardLevel{{Price: 101, Size: 1}}})
+		if book.ResyncCompleted(testBoard()) {
+			t.Error("ResyncCompleted with a crossed book = true, want false")
+		}
+		if book.Synced() {
+			t.Error("Synced with a crossed book = true, want false")
+		}
+	})
+
+	t.Run("failed resync waits before retrying", func(t *testing.T) {
+		book := NewOrderBook("BTC_JPY")
+		book.ResyncStarted()
+		book.ApplyDiff(&Board{Bids: []BoardLevel{{Price: 100, Size: 5}}})
+		book.ResyncFailed()
+		if book.ApplyDiff(&Board{Bids: []BoardLevel{{Price: 100, Size: 1}}}) {
+			t.Error("ApplyDiff after ResyncFailed = true, want false")
+		}
+		if book.ResyncStarted() {
+			t.Error("ResyncStarted within orderBookResyncInterval = true, want false")
+		}
+		book.ApplySnapshot(testBoard())
+		if bid, _ := book.BestBid(); bid != (BoardLevel{Price: 100, Size: 1}) {
+			t.Errorf("BestBid = %+v, want the snapshot without the dropped diffs", bid)
+		}
+	})
+}
+
+func TestOrderBookVWAP(t *testing.T) {
+	book := NewOrderBook("BTC_JPY")
+	book.ApplySnapshot(testBoard())
+	tests := []struct {
+		side      string
+		size      float64
+		wantPrice float64
+		wantOK    bool
+	}{
+		{side: "BUY", size: 1, wantPrice: 101, wantOK: true},
+		{side: "BUY", size: 2, wantPrice: 101.5, wantOK: true},
+		{side: "BUY", size: 4, wantOK: false},
+		{side: "SELL", size: 3, wantPrice: (100 + 99*2) / 3.0, wantOK: true},
+		{side: "SELL", size: 0, wantOK: false},
+	}
+	for _, tt := range tests {
+		price, ok := book.VWAP(tt.side, tt.size)
+		if price != tt.wantPrice || ok != tt.wantOK {
+			t.Errorf("VWAP(%s, %v) = %v, %v, want %v, %v", tt.side, tt.size, price, ok, tt.wantPrice, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ratelimit.go bitflyer の API 制限を超えないようにリクエストを調整するファイル
+
+// bitflyer の API 制限 (5分間あたりのリクエスト数)
+const (
+	rateLimitWindow      = 5 * time.Minute
+	defaultPublicLimit   = 500
+	defaultPrivateLimit  = 500
+	defaultOrderLimit    = 300
+	defaultMaxRetries    = 3
+	defaultRetryBaseWait = 500 * time.Millisecond
+)
+
+// 注文系のエンドポイント (Private の制限とは別に、より厳しい制限がかかる)
+var orderEndpoints = map[string]bool{
+	"me/sendchildorder":        true,
+	"me/cancelchildorder":      true,
+	"me/cancelallchildorders":  true,
+	"me/sendparentorder":       true,
+	"me/cancelparentorder":     true,
+	"me/cancelallparentorders": true,
+}
+
+// RateLimiter トークンバケットでリクエスト数を制限するStruct
+type RateLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	tokens   float64
+	perToken time.Duration
+	last     time.Time
+	now      func() time.Time
+}
+
+// window の間に limit 回までリクエストできる RateLimiter を返すfunction
+// limit が0以下の場合は制限しない
+func NewRateLimiter(limit int, window time.Duration, now func() time.Time) *RateLimiter {
+	if limit <= 0 {
+		return &RateLimiter{now: now}
+	}
+	return &RateLimiter{
+		limit:    float64(limit),
+		tokens:   float64(limit),
+		perToken: window / time.Duration(limit),
+		last:     now(),
+		now:      now,
+	}
+}
+
+// 制限しない RateLimiter か判定するfunction
+func (l *RateLimiter) unlimited() bool {
+	return l.limit <= 0
+}
+
+// 経過時間分のトークンを補充するfunction (mu をロックしてから呼ぶ)
+func (l *RateLimiter) refill() {
+	now := l.now()
+	elapsed := now.Sub(l.last)
+	if elapsed <= 0 {
+		return
+	}
+	l.tokens += float64(elapsed) / float64(l.perToken)
+	if l.tokens > l.limit {
+		l.tokens = l.limit
+	}
+	l.last = now
+}
+
+// トークンを1つ使うまで待つfunction (ctx がキャンセルされたらエラーを返す)
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l.unlimited() {
+		return ctx.Err()
+	}
+	for {
+		l.mu.Lock()
+		l.refill()
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) * float64(l.perToken))
+		l.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// 残りのリクエスト数を返すfunction (制限しない場合は math.MaxInt32)
+func (l *RateLimiter) Remaining() int {
+	if l.unlimited() {
+		return math.MaxInt32
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	return int(l.tokens)
+}
+
+// 5分間あたりのリクエスト数の上限を返すfunction
+func (l *RateLimiter) Limit() int {
+	return int(l.limit)
+}
+
+// RateLimitBudget Public / Private / 注文 それぞれの残りのリクエスト数を格納するStruct
+type RateLimitBudget struct {
+	Public  int
+	Private int
+	Order   int
+}
+
+// 残りのリクエスト数を返すfunction
+func (api *APIClient) RateLimitBudget() RateLimitBudget {
+	return RateLimitBudget{
+		Public:  api.publicLimiter.Remaining(),
+		Private: api.privateLimiter.Remaining(),
+		Order:   api.orderLimiter.Remaining(),
+	}
+}
+
+// Private API か注文の残りのリクエスト数が上限の ratio 未満になっているか判定するfunction
+func (api *APIClient) IsRateLimitLow(ratio float64) bool {
+	return float64(api.privateLimiter.Remaining()) < float64(api.privateLimiter.Limit())*ratio ||
+		float64(api.orderLimiter.Remaining()) < float64(api.orderLimiter.Limit())*ratio
+}
+
+// エンドポイントに応じて必要な RateLimiter のトークンを取るfunction
+func (api *APIClient) waitRateLimit(ctx context.Context, urlPath string) error {
+	if !strings.HasPrefix(urlPath, "me/") {
+		return api.publicLimiter.Wait(ctx)
+	}
+	if orderEndpoints[urlPath] {
+		if err := api.orderLimiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return api.privateLimiter.Wait(ctx)
+}
+
+// リトライしてよいエラーか判定するfunction
+// GET 以外はリトライすると二重に注文してしまう可能性があるのでリトライしない
+func shouldRetry(method string, err error) bool {
+	if method != http.MethodGet || err == nil {
+		return false
+	}
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return apiError.StatusCode == http.StatusTooManyRequests || apiError.StatusCode >= 500
+	}
+	// 通信エラーはリトライする
+	return true
+}
+
+// attempt 回目のリトライまでの待ち時間を返すfunction (指数的に増やしてジッターを加える)
+func (api *APIClient) retryWait(attempt int) time.Duration {
+	wait := api.retryBaseWait << uint(attempt)
+	return wait/2 + time.Duration(rand.Int63n(int64(wait)/2+1))
+}
+
+// 5分間あたりのリクエスト数の上限を変更する (0 で制限しない)
+func WithRateLimits(public, private, order int) Option {
+	return func(api *APIClient) {
+		api.publicLimit = public
+		api.privateLimit = private
+		api.orderLimit = order
+	}
+}
+
+// GET リクエストのリトライ回数と最初の待ち時間を変更する
+func WithRetry(maxRetries int, baseWait time.Duration) Option {
+	return func(api *APIClient) {
+		api.maxRetries = maxRetries
+		api.retryBaseWait = baseWait
+	}
+}
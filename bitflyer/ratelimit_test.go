@@ -0,0 +1,184 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock テストで進める時計
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int
+		take          int
+		advance       time.Duration
+		wantRemaining int
+	}{
+		{name: "full bucket", limit: 5, wantRemaining: 5},
+		{name: "takes tokens", limit: 5, take: 3, wantRemaining: 2},
+		{name: "refills one token per window/limit", limit: 5, take: 5, advance: time.Minute, wantRemaining: 1},
+		{name: "partial token is not available", limit: 5, take: 5, advance: 59 * time.Second, wantRemaining: 0},
+		{name: "refill is capped at the limit", limit: 5, take: 5, advance: time.Hour, wantRemaining: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: testNow}
+			limiter := NewRateLimiter(tt.limit, 5*time.Minute, clock.Now)
+			for i := 0; i < tt.take; i++ {
+				if err := limiter.Wait(context.Background()); err != nil {
+					t.Fatalf("Wait: %v", err)
+				}
+			}
+			clock.Advance(tt.advance)
+			if got := limiter.Remaining(); got != tt.wantRemaining {
+				t.Errorf("Remaining = %d, want %d", got, tt.wantRemaining)
+			}
+			if got := limiter.Limit(); got != tt.limit {
+				t.Errorf("Limit = %d, want %d", got, tt.limit)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWaitReturnsWhenCanceled(t *testing.T) {
+	limiter := NewRateLimiter(1, 5*time.Minute, (&fakeClock{now: testNow}).Now)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait on an empty bucket returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			limiter := NewRateLimiter(limit, 5*time.Minute, time.Now)
+			for i := 0; i < 1000; i++ {
+				if err := limiter.Wait(context.Background()); err != nil {
+					t.Fatalf("Wait: %v", err)
+				}
+			}
+			if got := limiter.Remaining(); got != math.MaxInt32 {
+				t.Errorf("Remaining = %d, want math.MaxInt32", got)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := limiter.Wait(ctx); !errors.Is(err, context.Canceled) {
+				t.Errorf("Wait with a canceled context returned %v, want context.Canceled", err)
+			}
+		})
+	}
+}
+
+func TestWaitRateLimit(t *testing.T) {
+	tests := []struct {
+		urlPath string
+		want    RateLimitBudget
+	}{
+		{urlPath: "board", want: RateLimitBudget{Public: 9, Private: 10, Order: 10}},
+		{urlPath: "me/getbalance", want: RateLimitBudget{Public: 10, Private: 9, Order: 10}},
+		{urlPath: "me/sendchildorder", want: RateLimitBudget{Public: 10, Private: 9, Order: 9}},
+		{urlPath: "me/cancelparentorder", want: RateLimitBudget{Public: 10, Private: 9, Order: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.urlPath, func(t *testing.T) {
+			api := New("key", "secret", WithRateLimits(10, 10, 10), WithClock((&fakeClock{now: testNow}).Now))
+			if err := api.waitRateLimit(context.Background(), tt.urlPath); err != nil {
+				t.Fatalf("waitRateLimit: %v", err)
+			}
+			if got := api.RateLimitBudget(); got != tt.want {
+				t.Errorf("RateLimitBudget = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRateLimitLow(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits [3]int
+		take   []string
+		want   bool
+	}{
+		{name: "full budget", limits: [3]int{10, 10, 10}, want: false},
+		{name: "private budget low", limits: [3]int{10, 10, 10}, take: []string{"me/getbalance", "me/getbalance", "me/getbalance", "me/getbalance", "me/getbalance", "me/getbalance", "me/getbalance", "me/getbalance"}, want: true},
+		{name: "order budget low", limits: [3]int{10, 100, 2}, take: []string{"me/sendchildorder", "me/sendchildorder"}, want: true},
+		{name: "public requests do not count", limits: [3]int{10, 10, 10}, take: []string{"board", "board", "board", "board", "board", "board", "board", "board"}, want: false},
+		{name: "unlimited", limits: [3]int{0, 0, 0}, take: []string{"me/sendchildorder"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New("key", "secret", WithRateLimits(tt.limits[0], tt.limits[1], tt.limits[2]), WithClock((&fakeClock{now: testNow}).Now))
+			for _, urlPath := range tt.take {
+				if err := api.waitRateLimit(context.Background(), urlPath); err != nil {
+					t.Fatalf("waitRateLimit: %v", err)
+				}
+			}
+			if got := api.IsRateLimitLow(0.3); got != tt.want {
+				t.Errorf("IsRateLimitLow(0.3) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		err    error
+		want   bool
+	}{
+		{name: "no error", method: "GET", err: nil, want: false},
+		{name: "network error", method: "GET", err: errors.New("connection reset"), want: true},
+		{name: "too many requests", method: "GET", err: &APIError{StatusCode: 429}, want: true},
+		{name: "server error", method: "GET", err: &APIError{StatusCode: 502}, want: true},
+		{name: "wrapped server error", method: "GET", err: fmt.Errorf("wrapped: %w", &APIError{StatusCode: 500}), want: true},
+		{name: "client error", method: "GET", err: &APIError{StatusCode: 400, Status: -200}, want: false},
+		{name: "error in a 200 body", method: "GET", err: &APIError{StatusCode: 200, Status: -2}, want: false},
+		{name: "POST server error", method: "POST", err: &APIError{StatusCode: 500}, want: false},
+		{name: "POST network error", method: "POST", err: errors.New("connection reset"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRetry(tt.method, tt.err); got != tt.want {
+				t.Errorf("shouldRetry(%s, %v) = %v, want %v", tt.method, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	api := New("key", "secret", WithRetry(3, 100*time.Millisecond))
+	for attempt := 0; attempt < 4; attempt++ {
+		wait := api.retryWait(attempt)
+		base := 100 * time.Millisecond << uint(attempt)
+		if wait < base/2 || wait > base {
+			t.Errorf("retryWait(%d) = %s, want between %s and %s", attempt, wait, base/2, base)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// realtime.go Realtime API (JSON-RPC 2.0 over WebSocket) の接続を管理するファイル
+
+type JsonRPC2 struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	Result  interface{} `json:"result,omitempty"`
+	Id      *int        `json:"id,omitempty"`
+}
+
+type SubscribeParams struct {
+	Channel string `json:"channel"`
+}
+
+// channelMessage 購読しているチャネルから届くメッセージを格納するStruct
+type channelMessage struct {
+	Channel string          `json:"channel"`
+	Message json.RawMessage `json:"message"`
+}
+
+// rpcMessage サーバーから届く JSON-RPC のメッセージを格納するStruct
+type rpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+	Id      *int            `json:"id"`
+}
+
+// rpcError JSON-RPC のエラーを格納するStruct
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// auth リクエストに付ける ID
+const authRequestID = 1
+
+// Private チャネルのイベントの種類
+const (
+	EventOrder        = "ORDER"
+	EventOrderFailed  = "ORDER_FAILED"
+	EventCancel       = "CANCEL"
+	EventCancelFailed = "CANCEL_FAILED"
+	EventExecution    = "EXECUTION"
+	EventExpire       = "EXPIRE"
+	EventTrigger      = "TRIGGER"
+	EventComplete     = "COMPLETE"
+)
+
+// ChildOrderEvent child_order_events で届く注文のイベントを格納するStruct
+type ChildOrderEvent struct {
+	ProductCode            string  `json:"product_code"`
+	ChildOrderID           string  `json:"child_order_id"`
+	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
+	EventDate              string  `json:"event_date"`
+	EventType              string  `json:"event_type"`
+	ChildOrderType         string  `json:"child_order_type"`
+	ExpireDate             string  `json:"expire_date"`
+	Reason                 string  `json:"reason"`
+	ExecID                 int     `json:"exec_id"`
+	Side                   string  `json:"side"`
+	Price                  float64 `json:"price"`
+	Size                   float64 `json:"size"`
+	Commission             float64 `json:"commission"`
+	Sfd                    float64 `json:"sfd"`
+	OutstandingSize        float64 `json:"outstanding_size"`
+}
+
+// イベントが起きた時間を取得するfunction
+func (e *ChildOrderEvent) DateTime() time.Time {
+	return parseTime(e.EventDate)
+}
+
+// ParentOrderEvent parent_order_events で届く特殊注文のイベントを格納するStruct
+type ParentOrderEvent struct {
+	ProductCode             string  `json:"product_code"`
+	ParentOrderID           string  `json:"parent_order_id"`
+	ParentOrderAcceptanceID string  `json:"parent_order_acceptance_id"`
+	EventDate               string  `json:"event_date"`
+	EventType               string  `json:"event_type"`
+	ParentOrderType         string  `json:"parent_order_type"`
+	Reason                  string  `json:"reason"`
+	ChildOrderType          string  `json:"child_order_type"`
+	ParameterIndex          int     `json:"parameter_index"`
+	ChildOrderAcceptanceID  string  `json:"child_order_acceptance_id"`
+	Side                    string  `json:"side"`
+	Price                   float64 `json:"price"`
+	Size                    float64 `json:"size"`
+	ExpireDate              string  `json:"expire_date"`
+}
+
+// イベントが起きた時間を取得するfunction
+func (e *ParentOrderEvent) DateTime() time.Time {
+	return parseTime(e.EventDate)
+}
+
+// ConnectionState WebSocket の接続状態
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "CONNECTING"
+	case StateConnected:
+		return "CONNECTED"
+	case StateDisconnected:
+		return "DISCONNECTED"
+	case StateClosed:
+		return "CLOSED"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// ConnectionEvent 接続状態が変わった時に通知するStruct
+type ConnectionEvent struct {
+	State ConnectionState
+	Err   error
+	Time  time.Time
+}
+
+// ErrStaleData 一定時間チャネルのメッセージが届かなかった時のエラー
+var ErrStaleData = errors.New("bitflyer: no channel message within stale timeout")
+
+// ErrAuthFailed Realtime API の認証に失敗した時のエラー
+var ErrAuthFailed = errors.New("bitflyer: realtime auth failed")
+
+// Stream 切断時の再接続と再購読を自動で行う Realtime API の接続
+type Stream struct {
+	api *APIClient
+
+	// 再接続の待ち時間 (BackoffMin から倍々にして BackoffMax で止める)
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// Ping を送る間隔と、Pong やメッセージが途絶えたとみなすまでの時間
+	PingInterval time.Duration
+	ReadTimeout  time.Duration
+	// 接続は生きているがチャネルのメッセージが届かない時に再接続するまでの時間
+	StaleTimeout time.Duration
+
+	mu       sync.Mutex
+	channels []string
+	handlers map[string]func(json.RawMessage)
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	states   chan ConnectionEvent
+	done     chan struct{}
+	closed   bool
+
+	// 接続(再接続)するたびに購読の前に呼ばれる function
+	onConnect []func()
+	// Private チャネルを購読する場合は接続のたびに auth を行う
+	private bool
+}
+
+// Stream のStructを返すfunction
+func (api *APIClient) NewStream() *Stream {
+	return &Stream{
+		api:          api,
+		BackoffMin:   time.Second,
+		BackoffMax:   time.Minute,
+		PingInterval: 15 * time.Second,
+		ReadTimeout:  45 * time.Second,
+		StaleTimeout: time.Minute,
+		handlers:     map[string]func(json.RawMessage){},
+		states:       make(chan ConnectionEvent, 16),
+		done:         make(chan struct{}),
+	}
+}
+
+// 接続状態の変化を受け取るチャネルを返すfunction
+func (s *Stream) States() <-chan ConnectionEvent {
+	return s.states
+}
+
+// チャネルを購読するfunction (再接続した時も自動で購読し直す)
+func (s *Stream) Subscribe(channel string, handler func(json.RawMessage)) {
+	s.mu.Lock()
+	if _, ok := s.handlers[channel]; !ok {
+		s.channels = append(s.channels, channel)
+	}
+	s.handlers[channel] = handler
+	conn := s.conn
+	s.mu.Unlock()
+
+	// 既に接続済みの場合はその場で購読する
+	if conn != nil {
+		if err := s.writeJSON(conn, &JsonRPC2{Version: "2.0", Method: "subscribe", Params: &SubscribeParams{channel}}); err != nil {
+			log.Printf("action=Subscribe channel=%s err=%s", channel, err.Error())
+		}
+	}
+}
+
+// Ticker のチャネルを購読して ch に送信するfunction
+func (s *Stream) SubscribeTicker(symbol string, ch chan<- Ticker) {
+	channel := fmt.Sprintf("lightning_ticker_%s", symbol)
+	s.Subscribe(channel, func(message json.RawMessage) {
+		var ticker Ticker
+		if err := json.Unmarshal(message, &ticker); err != nil {
+			log.Printf("action=SubscribeTicker err=%s", err.Error())
+			return
+		}
+		select {
+		case ch <- ticker:
+		case <-s.done:
+		}
+	})
+}
+
+// 約定のチャネルを購読して ch に送信するfunction
+func (s *Stream) SubscribeExecutions(symbol string, ch chan<- []Execution) {
+	channel := fmt.Sprintf("lightning_executions_%s", symbol)
+	s.Subscribe(channel, func(message json.RawMessage) {
+		var executions []Execution
+		if err := json.Unmarshal(message, &executions); err != nil {
+			log.Printf("action=SubscribeExecutions err=%s", err.Error())
+			return
+		}
+		select {
+		case ch <- executions:
+		case <-s.done:
+		}
+	})
+}
+
+// 板のスナップショットと差分のチャネルを購読して book を更新し続けるfunction
+// 再接続した時と差分の取りこぼしを見つけた時は、REST で板を取り直すまで板を使わない
+func (s *Stream) SubscribeOrderBook(symbol string, book *OrderBook) {
+	s.mu.Lock()
+	s.onConnect = append(s.onConnect, func() { s.resyncOrderBook(symbol, book) })
+	s.mu.Unlock()
+
+	s.Subscribe(fmt.Sprintf("lightning_board_snapshot_%s", symbol), func(message json.RawMessage) {
+		var board Board
+		if err := json.Unmarshal(message, &board); err != nil {
+			log.Printf("action=SubscribeOrderBook err=%s", err.Error())
+			return
+		}
+		book.ApplySnapshot(&board)
+	})
+	s.Subscribe(fmt.Sprintf("lightning_board_%s", symbol), func(message json.RawMessage) {
+		var board Board
+		if err := json.Unmarshal(message, &board); err != nil {
+			log.Printf("action=SubscribeOrderBook err=%s", err.Error())
+			return
+		}
+		if !book.ApplyDiff(&board) {
+			s.resyncOrderBook(symbol, book)
+		}
+	})
+}
+
+// REST で取得した板のスナップショットで book を取り直すfunction (読み込みを止めないように別の goroutine で行う)
+func (s *Stream) resyncOrderBook(symbol string, book *OrderBook) {
+	if !book.ResyncStarted() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.ReadTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-s.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		board, err := s.api.GetBoardContext(ctx, symbol)
+		if err != nil {
+			log.Printf("action=resyncOrderBook product_code=%s err=%s", symbol, err.Error())
+			book.ResyncFailed()
+			return
+		}
+		if book.ResyncCompleted(board) {
+			log.Printf("action=resyncOrderBook product_code=%s status=synced", symbol)
+		}
+	}()
+}
+
+// 自分の注文のイベントを購読して ch に送信するfunction (auth が必要)
+func (s *Stream) SubscribeChildOrderEvents(ch chan<- []ChildOrderEvent) {
+	s.mu.Lock()
+	s.private = true
+	s.mu.Unlock()
+	s.Subscribe("child_order_events", func(message json.RawMessage) {
+		var events []ChildOrderEvent
+		if err := json.Unmarshal(message, &events); err != nil {
+			log.Printf("action=SubscribeChildOrderEvents err=%s", err.Error())
+			return
+		}
+		select {
+		case ch <- events:
+		case <-s.done:
+		}
+	})
+}
+
+// 自分の特殊注文のイベントを購読して ch に送信するfunction (auth が必要)
+func (s *Stream) SubscribeParentOrderEvents(ch chan<- []ParentOrderEvent) {
+	s.mu.Lock()
+	s.private = true
+	s.mu.Unlock()
+	s.Subscribe("parent_order_events", func(message json.RawMessage) {
+		var events []ParentOrderEvent
+		if err := json.Unmarshal(message, &events); err != nil {
+			log.Printf("action=SubscribeParentOrderEvents err=%s", err.Error())
+			return
+		}
+		select {
+		case ch <- events:
+		case <-s.done:
+		}
+	})
+}
+
+// 接続を閉じて Run を終了させるfunction
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *Stream) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// 接続状態を通知するfunction (受け取り側が詰まっていても Stream は止めない)
+func (s *Stream) emit(state ConnectionState, err error) {
+	event := ConnectionEvent{State: state, Err: err, Time: s.api.now()}
+	select {
+	case s.states <- event:
+	default:
+		log.Printf("action=Stream.emit status=dropped event=%+v", event)
+	}
+}
+
+func (s *Stream) writeJSON(conn *websocket.Conn, v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return conn.WriteJSON(v)
+}
+
+// ctx がキャンセルされるか Close されるまで接続と再接続を繰り返すfunction
+func (s *Stream) RunContext(ctx context.Context) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-stop:
+		}
+	}()
+	s.Run()
+}
+
+// Close されるまで接続と再接続を繰り返すfunction
+func (s *Stream) Run() {
+	backoff := s.BackoffMin
+	for !s.isClosed() {
+		s.emit(StateConnecting, nil)
+		connected, err := s.connectAndRead()
+		if s.isClosed() {
+			break
+		}
+		log.Printf("action=Stream.Run status=disconnected err=%v", err)
+		s.emit(StateDisconnected, err)
+
+		// 一度接続できていれば待ち時間をリセットする
+		if connected {
+			backoff = s.BackoffMin
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+		}
+		backoff *= 2
+		if backoff > s.BackoffMax {
+			backoff = s.BackoffMax
+		}
+	}
+	s.emit(StateClosed, nil)
+	close(s.states)
+}
+
+// 接続してチャネルを購読し、切断されるまでメッセージを読み続けるfunction
+func (s *Stream) connectAndRead() (connected bool, err error) {
+	log.Printf("connecting to %s", s.api.webSocketURL)
+	header := http.Header{}
+	if s.api.userAgent != "" {
+		header.Set("User-Agent", s.api.userAgent)
+	}
+	// 接続中に Close された場合も待たずに終了できるようにする
+	dialCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-dialCtx.Done():
+		}
+	}()
+	conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, s.api.webSocketURL, header)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return false, nil
+	}
+	s.conn = conn
+	channels := append([]string(nil), s.channels...)
+	onConnect := append([]func(){}, s.onConnect...)
+	private := s.private
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for _, fn := range onConnect {
+		fn()
+	}
+	// Private チャネルは購読する前に認証しておく必要がある
+	if private {
+		if err := s.authenticate(conn); err != nil {
+			return false, err
+		}
+	}
+	for _, channel := range channels {
+		if err := s.writeJSON(conn, &JsonRPC2{Version: "2.0", Method: "subscribe", Params: &SubscribeParams{channel}}); err != nil {
+			return false, err
+		}
+	}
+	s.emit(StateConnected, nil)
+
+	// 接続の期限やデータの途絶えは実際の時間で判定する (WithClock の時計は記録する時間にだけ使う)
+	// Pong が返ってくる度に読み込みの期限を延ばす
+	conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	})
+
+	var lastMu sync.Mutex
+	lastMessage := time.Now()
+	var staleErr error
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Ping の送信と、データが途絶えていないかの監視を行う
+	go func() {
+		ping := time.NewTicker(s.PingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ping.C:
+				lastMu.Lock()
+				stale := time.Now().Sub(lastMessage) > s.StaleTimeout
+				if stale {
+					staleErr = ErrStaleData
+				}
+				lastMu.Unlock()
+				if stale {
+					conn.Close()
+					return
+				}
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.PingInterval)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		message := new(rpcMessage)
+		if err := conn.ReadJSON(message); err != nil {
+			lastMu.Lock()
+			defer lastMu.Unlock()
+			if staleErr != nil {
+				return true, staleErr
+			}
+			return true, err
+		}
+		conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+
+		if message.Method != "channelMessage" {
+			continue
+		}
+		var params channelMessage
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			log.Printf("action=Stream.read err=%s", err.Error())
+			continue
+		}
+		lastMu.Lock()
+		lastMessage = time.Now()
+		lastMu.Unlock()
+
+		s.mu.Lock()
+		handler := s.handlers[params.Channel]
+		s.mu.Unlock()
+		if handler != nil {
+			handler(params.Message)
+		}
+	}
+}
+
+// auth を送信して、結果が返ってくるまで待つfunction
+func (s *Stream) authenticate(conn *websocket.Conn) error {
+	params, err := s.api.authParams()
+	if err != nil {
+		return err
+	}
+	id := authRequestID
+	if err := s.writeJSON(conn, &JsonRPC2{Version: "2.0", Method: "auth", Params: params, Id: &id}); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	for {
+		message := new(rpcMessage)
+		if err := conn.ReadJSON(message); err != nil {
+			return err
+		}
+		if message.Id == nil || *message.Id != id {
+			continue
+		}
+		if message.Error != nil {
+			return fmt.Errorf("%w: %s", ErrAuthFailed, message.Error.Message)
+		}
+		var ok bool
+		if err := json.Unmarshal(message.Result, &ok); err != nil || !ok {
+			return ErrAuthFailed
+		}
+		return nil
+	}
+}
+
+// JSON-RPC 2.0 over WebSocket APIでリアルタイムでTickerを取得するためのfunction
+// 切断された場合は自動で再接続し、ctx がキャンセルされたら終了する
+func (api *APIClient) GetRealTimeTickerContext(ctx context.Context, symbol string, ch chan<- Ticker) {
+	stream := api.NewStream()
+	stream.SubscribeTicker(symbol, ch)
+	stream.RunContext(ctx)
+}
+
+// GetRealTimeTicker は GetRealTimeTickerContext を context.Background() で呼ぶfunction
+func (api *APIClient) GetRealTimeTicker(symbol string, ch chan<- Ticker) {
+	api.GetRealTimeTickerContext(context.Background(), symbol, ch)
+}
@@ -0,0 +1,234 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// テストで接続状態やメッセージを待つ時間の上限
+const testTimeout = 5 * time.Second
+
+// クライアントから届いた JSON-RPC のリクエストを読み込むfunction
+func readRequest(conn *websocket.Conn) (*rpcMessage, error) {
+	message := new(rpcMessage)
+	if err := conn.ReadJSON(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// subscribe のリクエストを読み込んで、購読したチャネルを返すfunction
+func readSubscribe(conn *websocket.Conn) (string, error) {
+	message, err := readRequest(conn)
+	if err != nil {
+		return "", err
+	}
+	var params SubscribeParams
+	if message.Method != "subscribe" {
+		return "", errors.New("unexpected method " + message.Method)
+	}
+	if err := json.Unmarshal(message.Params, &params); err != nil {
+		return "", err
+	}
+	return params.Channel, nil
+}
+
+// チャネルのメッセージを送るfunction
+func sendChannelMessage(conn *websocket.Conn, channel string, message interface{}) error {
+	return conn.WriteJSON(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "channelMessage",
+		"params":  map[string]interface{}{"channel": channel, "message": message},
+	})
+}
+
+// クライアントが切断するまで読み捨てるfunction
+func drain(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// テスト用に待ち時間を短くした Stream を返すfunction (テストが終わったら閉じる)
+func newTestStream(t *testing.T, api *APIClient) *Stream {
+	t.Helper()
+	stream := api.NewStream()
+	stream.BackoffMin = 10 * time.Millisecond
+	stream.BackoffMax = 20 * time.Millisecond
+	t.Cleanup(stream.Close)
+	return stream
+}
+
+// want の接続状態が届くまで待って返すfunction
+func waitState(t *testing.T, stream *Stream, want ConnectionState) ConnectionEvent {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-stream.States():
+			if !ok {
+				t.Fatalf("States closed before %s", want)
+			}
+			if event.State == want {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestStreamResubscribesAfterReconnect(t *testing.T) {
+	var mu sync.Mutex
+	var subscribed []string
+	connections := 0
+	f := newFakeBitflyer(t, nil, func(conn *websocket.Conn) {
+		mu.Lock()
+		connections++
+		first := connections == 1
+		mu.Unlock()
+		channel, err := readSubscribe(conn)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		subscribed = append(subscribed, channel)
+		mu.Unlock()
+		sendChannelMessage(conn, channel, Ticker{ProductCode: "BTC_JPY", Ltp: 100})
+		// 1回目の接続はすぐに切断する
+		if first {
+			return
+		}
+		drain(conn)
+	})
+	stream := newTestStream(t, f.client())
+	ch := make(chan Ticker, 2)
+	stream.SubscribeTicker("BTC_JPY", ch)
+	go stream.Run()
+
+	waitState(t, stream, StateConnected)
+	waitState(t, stream, StateDisconnected)
+	waitState(t, stream, StateConnected)
+	for i := 0; i < 2; i++ {
+		select {
+		case ticker := <-ch:
+			if ticker.ProductCode != "BTC_JPY" || ticker.Ltp != 100 {
+				t.Errorf("ticker = %+v, want BTC_JPY at 100", ticker)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for ticker #%d", i)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"lightning_ticker_BTC_JPY", "lightning_ticker_BTC_JPY"}
+	if len(subscribed) != 2 || subscribed[0] != want[0] || subscribed[1] != want[1] {
+		t.Errorf("subscribed = %v, want %v", subscribed, want)
+	}
+}
+
+func TestStreamSubscribeOrderBook(t *testing.T) {
+	f := newFakeBitflyer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/board" || r.URL.Query().Get("product_code") != "BTC_JPY" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(testBoard())
+	}, func(conn *websocket.Conn) {
+		for {
+			channel, err := readSubscribe(conn)
+			if err != nil {
+				return
+			}
+			if channel == "lightning_board_BTC_JPY" {
+				break
+			}
+		}
+		// REST の板を取り直している途中に届いても、取り直した板に当て直される
+		sendChannelMessage(conn, "lightning_board_BTC_JPY", &Board{Bids: []BoardLevel{{Price: 100, Size: 5}}})
+		drain(conn)
+	})
+	stream := newTestStream(t, f.client())
+	book := NewOrderBook("BTC_JPY")
+	stream.SubscribeOrderBook("BTC_JPY", book)
+	go stream.Run()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		bid, _ := book.BestBid()
+		ask, _ := book.BestAsk()
+		if book.Synced() && bid == (BoardLevel{Price: 100, Size: 5}) && ask == (BoardLevel{Price: 101, Size: 1}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order book synced=%v bid=%+v ask=%+v, want the REST snapshot with the diff", book.Synced(), bid, ask)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr error
+	}{
+		{name: "valid signature", secret: "secret"},
+		{name: "invalid signature", secret: "other", wantErr: ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subscribed := make(chan string, 1)
+			f := newFakeBitflyer(t, nil, func(conn *websocket.Conn) {
+				message, err := readRequest(conn)
+				if err != nil || message.Method != "auth" || message.Id == nil {
+					return
+				}
+				var params AuthParams
+				json.Unmarshal(message.Params, &params)
+				reply := map[string]interface{}{"jsonrpc": "2.0", "id": *message.Id}
+				if params.APIKey == "key" && params.Signature == sign(tt.secret, strconv.FormatInt(params.Timestamp, 10)+params.Nonce) {
+					reply["result"] = true
+				} else {
+					reply["error"] = map[string]interface{}{"code": -32000, "message": "invalid signature"}
+				}
+				if err := conn.WriteJSON(reply); err != nil {
+					return
+				}
+				if channel, err := readSubscribe(conn); err == nil {
+					subscribed <- channel
+				}
+				drain(conn)
+			})
+			stream := newTestStream(t, f.client())
+			stream.SubscribeChildOrderEvents(make(chan []ChildOrderEvent))
+			go stream.Run()
+
+			if tt.wantErr != nil {
+				event := waitState(t, stream, StateDisconnected)
+				if !errors.Is(event.Err, tt.wantErr) {
+					t.Errorf("disconnected with %v, want %v", event.Err, tt.wantErr)
+				}
+				return
+			}
+			waitState(t, stream, StateConnected)
+			select {
+			case channel := <-subscribed:
+				if channel != "child_order_events" {
+					t.Errorf("subscribed %q after auth, want child_order_events", channel)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("timed out waiting for subscribe after auth")
+			}
+		})
+	}
+}
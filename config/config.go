@@ -3,6 +3,10 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/ini.v1"
@@ -10,49 +14,175 @@ import (
 
 // ConfigList はAPIの情報が入った構造体
 type ConfigList struct {
-	APIKey      string
-	APISecret   string
-	LogFile     string
-	ProductCode string
+	APIKey       string
+	APISecret    string
+	BaseURL      string
+	WebSocketURL string
+	LogFile      string
+	ProductCode  string
+	ProductCodes []string
+	CandleSource string
+	PriceSources map[string]string
 
 	TradeDuration time.Duration
 	Durations     map[string]time.Duration
+	DurationNames []string
 	DbName        string
 	SQLDriver     string
 	Port          int
 
+	Retentions      map[string]time.Duration
+	CompactInterval time.Duration
+	VacuumInterval  time.Duration
+
 	BackTest         bool
 	UsePercent       float64
 	DataLimit        int
 	StopLimitPercent float64
 	NumRanking       int
+
+	UseSpecialOrder   bool
+	TakeProfitPercent float64
+
+	MaxSlippagePercent float64
+
+	BackfillHours int
+
+	MarginTrading bool
+	Leverage      float64
+
+	FillGaps bool
+
+	BackTestFill string
+
+	BackTestFrom time.Time
+	BackTestTo   time.Time
 }
 
 var Config ConfigList
 
+// configFile はリポジトリの外から起動した場合の config.ini のパス
+const configFile = "backend-2-go-fintech/Section20/config.ini"
+
+// config.ini のパスを返すfunction
+// configFile が無い場合は、カレントディレクトリから親のディレクトリに向かって config.ini を探す
+// (go test はパッケージのディレクトリで実行されるため)
+func findConfigFile() string {
+	if _, err := os.Stat(configFile); err == nil {
+		return configFile
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return configFile
+	}
+	for {
+		path := filepath.Join(dir, "config.ini")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return configFile
+		}
+		dir = parent
+	}
+}
+
+// Path config.ini と同じディレクトリからの相対パスを、実行しているディレクトリから開けるパスに変換するfunction
+func Path(name string) string {
+	return filepath.Join(filepath.Dir(findConfigFile()), name)
+}
+
 // config.ini の読み込み処理
 func init() {
 	// ファイルが読み込めない場合
-	cfg, err := ini.Load("backend-2-go-fintech/Section20/config.ini")
+	cfg, err := ini.Load(findConfigFile())
 	if err != nil {
 		log.Printf("Failed to read file: %v", err)
 		os.Exit(1)
 	}
 
-	// 1h,1m,1s毎のキャンドルスティック(ビットコインの値動きの情報を)取得するdurationsを作成
-	durations := map[string]time.Duration{
-		"1s": time.Second,
-		"1m": time.Minute,
-		"1h": time.Hour,
+	// durations に書いた 1s, 5m, 4h, 1d, 1w などの期間ごとにキャンドルスティック(ビットコインの値動きの情報を)作成する
+	durations := map[string]time.Duration{}
+	var durationNames []string
+	for _, name := range cfg.Section("gotrading").Key("durations").Strings(",") {
+		duration, err := parseDuration(name)
+		if err != nil || duration <= 0 {
+			log.Printf("action=config.init invalid duration=%s", name)
+			continue
+		}
+		// 1分より長い期間は1分足からまとめて作るので、1分の倍数でなければならない
+		if duration > time.Minute && duration%time.Minute != 0 {
+			log.Printf("action=config.init duration=%s is not a multiple of 1m", name)
+			continue
+		}
+		durations[name] = duration
+		durationNames = append(durationNames, name)
+	}
+	if len(durations) == 0 {
+		durations = map[string]time.Duration{
+			"1s": time.Second,
+			"1m": time.Minute,
+			"1h": time.Hour,
+		}
+		durationNames = []string{"1s", "1m", "1h"}
+	}
+	// チャートのボタンなどで短い順に並べられるようにする
+	sort.Slice(durationNames, func(i, j int) bool {
+		return durations[durationNames[i]] < durations[durationNames[j]]
+	})
+
+	// 複数の商品をカンマ区切りで指定できる。product_codes が無い場合は product_code の1つだけを使う
+	productCodes := cfg.Section("gotrading").Key("product_codes").Strings(",")
+	if len(productCodes) == 0 {
+		productCodes = []string{cfg.Section("gotrading").Key("product_code").String()}
+	}
+
+	// Ticker からキャンドルを作る時の価格の種類。price_sources で商品ごとに上書きできる (例: BTC_JPY:ltp, FX_BTC_JPY:microprice)
+	priceSourceNames := []string{"mid", "ltp", "bid", "ask", "microprice"}
+	defaultPriceSource := cfg.Section("gotrading").Key("price_source").In("mid", priceSourceNames)
+	priceSources := map[string]string{}
+	for _, productCode := range productCodes {
+		priceSources[productCode] = defaultPriceSource
+	}
+	for _, pair := range cfg.Section("gotrading").Key("price_sources").Strings(",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || !containsString(priceSourceNames, parts[1]) {
+			log.Printf("action=config.init invalid price_sources=%s", pair)
+			continue
+		}
+		priceSources[parts[0]] = parts[1]
+	}
+
+	// 期間ごとにキャンドルを残す長さ (例: 1s:7d, 1m:365d)。指定しない期間はずっと残す
+	retentions := map[string]time.Duration{}
+	for _, pair := range cfg.Section("db").Key("retention").Strings(",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			log.Printf("action=config.init invalid retention=%s", pair)
+			continue
+		}
+		keep, err := parseDuration(parts[1])
+		if _, ok := durations[parts[0]]; !ok || err != nil || keep <= 0 {
+			log.Printf("action=config.init invalid retention=%s", pair)
+			continue
+		}
+		retentions[parts[0]] = keep
 	}
 
 	// durations の情報を追加
 	Config = ConfigList{
 		APIKey:           cfg.Section("bitflyer").Key("api_key").String(),
 		APISecret:        cfg.Section("bitflyer").Key("api_secret").String(),
+		BaseURL:          cfg.Section("bitflyer").Key("base_url").String(),
+		WebSocketURL:     cfg.Section("bitflyer").Key("ws_url").String(),
 		LogFile:          cfg.Section("gotrading").Key("log_file").String(),
-		ProductCode:      cfg.Section("gotrading").Key("product_code").String(),
+		ProductCode:      productCodes[0],
+		ProductCodes:     productCodes,
+		CandleSource:     cfg.Section("gotrading").Key("candle_source").In("ticker", []string{"ticker", "executions"}),
+		PriceSources:     priceSources,
 		Durations:        durations,
+		DurationNames:    durationNames,
 		TradeDuration:    durations[cfg.Section("gotrading").Key("trade_duration").String()],
 		DbName:           cfg.Section("db").Key("name").String(),
 		SQLDriver:        cfg.Section("db").Key("driver").String(),
@@ -62,5 +192,80 @@ func init() {
 		DataLimit:        cfg.Section("gotrading").Key("data_limit").MustInt(),
 		StopLimitPercent: cfg.Section("gotrading").Key("stop_limit_percent").MustFloat64(),
 		NumRanking:       cfg.Section("gotrading").Key("num_ranking").MustInt(),
+		// IFDOCO で利確と損切りを取引所に任せるかどうか
+		UseSpecialOrder:   cfg.Section("gotrading").Key("use_special_order").MustBool(false),
+		TakeProfitPercent: cfg.Section("gotrading").Key("take_profit_percent").MustFloat64(1.1),
+		// 板から見積もった成行注文の滑りがこの割合を超えたら注文しない (0 で無効)
+		MaxSlippagePercent: cfg.Section("gotrading").Key("max_slippage_percent").MustFloat64(0),
+		// 起動時に直近何時間分のキャンドルを約定履歴から作り直すか (0 で無効)
+		BackfillHours: cfg.Section("gotrading").Key("backfill_hours").MustInt(0),
+		// 証拠金取引 (FX_BTC_JPY など) で売りシグナルからショートを建てるかどうか
+		MarginTrading: cfg.Section("gotrading").Key("margin_trading").MustBool(false),
+		Leverage:      cfg.Section("gotrading").Key("leverage").MustFloat64(2),
+		// Tick が無かった期間を前の終値の出来高0のキャンドルで埋めるかどうか
+		FillGaps: cfg.Section("gotrading").Key("fill_gaps").MustBool(false),
+		// バックテストで終値 (close) で約定させるか、記録した売り気配で買い・買い気配で売る (quote) か
+		BackTestFill: cfg.Section("gotrading").Key("back_test_fill").In("close", []string{"close", "quote"}),
+		Retentions:   retentions,
+		// 古いキャンドルをまとめて削除する間隔と、VACUUM / ANALYZE する間隔 (0 で無効)
+		CompactInterval: mustParseDuration(cfg.Section("db").Key("compact_interval").String()),
+		VacuumInterval:  mustParseDuration(cfg.Section("db").Key("vacuum_interval").String()),
+		// バックテストでパラメータを最適化する期間 (RFC3339、空の場合は直近の data_limit 本)
+		BackTestFrom: mustParseTime(cfg.Section("gotrading").Key("back_test_from").String()),
+		BackTestTo:   mustParseTime(cfg.Section("gotrading").Key("back_test_to").String()),
+	}
+}
+
+// BackTestRange バックテストで期間を指定しているか判定するfunction
+func (c *ConfigList) BackTestRange() bool {
+	return c.BackTest && (!c.BackTestFrom.IsZero() || !c.BackTestTo.IsZero())
+}
+
+// values に value が含まれているか判定するfunction
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDuration で変換できない場合は0を返すfunction
+func mustParseDuration(name string) time.Duration {
+	if name == "" {
+		return 0
+	}
+	duration, err := parseDuration(name)
+	if err != nil {
+		log.Printf("action=config.init invalid duration=%s", name)
+		return 0
+	}
+	return duration
+}
+
+// RFC3339 の時間に変換できない場合はゼロ値を返すfunction
+func mustParseTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Printf("action=config.init invalid time=%s", value)
+		return time.Time{}
+	}
+	return t
+}
+
+// 5m, 4h のような time.ParseDuration の形式に加えて、1d (日) と 1w (週) を time.Duration に変換するfunction
+func parseDuration(name string) (time.Duration, error) {
+	switch {
+	case strings.HasSuffix(name, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(name, "d"))
+		return time.Duration(days) * 24 * time.Hour, err
+	case strings.HasSuffix(name, "w"):
+		weeks, err := strconv.Atoi(strings.TrimSuffix(name, "w"))
+		return time.Duration(weeks) * 7 * 24 * time.Hour, err
 	}
+	return time.ParseDuration(name)
 }
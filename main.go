@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/app/controllers"
@@ -11,16 +16,354 @@ import (
 	"github.com/gemcook/gop50k-training/backend-2-go-fintech/Section20/utils"
 )
 
+// backfill サブコマンドで指定した範囲のキャンドルを作り直す function
+// 例: go run main.go backfill -from 2020-01-01T00:00:00Z -to 2020-01-02T00:00:00Z [-product BTC_JPY] [-file executions.json]
+func runBackfill(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := flags.String("from", "", "start time (RFC3339)")
+	to := flags.String("to", "", "end time (RFC3339, default now)")
+	product := flags.String("product", "", "product code (default all product_codes)")
+	file := flags.String("file", "", "execution dump file (JSON lines) instead of the API")
+	flags.Parse(args)
+
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("action=runBackfill err=%s", err.Error())
+	}
+	end := time.Now()
+	if *to != "" {
+		end, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatalf("action=runBackfill err=%s", err.Error())
+		}
+	}
+	productCodes := config.Config.ProductCodes
+	if *product != "" {
+		productCodes = []string{*product}
+	} else if *file != "" {
+		// ファイルの約定履歴は1つの商品分なので、デフォルトの商品として扱う
+		productCodes = []string{config.Config.ProductCode}
+	}
+	for _, productCode := range productCodes {
+		if err := controllers.Backfill(ctx, productCode, start, end, *file); err != nil {
+			log.Fatalf("action=runBackfill product_code=%s err=%s", productCode, err.Error())
+		}
+	}
+}
+
+// rebuild サブコマンドで1分足から上位の期間のキャンドルを作り直す function
+// 例: go run main.go rebuild [-product BTC_JPY] [-duration 1h] [-from 2020-01-01T00:00:00Z] [-to 2020-01-02T00:00:00Z]
+func runRebuild(args []string) {
+	flags := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	product := flags.String("product", "", "product code (default all product_codes)")
+	durationName := flags.String("duration", "", "duration to rebuild (default all durations longer than 1m)")
+	from := flags.String("from", "", "start time (RFC3339, default all)")
+	to := flags.String("to", "", "end time (RFC3339, default now)")
+	flags.Parse(args)
+
+	var start, end time.Time
+	var err error
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			log.Fatalf("action=runRebuild err=%s", err.Error())
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			log.Fatalf("action=runRebuild err=%s", err.Error())
+		}
+	}
+	productCodes := config.Config.ProductCodes
+	if *product != "" {
+		productCodes = []string{*product}
+	}
+	var durations []time.Duration
+	for _, name := range config.Config.DurationNames {
+		if *durationName == "" || *durationName == name {
+			durations = append(durations, config.Config.Durations[name])
+		}
+	}
+	for _, productCode := range productCodes {
+		for _, duration := range durations {
+			if !models.IsResampledDuration(duration) {
+				continue
+			}
+			if err := models.RebuildCandles(productCode, duration, start, end); err != nil {
+				log.Fatalf("action=runRebuild product_code=%s duration=%s err=%s", productCode, duration, err.Error())
+			}
+		}
+	}
+}
+
+// fillgaps サブコマンドで既存のテーブルの抜けている期間を埋める function
+// 例: go run main.go fillgaps [-product BTC_JPY] [-duration 1m]
+// 1分より長い期間は1分足を埋めた後に rebuild で作り直す
+func runFillGaps(args []string) {
+	flags := flag.NewFlagSet("fillgaps", flag.ExitOnError)
+	product := flags.String("product", "", "product code (default all product_codes)")
+	durationName := flags.String("duration", "", "duration to fill (default all durations up to 1m)")
+	flags.Parse(args)
+
+	productCodes := config.Config.ProductCodes
+	if *product != "" {
+		productCodes = []string{*product}
+	}
+	for _, productCode := range productCodes {
+		for _, name := range config.Config.DurationNames {
+			duration := config.Config.Durations[name]
+			if (*durationName != "" && *durationName != name) || models.IsResampledDuration(duration) {
+				continue
+			}
+			if _, err := models.FillCandleGaps(productCode, duration, time.Time{}, time.Time{}); err != nil {
+				log.Fatalf("action=runFillGaps product_code=%s duration=%s err=%s", productCode, duration, err.Error())
+			}
+		}
+	}
+}
+
+// compact サブコマンドで config.ini の retention より古いキャンドルを上位の期間にまとめてから削除する function
+// 例: go run main.go compact [-vacuum]
+func runCompact(args []string) {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	vacuum := flags.Bool("vacuum", false, "VACUUM / ANALYZE after compaction")
+	flags.Parse(args)
+
+	models.NewCandleCompactor(config.Config.ProductCodes, config.Config.Durations, config.Config.Retentions).Compact(time.Now().UTC())
+	if *vacuum {
+		if err := models.Repo.Vacuum(); err != nil {
+			log.Fatalf("action=runCompact err=%s", err.Error())
+		}
+	}
+}
+
+// export サブコマンドでキャンドルか売買のイベントを CSV・Parquet に書き出す function
+// 例: go run main.go export -type candles -product BTC_USD -duration 1m -from 2020-01-01T00:00:00Z -to 2020-01-08T00:00:00Z -out btc_usd_1m.parquet
+// 例: go run main.go export -type events -product BTC_USD -out signal_events.csv
+// -format を指定しない場合は -out の拡張子から決める (ログも標準出力に出るので、ファイルに書き出す)
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	kind := flags.String("type", "candles", "candles or events")
+	product := flags.String("product", config.Config.ProductCode, "product code")
+	durationName := flags.String("duration", "1m", "duration of candles")
+	from := flags.String("from", "", "start time (RFC3339, default all)")
+	to := flags.String("to", "", "end time (RFC3339, default all)")
+	format := flags.String("format", "", "csv or parquet (default from the -out extension)")
+	out := flags.String("out", "", "output file")
+	flags.Parse(args)
+
+	var start, end time.Time
+	var err error
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			log.Fatalf("action=runExport err=%s", err.Error())
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			log.Fatalf("action=runExport err=%s", err.Error())
+		}
+	}
+	if *out == "" {
+		log.Fatalf("action=runExport err=-out is required")
+	}
+	if *format == "" {
+		*format = models.FormatFromFileName(*out)
+	}
+	w, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("action=runExport err=%s", err.Error())
+	}
+	defer w.Close()
+
+	var n int
+	switch *kind {
+	case "candles":
+		duration, ok := config.Config.Durations[*durationName]
+		if !ok {
+			log.Fatalf("action=runExport invalid duration=%s", *durationName)
+		}
+		n, err = models.ExportCandles(w, *format, *product, duration, start, end)
+	case "events":
+		n, err = models.ExportSignalEvents(w, *format, *product, start, end)
+	default:
+		log.Fatalf("action=runExport invalid type=%s", *kind)
+	}
+	if err != nil {
+		log.Fatalf("action=runExport err=%s", err.Error())
+	}
+	log.Printf("action=runExport type=%s product_code=%s format=%s rows=%d", *kind, *product, *format, n)
+}
+
+// import サブコマンドで CSV・Parquet のキャンドルか売買のイベントを DB に取り込む function
+// 例: go run main.go import -type candles -product BTC_USD -duration 1m -file bitstamp_btcusd_1m.csv
+// 例: go run main.go import -type events -file signal_events.parquet
+// 1分足を取り込んだ場合は、取り込んだ期間の上位の期間のキャンドルも作り直す
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	kind := flags.String("type", "candles", "candles or events")
+	product := flags.String("product", config.Config.ProductCode, "product code (for events without product_code)")
+	durationName := flags.String("duration", "1m", "duration of candles")
+	format := flags.String("format", "", "csv or parquet (default from the -file extension)")
+	file := flags.String("file", "", "input file")
+	flags.Parse(args)
+
+	if *format == "" {
+		*format = models.FormatFromFileName(*file)
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("action=runImport err=%s", err.Error())
+	}
+	defer f.Close()
+
+	switch *kind {
+	case "candles":
+		duration, ok := config.Config.Durations[*durationName]
+		if !ok {
+			log.Fatalf("action=runImport invalid duration=%s", *durationName)
+		}
+		candles, err := models.ReadCandles(f, *format, *product, duration)
+		if err != nil {
+			log.Fatalf("action=runImport file=%s err=%s", *file, err.Error())
+		}
+		if err := models.ImportCandles(candles); err != nil {
+			log.Fatalf("action=runImport err=%s", err.Error())
+		}
+		log.Printf("action=runImport type=candles product_code=%s duration=%s rows=%d", *product, duration, len(candles))
+		if duration != models.BaseDuration || len(candles) == 0 {
+			return
+		}
+		start, end := candles[0].Time, candles[len(candles)-1].Time.Add(duration)
+		for _, name := range config.Config.DurationNames {
+			resampled := config.Config.Durations[name]
+			if !models.IsResampledDuration(resampled) {
+				continue
+			}
+			if err := models.Repo.CreateCandleTables([]string{*product}, []time.Duration{resampled}); err != nil {
+				log.Fatalf("action=runImport err=%s", err.Error())
+			}
+			if err := models.RebuildCandles(*product, resampled, start, end); err != nil {
+				log.Fatalf("action=runImport duration=%s err=%s", resampled, err.Error())
+			}
+		}
+	case "events":
+		events, err := models.ReadSignalEvents(f, *format, *product)
+		if err != nil {
+			log.Fatalf("action=runImport file=%s err=%s", *file, err.Error())
+		}
+		saved, err := models.ImportSignalEvents(events)
+		if err != nil {
+			log.Fatalf("action=runImport err=%s", err.Error())
+		}
+		log.Printf("action=runImport type=events rows=%d saved=%d", len(events), saved)
+	default:
+		log.Fatalf("action=runImport invalid type=%s", *kind)
+	}
+}
+
+// migrate サブコマンドで DB のスキーマのマイグレーションを適用する、もしくは戻す function
+// 例: go run main.go migrate [-to 0] [-status]
+// -to を指定しない場合は最新まで適用する
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.Int("to", models.LatestSchemaVersion(), "schema version to migrate to (0 is the schema before migrations)")
+	status := flags.Bool("status", false, "show the current schema version only")
+	flags.Parse(args)
+
+	repo, err := models.OpenRepository(config.Config.SQLDriver, config.Config.DbName)
+	if err != nil {
+		log.Fatalf("action=runMigrate err=%s", err.Error())
+	}
+	defer repo.Close()
+	if !*status {
+		if err := repo.MigrateTo(*to); err != nil {
+			log.Fatalf("action=runMigrate err=%s", err.Error())
+		}
+	}
+	version, err := repo.SchemaVersion()
+	if err != nil {
+		log.Fatalf("action=runMigrate err=%s", err.Error())
+	}
+	log.Printf("action=runMigrate version=%d latest=%d", version, models.LatestSchemaVersion())
+}
+
 func main() {
+	// マイグレーションは DB を開く前に実行する (スキーマが新しすぎて起動できない時にも戻せるように)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	// スキーマを最新にしてから使う。DB の方が新しい場合は古いプログラムで壊さないように起動しない
+	if err := models.OpenDB(); err != nil {
+		log.Fatalf("action=main err=%s", err.Error())
+	}
+
+	utils.LoggingSettings(config.Config.LogFile)
+
+	// SIGINT / SIGTERM を受け取ったらキャンセルされる ctx
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// サブコマンドが指定された場合は、それだけを実行して終了する (インディケーターの最適化は行わない)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			runBackfill(ctx, os.Args[2:])
+			return
+		case "rebuild":
+			runRebuild(os.Args[2:])
+			return
+		case "fillgaps":
+			runFillGaps(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "compact":
+			runCompact(os.Args[2:])
+			return
+		}
+	}
+
 	// パフォーマンスが出るインディケーターのBest３を表示する
-	df, _ := models.GetAllCandle(config.Config.ProductCode, time.Minute, 365)
+	var df *models.DataFrameCandle
+	var err error
+	if config.Config.BackTestRange() {
+		df, err = models.GetCandlesBetween(config.Config.ProductCode, config.Config.TradeDuration, config.Config.BackTestFrom, config.Config.BackTestTo)
+	} else {
+		df, err = models.GetAllCandle(config.Config.ProductCode, config.Config.TradeDuration, 365)
+	}
+	if err != nil {
+		log.Fatalf("action=main err=%s", err.Error())
+	}
 	fmt.Printf("%+v\n", df.OptimizeParams())
 
-	utils.LoggingSettings(config.Config.LogFile)
+	// 停止していた間に抜けたキャンドルを作り直してからストリーミングを始める
+	if hours := config.Config.BackfillHours; hours > 0 {
+		now := time.Now()
+		for _, productCode := range config.Config.ProductCodes {
+			if err := controllers.Backfill(ctx, productCode, now.Add(-time.Duration(hours)*time.Hour), now, ""); err != nil {
+				log.Printf("action=main backfill product_code=%s err=%s", productCode, err.Error())
+			}
+		}
+	}
 
 	// ストリーミングされたデータを表示
-	controllers.StreamIngestionData()
+	ingestionDone, err := controllers.StreamIngestionData(ctx)
+	if err != nil {
+		log.Fatalf("action=main err=%s", err.Error())
+	}
 
 	// キャンドルスティックチャートを表示
-	log.Println(controllers.StartWebServer())
+	if err := controllers.StartWebServer(ctx); err != nil {
+		log.Println(err)
+		stop()
+	}
+
+	// ストリームを閉じて約定待ちの注文を確認し終わるまで待つ
+	<-ingestionDone
+	log.Println("shutdown completed")
 }